@@ -0,0 +1,517 @@
+package blameworthy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// A blame cache is a GitHistory saved in a compact binary form that
+// loads far faster than the git log it was parsed from. After its
+// header, it is a sequence of varints and of strings, each written as
+// its length followed by its bytes:
+//
+//	mode:    1 if the history follows merges, else 0
+//	authors: a count, then each author
+//	paths:   a count, then each path
+//	commits: a count, and how many of them are in the history's
+//	         Hashes, which come first and in order; then for each
+//	         commit its hash, author index, date, and number of diffs
+//	         followed by the diffs
+//	files:   a count, then for each file its path index and number of
+//	         diffs, and for each of those the index of its commit and
+//	         of the diff within the commit, or -1 and the diff itself
+//	         if the commit doesn't list it (as for a renamed file's
+//	         removal from its old path)
+//
+// A diff is its path index, old path index plus one (or 0), whether
+// it is a copy, its checksums and line counts before and after, and
+// its hunks as a count followed by four numbers apiece, and its origins
+// as a count followed by the index of each one's commit plus one (or
+// 0) and its line number.
+//
+// Files share the diffs of their commits, as they do in a parsed
+// history.
+
+const (
+	cacheMagic   = "livegrep blame cache\n"
+	cacheVersion = 3
+)
+
+type cacheWriter struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (c *cacheWriter) int(n int) {
+	k := binary.PutVarint(c.buf[:], int64(n))
+	c.w.Write(c.buf[:k])
+}
+
+func (c *cacheWriter) string(s string) {
+	c.int(len(s))
+	c.w.WriteString(s)
+}
+
+func (c *cacheWriter) diff(d *Diff, paths map[string]int, commits map[*Commit]int) {
+	c.int(paths[d.Path])
+	if d.OldPath == "" {
+		c.int(0)
+	} else {
+		c.int(paths[d.OldPath] + 1)
+	}
+	if d.IsCopy {
+		c.int(1)
+	} else {
+		c.int(0)
+	}
+	c.string(d.ChecksumBefore)
+	c.string(d.ChecksumAfter)
+	c.int(d.LineCountBefore)
+	c.int(d.LineCountAfter)
+	c.int(len(d.Hunks))
+	for _, h := range d.Hunks {
+		c.int(h.OldStart)
+		c.int(h.OldLength)
+		c.int(h.NewStart)
+		c.int(h.NewLength)
+	}
+	c.int(len(d.Origins))
+	for _, o := range d.Origins {
+		if o.Commit == nil {
+			c.int(0)
+		} else {
+			c.int(commits[o.Commit] + 1)
+		}
+		c.int(o.LineNumber)
+	}
+}
+
+// WriteCache writes the history to w as a blame cache.
+func (history *GitHistory) WriteCache(w io.Writer) error {
+	c := cacheWriter{w: bufio.NewWriter(w)}
+	c.w.WriteString(cacheMagic)
+	c.int(cacheVersion)
+	if history.WithMerges {
+		c.int(1)
+	} else {
+		c.int(0)
+	}
+
+	// Commits that only merges' origins refer to follow the others.
+	hashes := append([]string{}, history.Hashes...)
+	others := []string{}
+	commitIndex := make(map[*Commit]int, len(history.Commits))
+	for i, h := range hashes {
+		commit := history.Commits[h]
+		if commit == nil {
+			return fmt.Errorf("commit %s is missing from the history", h)
+		}
+		commitIndex[commit] = i
+	}
+	for h, commit := range history.Commits {
+		if _, ok := commitIndex[commit]; !ok {
+			others = append(others, h)
+		}
+	}
+	sort.Strings(others)
+	for _, h := range others {
+		commitIndex[history.Commits[h]] = len(hashes)
+		hashes = append(hashes, h)
+	}
+	authors := map[string]int{}
+	authorList := []string{}
+	for _, h := range hashes {
+		commit := history.Commits[h]
+		if _, ok := authors[commit.Author]; !ok {
+			authors[commit.Author] = len(authorList)
+			authorList = append(authorList, commit.Author)
+		}
+	}
+
+	filePaths := make([]string, 0, len(history.Files))
+	for path := range history.Files {
+		filePaths = append(filePaths, path)
+	}
+	sort.Strings(filePaths)
+	paths := map[string]int{}
+	pathList := []string{}
+	addPath := func(path string) {
+		if _, ok := paths[path]; !ok {
+			paths[path] = len(pathList)
+			pathList = append(pathList, path)
+		}
+	}
+	for _, path := range filePaths {
+		addPath(path)
+		for _, d := range history.Files[path] {
+			addPath(d.Path)
+			if d.OldPath != "" {
+				addPath(d.OldPath)
+			}
+		}
+	}
+	for _, h := range history.Hashes {
+		for _, d := range history.Commits[h].Diffs {
+			addPath(d.Path)
+			if d.OldPath != "" {
+				addPath(d.OldPath)
+			}
+		}
+	}
+
+	c.int(len(authorList))
+	for _, a := range authorList {
+		c.string(a)
+	}
+	c.int(len(pathList))
+	for _, p := range pathList {
+		c.string(p)
+	}
+	c.int(len(hashes))
+	c.int(len(history.Hashes))
+	for _, h := range hashes {
+		commit := history.Commits[h]
+		c.string(commit.Hash)
+		c.int(authors[commit.Author])
+		c.int(int(commit.Date))
+		c.int(len(commit.Diffs))
+		for _, d := range commit.Diffs {
+			for _, o := range d.Origins {
+				if _, ok := commitIndex[o.Commit]; o.Commit != nil && !ok {
+					return fmt.Errorf("%s in commit %s has a line from commit %s, which is missing from the history",
+						d.Path, commit.Hash, o.Commit.Hash)
+				}
+			}
+			c.diff(d, paths, commitIndex)
+		}
+	}
+	diffIndex := map[commitPath]int{}
+	for _, h := range hashes {
+		for k, d := range history.Commits[h].Diffs {
+			at := commitPath{d.Commit, d.Path}
+			if _, ok := diffIndex[at]; !ok {
+				diffIndex[at] = k
+			}
+		}
+	}
+	c.int(len(filePaths))
+	for _, path := range filePaths {
+		file := history.Files[path]
+		c.int(paths[path])
+		c.int(len(file))
+		for i := range file {
+			d := &file[i]
+			n, ok := commitIndex[d.Commit]
+			if !ok {
+				return fmt.Errorf("%s has a diff from commit %s, which is missing from the history",
+					path, d.Commit.Hash)
+			}
+			c.int(n)
+			k, ok := diffIndex[commitPath{d.Commit, d.Path}]
+			if !ok || !sameDiff(d.Commit.Diffs[k], d) {
+				k = -1
+			}
+			c.int(k)
+			if k == -1 {
+				c.diff(d, paths, commitIndex)
+			}
+		}
+	}
+	return c.w.Flush()
+}
+
+// commitPath identifies the diff a commit made to a path.
+type commitPath struct {
+	commit *Commit
+	path   string
+}
+
+func sameDiff(a, b *Diff) bool {
+	if a.OldPath != b.OldPath || a.IsCopy != b.IsCopy ||
+		a.ChecksumBefore != b.ChecksumBefore ||
+		a.ChecksumAfter != b.ChecksumAfter ||
+		a.LineCountBefore != b.LineCountBefore ||
+		a.LineCountAfter != b.LineCountAfter ||
+		len(a.Hunks) != len(b.Hunks) ||
+		len(a.Origins) != len(b.Origins) {
+		return false
+	}
+	for i := range a.Hunks {
+		if a.Hunks[i] != b.Hunks[i] {
+			return false
+		}
+	}
+	for i := range a.Origins {
+		if a.Origins[i] != b.Origins[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type cacheReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (c *cacheReader) int() int {
+	if c.err != nil {
+		return 0
+	}
+	n, err := binary.ReadVarint(c.r)
+	if err != nil {
+		c.err = err
+	}
+	return int(n)
+}
+
+func (c *cacheReader) count() int {
+	n := c.int()
+	if n < 0 {
+		c.fail("bad count %d", n)
+		return 0
+	}
+	return n
+}
+
+// maxPrealloc bounds the room made ahead of time for the items of a
+// count, which otherwise grow as they are read, so that a corrupt
+// count fails at the end of the input rather than asking for more
+// memory than there is.
+const maxPrealloc = 1 << 16
+
+func capacity(n int) int {
+	if n > maxPrealloc {
+		return maxPrealloc
+	}
+	return n
+}
+
+func (c *cacheReader) string() string {
+	n := c.count()
+	if c.err != nil {
+		return ""
+	}
+	if n > maxPrealloc {
+		var b strings.Builder
+		b.Grow(maxPrealloc)
+		if _, err := io.CopyN(&b, c.r, int64(n)); err != nil {
+			c.err = err
+		}
+		return b.String()
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		c.err = err
+	}
+	return string(buf)
+}
+
+// index reads an index into a table of n items, returning -1 if it
+// is out of range.
+func (c *cacheReader) index(n int) int {
+	i := c.int()
+	if c.err == nil && (i < 0 || i >= n) {
+		c.fail("index %d out of range", i)
+	}
+	if c.err != nil {
+		return -1
+	}
+	return i
+}
+
+// lookup reads an index into a table of strings.
+func (c *cacheReader) lookup(table []string) string {
+	if i := c.index(len(table)); i >= 0 {
+		return table[i]
+	}
+	return ""
+}
+
+// strings reads a count, then that many strings.
+func (c *cacheReader) strings() []string {
+	n := c.count()
+	table := make([]string, 0, capacity(n))
+	for ; n > 0 && c.err == nil; n-- {
+		table = append(table, c.string())
+	}
+	return table
+}
+
+func (c *cacheReader) fail(format string, args ...interface{}) {
+	if c.err == nil {
+		c.err = fmt.Errorf("corrupt blame cache: "+format, args...)
+	}
+}
+
+// commitList holds the commits of a cache as they are read. An origin
+// can refer to a commit that comes later, whose place is kept until
+// the commits have all been read.
+type commitList struct {
+	n       int // commits in the cache
+	commits []*Commit
+	later   []laterOrigin
+}
+
+type laterOrigin struct {
+	origin *BlameLine
+	index  int
+}
+
+// resolve fills in the origins that referred to later commits.
+func (l *commitList) resolve() {
+	for _, o := range l.later {
+		o.origin.Commit = l.commits[o.index]
+	}
+	l.later = nil
+}
+
+func (c *cacheReader) diff(commit *Commit, paths []string, commits *commitList) Diff {
+	d := Diff{Commit: commit}
+	d.Path = c.lookup(paths)
+	if i := c.index(len(paths) + 1); i > 0 {
+		d.OldPath = paths[i-1]
+	}
+	d.IsCopy = c.int() != 0
+	d.ChecksumBefore = c.string()
+	d.ChecksumAfter = c.string()
+	d.LineCountBefore = c.int()
+	d.LineCountAfter = c.int()
+	n := c.count()
+	d.Hunks = make([]Hunk, 0, capacity(n))
+	for ; n > 0 && c.err == nil; n-- {
+		d.Hunks = append(d.Hunks, Hunk{c.int(), c.int(), c.int(), c.int()})
+	}
+	if n := c.count(); n > 0 {
+		d.Origins = make([]BlameLine, 0, capacity(n))
+		indexes := []int{}
+		for ; n > 0 && c.err == nil; n-- {
+			j := c.index(commits.n + 1)
+			d.Origins = append(d.Origins, BlameLine{nil, c.int()})
+			indexes = append(indexes, j-1)
+		}
+		for i, j := range indexes {
+			if j < 0 {
+				continue
+			} else if j < len(commits.commits) {
+				d.Origins[i].Commit = commits.commits[j]
+			} else {
+				commits.later = append(commits.later, laterOrigin{&d.Origins[i], j})
+			}
+		}
+	}
+	return d
+}
+
+// isCache reports whether the input starts like a blame cache rather
+// than a git log.
+func isCache(input *bufio.Reader) bool {
+	header, _ := input.Peek(len(cacheMagic))
+	return bytes.Equal(header, []byte(cacheMagic))
+}
+
+// ReadCache reads a history written by WriteCache.
+func ReadCache(input io.Reader) (*GitHistory, error) {
+	c := cacheReader{r: bufio.NewReader(input)}
+	if !isCache(c.r) {
+		return nil, fmt.Errorf("not a blame cache")
+	}
+	c.r.Discard(len(cacheMagic))
+	if v := c.int(); c.err == nil && v != cacheVersion {
+		return nil, fmt.Errorf("blame cache has version %d, not %d", v, cacheVersion)
+	}
+	withMerges := c.int() == 1
+
+	authors := c.strings()
+	paths := c.strings()
+
+	commits := commitList{n: c.count()}
+	commits.commits = make([]*Commit, 0, capacity(commits.n))
+	history := &GitHistory{WithMerges: withMerges}
+	n := c.count()
+	if c.err == nil && n > commits.n {
+		c.fail("%d commits in Hashes, out of %d", n, commits.n)
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	history.Hashes = make([]string, 0, capacity(n))
+	history.Commits = make(map[string]*Commit, capacity(commits.n))
+	for i := 0; i < commits.n; i++ {
+		commit := &Commit{}
+		commit.Hash = c.string()
+		commit.Author = c.lookup(authors)
+		commit.Date = int32(c.int())
+		k := c.count()
+		diffs := make([]Diff, 0, capacity(k))
+		for ; k > 0 && c.err == nil; k-- {
+			diffs = append(diffs, c.diff(commit, paths, &commits))
+		}
+		if c.err != nil {
+			return nil, c.err
+		}
+		commit.Diffs = make([]*Diff, len(diffs))
+		for k := range diffs {
+			commit.Diffs[k] = &diffs[k]
+		}
+		if i < n {
+			history.Hashes = append(history.Hashes, commit.Hash)
+		}
+		history.Commits[commit.Hash] = commit
+		commits.commits = append(commits.commits, commit)
+	}
+	commits.resolve()
+
+	n = c.count()
+	history.Files = make(map[string]File, capacity(n))
+	for ; n > 0 && c.err == nil; n-- {
+		path := c.lookup(paths)
+		m := c.count()
+		file := make(File, 0, capacity(m))
+		for ; m > 0; m-- {
+			j := c.index(len(commits.commits))
+			k := c.int()
+			if c.err != nil {
+				return nil, c.err
+			}
+			commit := commits.commits[j]
+			if k == -1 {
+				file = append(file, c.diff(commit, paths, &commits))
+			} else if k >= 0 && k < len(commit.Diffs) {
+				file = append(file, *commit.Diffs[k])
+			} else {
+				c.fail("diff %d out of range", k)
+			}
+			if c.err != nil {
+				return nil, c.err
+			}
+		}
+		history.Files[path] = file
+	}
+	if c.err != nil {
+		if c.err == io.EOF {
+			c.err = io.ErrUnexpectedEOF
+		}
+		return nil, c.err
+	}
+	return history, nil
+}
+
+// ReadHistory reads a history from either a blame cache or a git log,
+// which is parsed with ParseGitLogWithMerges if withMerges is true.
+func ReadHistory(input io.Reader, withMerges bool) (*GitHistory, error) {
+	r := bufio.NewReader(input)
+	if isCache(r) {
+		return ReadCache(r)
+	}
+	if withMerges {
+		return ParseGitLogWithMerges(ioutil.NopCloser(r))
+	}
+	return ParseGitLog(ioutil.NopCloser(r))
+}
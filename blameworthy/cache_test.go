@@ -0,0 +1,82 @@
+package blameworthy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	file, err := os.Open("test_data/git-log.renames")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	history, err := ParseGitLog(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := history.WriteCache(&buf); err != nil {
+		t.Fatal(err)
+	}
+	cache := buf.Bytes()
+
+	loaded, err := ReadHistory(bytes.NewReader(cache), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.WithMerges {
+		t.Errorf("Cache read back as following merges")
+	}
+	if s, wanted := summarize(loaded), summarize(history); s != wanted {
+		t.Errorf("Cache read back wrongly\nWanted: %v\nActual: %v", wanted, s)
+	}
+	for _, h := range history.Hashes {
+		a, b := history.Commits[h], loaded.Commits[h]
+		if a.Author != b.Author || a.Date != b.Date || len(a.Diffs) != len(b.Diffs) {
+			t.Errorf("Commit %s read back as %v, not %v", h, *b, *a)
+		}
+	}
+
+	// Files share the hunks of their commits' diffs.
+	last := loaded.Commits[loaded.Hashes[3]]
+	d := loaded.Files["d.txt"]
+	if &last.Diffs[1].Hunks[0] != &d[len(d)-1].Hunks[0] {
+		t.Errorf("d.txt's last diff isn't its commit's")
+	}
+
+	for _, bad := range [][]byte{
+		cache[:len(cache)-1],
+		bytes.Replace(cache, []byte("cache\n\x06"), []byte("cache\n\x08"), 1),
+		[]byte("commit 0123"),
+	} {
+		if _, err := ReadCache(bytes.NewReader(bad)); err == nil {
+			t.Errorf("Read a bad cache without error: %q", bad)
+		}
+	}
+	_, err = ReadCache(bytes.NewReader(bytes.Replace(cache, []byte("cache\n\x06"), []byte("cache\n\x08"), 1)))
+	if err == nil || !strings.Contains(err.Error(), "version 4") {
+		t.Errorf("Wanted a version error, got %v", err)
+	}
+
+	// Huge counts fail at the end of the input rather than asking
+	// for the memory to hold what they count.
+	huge := make([]byte, binary.MaxVarintLen64)
+	huge = huge[:binary.PutVarint(huge, 1<<62)]
+	header := cacheMagic + "\x06\x00"
+	for _, prefix := range []string{
+		header,                      // authors
+		header + "\x02",             // an author's name
+		header + "\x00\x00",         // commits
+		header + "\x00\x00\x02\x00", // a commit's hash
+	} {
+		bad := append([]byte(prefix), huge...)
+		if _, err := ReadCache(bytes.NewReader(bad)); err == nil {
+			t.Errorf("Read a cache with a huge count without error: %q", bad)
+		}
+	}
+}
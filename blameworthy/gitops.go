@@ -16,6 +16,9 @@ type GitHistory struct {
 	Hashes  []string
 	Commits map[string]*Commit
 	Files   map[string]File
+	// WithMerges is set on a history parsed with
+	// ParseGitLogWithMerges.
+	WithMerges bool
 }
 
 type Commit struct {
@@ -28,13 +31,23 @@ type Commit struct {
 type File []Diff
 
 type Diff struct {
-	Commit          *Commit
-	Path            string
+	Commit *Commit
+	Path   string
+	// OldPath is set if the commit renamed or copied the file here
+	// from another path, whose diffs then precede this one in the
+	// file's history.
+	OldPath         string
+	IsCopy          bool
 	ChecksumBefore  string
 	ChecksumAfter   string
 	LineCountBefore int
 	LineCountAfter  int
 	Hunks           []Hunk
+	// Origins is set on a merge's diff, in a history parsed with
+	// ParseGitLogWithMerges, to the commits and lines that first
+	// wrote each line the hunks add, in order. A nil Commit means
+	// the merge wrote the line itself.
+	Origins []BlameLine
 }
 
 type Hunk struct {
@@ -45,37 +58,114 @@ type Hunk struct {
 }
 
 func RunGitLog(repository_path string, revision string) (io.ReadCloser, error) {
-	cmd := exec.Command("git",
+	return runGitLog(repository_path,
+		"--format=commit %H%nAuthor: %ae%nDate: %cd",
+
+		// Treat a merge as a simple diff against its 1st parent:
+		"--first-parent",
+		"-m",
+
+		revision,
+	)
+}
+
+// RunGitLogWithMerges logs every commit that revision descends from,
+// diffing each merge against all of its parents, for
+// ParseGitLogWithMerges to read.
+func RunGitLogWithMerges(repository_path string, revision string) (io.ReadCloser, error) {
+	return runGitLog(repository_path,
+		// With a custom format, git leaves out the header of a
+		// merge's diff against a parent that it matches; this
+		// one names the parent in every header instead.
+		"--pretty=fuller",
+		"--parents",
+		"-m",
+		"--topo-order",
+
+		revision,
+	)
+}
+
+func runGitLog(repository_path string, args ...string) (io.ReadCloser, error) {
+	args = append([]string{
 		"-C", repository_path,
 		"log",
 		"-U0",
-		"--format=commit %H%nAuthor: %ae%nDate: %cd",
 		"--date=format:%Y%m%d",
 		"--full-index",
 		"--no-prefix",
-		"--no-renames",
+		"--find-renames",
+		"--find-copies",
 		"--reverse",
 
 		// Avoid invoking custom diff commands or conversions.
 		"--no-ext-diff",
 		"--no-textconv",
-
-		// Treat a merge as a simple diff against its 1st parent:
-		"--first-parent",
-		"-m",
-
-		revision,
-	)
+	}, args...)
+	cmd := exec.Command("git", args...)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return nil, err
 	}
-	//defer cmd.Wait()  // drat, when will we do this?
 	err = cmd.Start()
 	if err != nil {
 		return nil, err
 	}
-	return stdout, nil
+	return &gitLogReader{stdout, cmd}, nil
+}
+
+// gitLogReader reads the output of `git log`, waiting for git to
+// exit when it is closed.
+type gitLogReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (r *gitLogReader) Close() error {
+	r.ReadCloser.Close()
+	return r.cmd.Wait()
+}
+
+// IsAncestor reports whether commit is an ancestor of revision, as it
+// is when revision has only moved forward since commit was logged.
+func IsAncestor(repository_path string, commit string, revision string) (bool, error) {
+	err := exec.Command("git",
+		"-C", repository_path,
+		"merge-base", "--is-ancestor", commit, revision,
+	).Run()
+	if _, ok := err.(*exec.ExitError); ok {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// IsFirstParentAncestor reports whether commit is on revision's chain
+// of first parents. Only then does the log of "<commit>..<revision>"
+// from RunGitLog, which follows first parents, continue a history
+// that ends at commit; revision may instead have reached it through
+// a merge's other parent.
+func IsFirstParentAncestor(repository_path string, commit string, revision string) (bool, error) {
+	ok, err := IsAncestor(repository_path, commit, revision)
+	if err != nil || !ok {
+		return false, err
+	}
+	// The walk stops at the first commit whose first parent is
+	// an ancestor of commit; that parent must be commit itself.
+	out, err := exec.Command("git",
+		"-C", repository_path,
+		"rev-list", "--first-parent", "--parents", "^"+commit, revision,
+	).Output()
+	if err != nil {
+		return false, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	oldest := strings.Fields(lines[len(lines)-1])
+	if len(oldest) == 0 {
+		return true, nil // revision is commit
+	}
+	return len(oldest) > 1 && strings.HasPrefix(oldest[1], commit), nil
 }
 
 // Given an input stream from `git log`, print out an abbreviated form
@@ -98,9 +188,14 @@ func StripGitLog(input io.Reader) error {
 		if strings.HasPrefix(line, "commit ") {
 		} else if strings.HasPrefix(line, "Author: ") {
 		} else if strings.HasPrefix(line, "Date: ") {
+		} else if strings.HasPrefix(line, "CommitDate: ") {
 		} else if strings.HasPrefix(line, "index ") {
 		} else if strings.HasPrefix(line, "--- ") {
 		} else if strings.HasPrefix(line, "+++ ") {
+		} else if strings.HasPrefix(line, "rename from ") {
+		} else if strings.HasPrefix(line, "rename to ") {
+		} else if strings.HasPrefix(line, "copy from ") {
+		} else if strings.HasPrefix(line, "copy to ") {
 		} else if strings.HasPrefix(line, "@@ ") {
 			rest := line[3:]
 			i := strings.Index(rest, " @@")
@@ -131,6 +226,110 @@ func StripGitLog(input io.Reader) error {
 }
 
 func ParseGitLog(input_stream io.ReadCloser) (*GitHistory, error) {
+	history := newGitHistory()
+	err := history.parse(input_stream)
+	return history, err
+}
+
+func newGitHistory() *GitHistory {
+	history := GitHistory{}
+	history.Commits = make(map[string]*Commit)
+	history.Files = make(map[string]File)
+	return &history
+}
+
+// Extend returns a new history with the commits in input_stream, which
+// must be the log of the commits that follow this history's last one
+// (say, from RunGitLog with the range "<last hash>..HEAD"), added to
+// it. The history itself is left unchanged so that it can go on being
+// used while the new one is built. If there are no new commits, the
+// history itself is returned.
+func (history *GitHistory) Extend(input_stream io.Reader) (*GitHistory, error) {
+	input := bufio.NewReader(input_stream)
+	if _, err := input.Peek(1); err == io.EOF {
+		return history, nil
+	}
+
+	n := len(history.Hashes)
+	extended := GitHistory{WithMerges: history.WithMerges}
+	extended.Hashes = history.Hashes[:n:n]
+	extended.Commits = make(map[string]*Commit, len(history.Commits))
+	for k, v := range history.Commits {
+		extended.Commits[k] = v
+	}
+	// Appending to a File can't disturb readers of the old
+	// history, which only look as far as its old length.
+	extended.Files = make(map[string]File, len(history.Files))
+	for k, v := range history.Files {
+		extended.Files[k] = v
+	}
+	if err := extended.parse(input); err != nil {
+		return nil, err
+	}
+	return &extended, nil
+}
+
+// parse adds the commits in a `git log` to the history.
+func (history *GitHistory) parse(input_stream io.Reader) error {
+	return scanGitLog(input_stream, func(lc *logCommit) {
+		history.add(lc.commit, lc.firstParentDiffs())
+	})
+}
+
+// A logCommit is a commit as a `git log` shows it. A log that follows
+// merges diffs them against each of their parents in turn; others
+// list the diffs against the first parent alone, without naming it.
+type logCommit struct {
+	commit  *Commit
+	parents []string
+	from    []string // the parent that each list of diffs is against
+	diffs   [][]*logDiff
+}
+
+// A logDiff is the change a commit made to one file.
+type logDiff struct {
+	path     string
+	oldPath  string // set if the file was renamed or copied here
+	isCopy   bool
+	created  bool
+	changed  bool // false if the file was only renamed or copied
+	checksum string
+	hunks    []Hunk
+}
+
+func (lc *logCommit) diffsFrom(parent string) []*logDiff {
+	for i, p := range lc.from {
+		if p == parent {
+			return lc.diffs[i]
+		}
+	}
+	return nil
+}
+
+func (lc *logCommit) firstParent() string {
+	if len(lc.parents) == 0 {
+		return ""
+	}
+	return lc.parents[0]
+}
+
+func (lc *logCommit) firstParentDiffs() []*logDiff {
+	return lc.diffsFrom(lc.firstParent())
+}
+
+// diff returns the commit's diff of the path against the parent, or
+// nil if the file is the same in both.
+func (lc *logCommit) diff(parent string, path string) *logDiff {
+	for _, d := range lc.diffsFrom(parent) {
+		if d.path == path {
+			return d
+		}
+	}
+	return nil
+}
+
+// scanGitLog reads a `git log`, passing each of its commits to emit.
+func scanGitLog(input_stream io.Reader, emit func(*logCommit)) error {
 	scanner := bufio.NewScanner(input_stream)
 
 	// Give the scanner permission to read very long lines, to
@@ -139,19 +338,18 @@ func ParseGitLog(input_stream io.ReadCloser) (*GitHistory, error) {
 	buf := make([]byte, 64*1024)
 	scanner.Buffer(buf, 1024*1024*1024)
 
-	history := GitHistory{}
-	history.Commits = make(map[string]*Commit)
-	history.Files = make(map[string]File)
-
-	commits := history.Commits
-	files := history.Files
-
 	authors := map[string]string{} // dedup authors
 
-	var commit_hash string
+	var lc *logCommit
 	var checksum string
-	var commit *Commit
-	var diff *Diff
+	var diff *logDiff
+
+	// A rename or copy is announced by a "from" line and a "to"
+	// line; the latter begins the diff, which "---" and "+++" lines
+	// for the new path continue if the file's content changed too.
+	var move_from string
+	var move_is_copy bool
+	var moved *logDiff
 
 	// A dash after the second "@@" is a signal from our command
 	// `strip-git-log` that it has removed the "+" and "-" lines
@@ -162,39 +360,75 @@ func ParseGitLog(input_stream io.ReadCloser) (*GitHistory, error) {
 	for scanner.Scan() {
 		line := scanner.Text()
 		if strings.HasPrefix(line, "commit ") {
-			commit_hash = line[7 : 7+HashLength]
-			history.Hashes = append(history.Hashes, commit_hash)
-			commit = &Commit{commit_hash, "", 0, nil}
-			commits[commit_hash] = commit
+			// With --parents, the commit's parents follow its
+			// hash, and with -m each of a merge's diffs says
+			// which parent it is against: "(from <parent>)".
+			from := ""
+			if i := strings.Index(line, " (from "); i != -1 {
+				from = shortHash(strings.TrimSuffix(line[i+7:], ")"))
+				line = line[:i]
+			}
+			fields := strings.Fields(line[7:])
+			commit_hash := shortHash(fields[0])
+			if lc == nil || lc.commit.Hash != commit_hash {
+				if lc != nil {
+					emit(lc)
+				}
+				lc = &logCommit{commit: &Commit{commit_hash, "", 0, nil}}
+				for _, p := range fields[1:] {
+					lc.parents = append(lc.parents, shortHash(p))
+				}
+			}
+			if from == "" && len(lc.parents) > 0 {
+				from = lc.parents[0]
+			}
+			lc.from = append(lc.from, from)
+			lc.diffs = append(lc.diffs, nil)
+			moved = nil
 		} else if strings.HasPrefix(line, "index ") {
 			groups := index_re.FindStringSubmatch(line)
 			if groups == nil {
 				continue
 			}
 			checksum = emptyZero(groups[2])
+		} else if strings.HasPrefix(line, "rename from ") {
+			move_from = line[12:]
+			move_is_copy = false
+		} else if strings.HasPrefix(line, "copy from ") {
+			move_from = line[10:]
+			move_is_copy = true
+		} else if strings.HasPrefix(line, "rename to ") ||
+			strings.HasPrefix(line, "copy to ") {
+			path := line[strings.Index(line, " to ")+4:]
+			diff = &logDiff{path: path, oldPath: move_from, isCopy: move_is_copy}
+			lc.addDiff(diff)
+			moved = diff
+			checksum = ""
 		} else if strings.HasPrefix(line, "--- ") {
-			path := line[4:]
+			old_path := line[4:]
 			scanner.Scan() // read the "+++" line
+			path := scanner.Text()[4:]
 			if path == "/dev/null" {
-				line2 := scanner.Text()
-				path = line2[4:]
+				path = old_path
 			}
-			checksumBefore := ""
-			lineCountBefore := 0
-			if files[path] != nil {
-				i := len(files[path]) - 1
-				checksumBefore = files[path][i].ChecksumAfter
-				lineCountBefore = files[path][i].LineCountAfter
+			if moved != nil && moved.path == path {
+				// The file was changed as well as moved.
+				moved.changed = true
+				moved.checksum = checksum
+				checksum = ""
+				diff = moved
+				moved = nil
+				continue
+			}
+			moved = nil
+			diff = &logDiff{
+				path:     path,
+				created:  old_path == "/dev/null",
+				changed:  true,
+				checksum: checksum,
 			}
-			files[path] = append(files[path], Diff{
-				commit, path,
-				checksumBefore, checksum,
-				lineCountBefore, lineCountBefore,
-				[]Hunk{},
-			})
 			checksum = ""
-			diff = &files[path][len(files[path])-1]
-			commit.Diffs = append(commit.Diffs, diff)
+			lc.addDiff(diff)
 		} else if strings.HasPrefix(line, "@@ ") {
 			groups := hunk_re.FindStringSubmatch(line)
 			if groups == nil {
@@ -211,9 +445,8 @@ func ParseGitLog(input_stream io.ReadCloser) (*GitHistory, error) {
 				NewLength, _ = strconv.Atoi(groups[4])
 			}
 
-			diff.Hunks = append(diff.Hunks,
+			diff.hunks = append(diff.hunks,
 				Hunk{OldStart, OldLength, NewStart, NewLength})
-			diff.LineCountAfter += NewLength - OldLength
 
 			// Expect no unified diff if hunk header ends in "@@-"
 			is_stripped := len(groups[5]) > 0
@@ -223,21 +456,148 @@ func ParseGitLog(input_stream io.ReadCloser) (*GitHistory, error) {
 					scanner.Scan()
 				}
 			}
-		} else if len(commit.Author) == 0 && strings.HasPrefix(line, "Author: ") {
+		} else if len(lc.commit.Author) == 0 && strings.HasPrefix(line, "Author: ") {
 			a := strings.TrimSpace(line[8:])
+			// Keep only the email of a "Name <email>" author.
+			if i := strings.LastIndex(a, "<"); i != -1 && strings.HasSuffix(a, ">") {
+				a = a[i+1 : len(a)-1]
+			}
 			a2, ok := authors[a]
-			if ok {
-				commit.Author = a2
-			} else {
+			if !ok {
 				authors[a] = a
+				a2 = a
 			}
-		} else if commit.Date == 0 && strings.HasPrefix(line, "Date: ") {
+			lc.commit.Author = a2
+		} else if lc.commit.Date == 0 && strings.HasPrefix(line, "Date: ") {
 			// TODO: also learn to parse normal "git log" dates?
 			n, _ := strconv.Atoi(line[6:])
-			commit.Date = int32(n)
+			lc.commit.Date = int32(n)
+		} else if lc.commit.Date == 0 && strings.HasPrefix(line, "CommitDate: ") {
+			n, _ := strconv.Atoi(strings.TrimSpace(line[12:]))
+			lc.commit.Date = int32(n)
+		}
+	}
+	if lc != nil {
+		emit(lc)
+	}
+	return scanner.Err()
+}
+
+func (lc *logCommit) addDiff(diff *logDiff) {
+	i := len(lc.diffs) - 1
+	lc.diffs[i] = append(lc.diffs[i], diff)
+}
+
+// add appends a commit, with its diffs against its first parent, to
+// the history.
+func (history *GitHistory) add(commit *Commit, diffs []*logDiff) {
+	files := history.Files
+	history.Hashes = append(history.Hashes, commit.Hash)
+	history.Commits[commit.Hash] = commit
+
+	// The histories, as they stood before the commit, of the paths
+	// it has changed so far, and the paths it has moved files to.
+	// Moves start from these, so that the order in which git lists
+	// a commit's files doesn't matter.
+	var before map[string]File
+	var move_targets map[string]bool
+	touch := func(path string) {
+		if before == nil {
+			before = map[string]File{}
+			move_targets = map[string]bool{}
+		}
+		if _, ok := before[path]; !ok {
+			before[path] = files[path]
+		}
+	}
+	history_before := func(path string) File {
+		if f, ok := before[path]; ok {
+			return f
 		}
+		return files[path]
 	}
-	return &history, scanner.Err()
+
+	for _, d := range diffs {
+		path := d.path
+		if d.oldPath != "" {
+			source := history_before(d.oldPath)
+			touch(path)
+			touch(d.oldPath)
+			move_targets[path] = true
+
+			checksumBefore := ""
+			lineCountBefore := 0
+			if len(source) > 0 {
+				i := len(source) - 1
+				checksumBefore = source[i].ChecksumAfter
+				lineCountBefore = source[i].LineCountAfter
+			}
+			checksumAfter := checksumBefore
+			if d.changed {
+				checksumAfter = d.checksum
+			}
+			// The file's history at its new path starts with
+			// its history at the old one.
+			f := make(File, len(source), len(source)+1)
+			copy(f, source)
+			files[path] = append(f, Diff{
+				commit, path, d.oldPath, d.isCopy,
+				checksumBefore, checksumAfter,
+				lineCountBefore, lineCountBefore + lineDelta(d.hunks),
+				d.hunks, nil,
+			})
+
+			// A rename removes the file from its old path,
+			// unless another move in this commit replaced it.
+			// Git doesn't list this as a diff of its own, so
+			// neither do we.
+			if !d.isCopy && len(source) > 0 && !move_targets[d.oldPath] {
+				removal := Diff{
+					commit, d.oldPath, "", false,
+					checksumBefore, "",
+					lineCountBefore, 0,
+					[]Hunk{}, nil,
+				}
+				if lineCountBefore > 0 {
+					removal.Hunks = append(removal.Hunks,
+						Hunk{1, lineCountBefore, 0, 0})
+				}
+				files[d.oldPath] = append(files[d.oldPath], removal)
+			}
+		} else {
+			touch(path)
+			checksumBefore := ""
+			lineCountBefore := 0
+			if files[path] != nil {
+				i := len(files[path]) - 1
+				checksumBefore = files[path][i].ChecksumAfter
+				lineCountBefore = files[path][i].LineCountAfter
+			}
+			files[path] = append(files[path], Diff{
+				commit, path, "", false,
+				checksumBefore, d.checksum,
+				lineCountBefore, lineCountBefore + lineDelta(d.hunks),
+				d.hunks, nil,
+			})
+		}
+		commit.Diffs = append(commit.Diffs, &files[path][len(files[path])-1])
+	}
+}
+
+// lineDelta returns the number of lines that hunks add to a file.
+func lineDelta(hunks []Hunk) int {
+	n := 0
+	for _, h := range hunks {
+		n += h.NewLength - h.OldLength
+	}
+	return n
+}
+
+func shortHash(hash string) string {
+	if len(hash) > HashLength {
+		return hash[:HashLength]
+	}
+	return hash
 }
 
 // Substitute the empty string for an all-zero git hash.
@@ -2,7 +2,9 @@ package blameworthy
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"sort"
 	"strings"
 	"testing"
 )
@@ -39,3 +41,160 @@ func test_log_parsing_file(t *testing.T, path string) {
 		)
 	}
 }
+
+func TestRenameParsing(t *testing.T) {
+	test_rename_parsing_file(t, "test_data/git-log.renames")
+	test_rename_parsing_file(t, "test_data/git-log.renames.stripped")
+}
+
+func test_rename_parsing_file(t *testing.T, path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	history, err := ParseGitLog(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Name the four commits c1 through c4.
+	name := func(s string) string {
+		for i, h := range history.Hashes {
+			s = strings.Replace(s, h, fmt.Sprint("c", i+1), -1)
+		}
+		return s
+	}
+
+	paths := []string{"a.txt", "b.txt", "c.txt", "d.txt"}
+	a := []string{}
+	for _, p := range paths {
+		a = append(a, fmt.Sprint(p, " -> "))
+		for _, d := range history.Files[p] {
+			a = append(a, fmt.Sprintf("{%v %v %q %v %v %d}",
+				d.Commit.Hash, d.Path, d.OldPath, d.IsCopy,
+				d.Hunks, d.LineCountAfter))
+		}
+	}
+	actual := name(strings.Join(a, ""))
+	wanted := "a.txt -> " +
+		`{c1 a.txt "" false [{0 0 1 5}] 5}` +
+		`{c2 a.txt "" false [{1 5 0 0}] 0}` +
+		"b.txt -> " +
+		`{c1 a.txt "" false [{0 0 1 5}] 5}` +
+		`{c2 b.txt "a.txt" false [] 5}` +
+		`{c3 b.txt "" false [{1 5 0 0}] 0}` +
+		"c.txt -> " +
+		`{c1 a.txt "" false [{0 0 1 5}] 5}` +
+		`{c2 b.txt "a.txt" false [] 5}` +
+		`{c3 c.txt "b.txt" false [{2 1 2 1}] 5}` +
+		`{c4 c.txt "" false [{5 1 5 1}] 5}` +
+		"d.txt -> " +
+		`{c1 a.txt "" false [{0 0 1 5}] 5}` +
+		`{c2 b.txt "a.txt" false [] 5}` +
+		`{c3 c.txt "b.txt" false [{2 1 2 1}] 5}` +
+		`{c4 d.txt "c.txt" true [{1 1 1 1}] 5}`
+	if actual != wanted {
+		t.Fatalf(
+			"Git log parsed incorrectly\nWanted: %v\nActual: %v",
+			wanted, actual,
+		)
+	}
+	if n := len(history.Commits[history.Hashes[3]].Diffs); n != 2 {
+		t.Errorf("Wanted 2 diffs in the last commit, got %d", n)
+	}
+
+	// Lines are blamed on the commits that wrote them, whatever
+	// the file was called then.
+	var tests = []struct {
+		path     string
+		expected string
+	}{
+		{"c.txt", "[{c1 1} {c3 2} {c1 3} {c1 4} {c4 5}]"},
+		{"d.txt", "[{c4 1} {c3 2} {c1 3} {c1 4} {c1 5}]"},
+	}
+	for _, test := range tests {
+		r, err := history.FileBlame(history.Hashes[3], test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := fmt.Sprint(r.BlameVector)
+		for _, h := range history.Hashes {
+			out = strings.Replace(out,
+				fmt.Sprintf("%p", history.Commits[h]), h, -1)
+		}
+		if out = name(out); out != test.expected {
+			t.Errorf("Blame of %s\n  Wanted %s\n  Got    %s",
+				test.path, test.expected, out)
+		}
+	}
+
+	// DiffBlame of a move compares it with the file's old path.
+	r, err := history.DiffBlame(history.Hashes[2], "c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.PreviousCommitHash != history.Hashes[1] {
+		t.Errorf("Wanted previous commit %s, got %s",
+			history.Hashes[1], r.PreviousCommitHash)
+	}
+	if p, err := history.PathAt(r.PreviousCommitHash, "c.txt"); err != nil || p != "b.txt" {
+		t.Errorf("Wanted c.txt to be b.txt before it moved, got %q (%v)", p, err)
+	}
+}
+
+func TestExtend(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/git-log.renames")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := string(data)
+	full, err := ParseGitLog(ioutil.NopCloser(strings.NewReader(log)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Split the log before its third commit.
+	i := strings.Index(log, "\ncommit ")
+	i += strings.Index(log[i+1:], "\ncommit ") + 2
+	old, err := ParseGitLog(ioutil.NopCloser(strings.NewReader(log[:i])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldSummary := summarize(old)
+
+	same, err := old.Extend(strings.NewReader(""))
+	if err != nil || same != old {
+		t.Errorf("Extending by no commits gave %v, %v", same, err)
+	}
+
+	extended, err := old.Extend(strings.NewReader(log[i:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, wanted := summarize(extended), summarize(full); s != wanted {
+		t.Errorf("Extended history is wrong\nWanted: %v\nActual: %v", wanted, s)
+	}
+	if s := summarize(old); s != oldSummary {
+		t.Errorf("Extending changed the old history\nWanted: %v\nActual: %v", oldSummary, s)
+	}
+}
+
+// summarize describes a history, listing its files in order.
+func summarize(history *GitHistory) string {
+	paths := []string{}
+	for p := range history.Files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	a := []string{fmt.Sprint(history.Hashes, len(history.Commits))}
+	for _, p := range paths {
+		a = append(a, fmt.Sprint(" ", p, " -> "))
+		for _, d := range history.Files[p] {
+			a = append(a, fmt.Sprintf("{%v %v %q %v %v %d}",
+				d.Commit.Hash, d.Path, d.OldPath, d.IsCopy,
+				d.Hunks, d.LineCountAfter))
+		}
+	}
+	return strings.Join(a, "")
+}
@@ -91,7 +91,7 @@ func (history GitHistory) FileBlameWithStart(start_commit, target_commit, path s
 	anchor_commit.Hash = start_commit
 	segments := BlameSegments{{initial_line_count, 1, &anchor_commit}}
 	for i := indices[0]; i < indices[1]; i++ {
-		segments = fileHistory[i].step(segments)
+		segments = fileHistory[i].stepForward(segments)
 	}
 	return segments.flatten(), nil
 }
@@ -139,12 +139,23 @@ func (history GitHistory) FindCommit(commitHash string, path string) (File, int,
 	return fileHistory, indices[0], nil
 }
 
+// PathAt returns the path, at the given commit, of the file whose
+// history is known by path. It differs from path if the file has since
+// been renamed or copied there.
+func (history GitHistory) PathAt(commitHash string, path string) (string, error) {
+	fileHistory, i, err := history.FindCommit(commitHash, path)
+	if err != nil {
+		return "", err
+	}
+	return fileHistory[i-1].Path, nil
+}
+
 func blame(history File, end int, bump int) (BlameVector, BlameVector) {
 	segments := BlameSegments{}
 	var i int
 	for i = 0; i < end+bump; i++ {
 		commit := history[i]
-		segments = commit.step(segments)
+		segments = commit.stepForward(segments)
 	}
 	blameVector := segments.flatten()
 	for ; i < len(history); i++ {
@@ -172,6 +183,16 @@ func getHash(history File, i int) string {
 }
 
 func (diff Diff) step(oldb BlameSegments) BlameSegments {
+	return diff.stepWith(oldb, nil)
+}
+
+// stepForward is like step, but blames the lines a merge brought in
+// from another branch on the commits there that wrote them.
+func (diff Diff) stepForward(oldb BlameSegments) BlameSegments {
+	return diff.stepWith(oldb, diff.Origins)
+}
+
+func (diff Diff) stepWith(oldb BlameSegments, origins []BlameLine) BlameSegments {
 	newb := BlameSegments{}
 	olineno := 1
 	nlineno := 1
@@ -225,11 +246,32 @@ func (diff Diff) step(oldb BlameSegments) BlameSegments {
 		// olineno += linecount
 		// fmt.Print("skip done")
 	}
+	added := 0
 	add := func(linecount int, commit *Commit) {
 		// fmt.Print("add ", linecount, commit_hash, "\n")
-		start := nlineno
-		newb = append(newb, BlameSegment{linecount, start, commit})
-		nlineno += linecount
+		if origins == nil {
+			start := nlineno
+			newb = append(newb, BlameSegment{linecount, start, commit})
+			nlineno += linecount
+			return
+		}
+		first := len(newb)
+		for ; linecount > 0; linecount-- {
+			o := BlameLine{commit, nlineno}
+			if added < len(origins) && origins[added].Commit != nil {
+				o = origins[added]
+			}
+			added++
+			// Runs of lines from the same commit share a segment.
+			n := len(newb) - 1
+			if n >= first && newb[n].Commit == o.Commit &&
+				newb[n].LineStart+newb[n].LineCount == o.LineNumber {
+				newb[n].LineCount++
+			} else {
+				newb = append(newb, BlameSegment{1, o.LineNumber, o.Commit})
+			}
+			nlineno++
+		}
 	}
 
 	for _, h := range diff.Hunks {
@@ -272,11 +314,15 @@ func reverse_in_place(diffs File) {
 }
 
 func (segments BlameSegments) wipe() BlameSegments {
+	return BlameSegments{{segments.lineCount(), 1, nil}}
+}
+
+func (segments BlameSegments) lineCount() int {
 	n := 0
 	for _, segment := range segments {
 		n += segment.LineCount
 	}
-	return BlameSegments{{n, 1, nil}}
+	return n
 }
 
 func (segments BlameSegments) flatten() BlameVector {
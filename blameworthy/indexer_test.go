@@ -7,7 +7,7 @@ import (
 )
 
 func mkDiff(commit *Commit, path string, hunks []Hunk) Diff {
-	return Diff{commit, path, "before", "after", 0, 0, hunks}
+	return Diff{commit, path, "", false, "before", "after", 0, 0, hunks, nil}
 }
 
 func TestStepping(t *testing.T) {
@@ -101,6 +101,27 @@ func TestStepping(t *testing.T) {
 	}
 }
 
+func TestStepForward(t *testing.T) {
+	a1 := &Commit{"a1", "", 0, nil}
+	b2 := &Commit{"b2", "", 0, nil}
+	m3 := &Commit{"m3", "", 0, nil}
+
+	// A merge adds three lines, the first two of which another
+	// branch wrote.
+	merge := mkDiff(m3, "test.txt", []Hunk{{1, 0, 2, 3}})
+	merge.Origins = []BlameLine{{b2, 4}, {b2, 5}, {nil, 4}}
+	segments := BlameSegments{{3, 1, a1}}
+
+	out := fmt.Sprint(merge.stepForward(segments), merge.step(segments))
+	out = strings.Replace(out, fmt.Sprintf("%p", a1), "a1", -1)
+	out = strings.Replace(out, fmt.Sprintf("%p", b2), "b2", -1)
+	out = strings.Replace(out, fmt.Sprintf("%p", m3), "m3", -1)
+	wanted := "[{1 1 a1} {2 4 b2} {1 4 m3} {2 2 a1}] [{1 1 a1} {3 2 m3} {2 2 a1}]"
+	if out != wanted {
+		t.Errorf("Wanted %s\n  Got    %s", wanted, out)
+	}
+}
+
 func TestAtMethod(t *testing.T) {
 	a1 := &Commit{"a1", "", 0, nil}
 	b2 := &Commit{"b2", "", 0, nil}
@@ -184,7 +205,7 @@ func TestAtMethod(t *testing.T) {
 		// Build full GitHistory based on this one lone file history.
 		gh := GitHistory{[]string{}, nil, map[string]File{
 			"path": test.inputCommits,
-		}}
+		}, false}
 		for _, c := range test.inputCommits {
 			gh.Hashes = append(gh.Hashes, c.Commit.Hash)
 		}
@@ -233,6 +254,7 @@ func TestPreviousAndNext(t *testing.T) {
 					mkDiff(d4, "test.txt", []Hunk{{2, 1, 2, 1}}),
 				},
 			},
+			false,
 		},
 		[]string{
 			"file README does not exist at commit a1",
@@ -285,6 +307,7 @@ func TestFindCommit(t *testing.T) {
 					mkDiff(c3, "README", []Hunk{{2, 1, 2, 1}}),
 				},
 			},
+			false,
 		},
 		[]string{
 			"file README does not exist at commit a1", "1", "2", "2",
@@ -330,6 +353,7 @@ func TestFindCommits(t *testing.T) {
 					mkDiff(d4, "README", []Hunk{{2, 1, 2, 1}}),
 				},
 			},
+			false,
 		},
 		[][]string{
 			{"a1", "b2"},
@@ -0,0 +1,263 @@
+package blameworthy
+
+import (
+	"io"
+	"sort"
+)
+
+// ParseGitLogWithMerges reads a log written by RunGitLogWithMerges.
+// As with ParseGitLog, the history's Hashes and Files follow the first
+// parents back from the last commit in the log. But the lines that a
+// merge along the way brought in from another branch are blamed, via
+// the Origins of its diffs, on the commits there that wrote them. Those
+// commits join the history's Commits, without any Diffs.
+func ParseGitLogWithMerges(input_stream io.ReadCloser) (*GitHistory, error) {
+	b := mergeBuilder{
+		history:   newGitHistory(),
+		commits:   map[string]*logCommit{},
+		blames:    map[fileAt]BlameSegments{},
+		mainlines: map[fileSteps]BlameSegments{},
+	}
+	b.history.WithMerges = true
+	var last *logCommit
+	err := scanGitLog(input_stream, func(lc *logCommit) {
+		b.commits[lc.commit.Hash] = lc
+		last = lc
+	})
+	if err != nil {
+		return b.history, err
+	}
+	if last != nil {
+		b.build(last)
+	}
+	return b.history, nil
+}
+
+type mergeBuilder struct {
+	history  *GitHistory
+	commits  map[string]*logCommit
+	position map[string]int // of each first-parent commit in Hashes
+
+	// Blames of files at commits off the first-parent line, and
+	// at the first-parent commits that their branches start from.
+	// A nil blame is one that can't be known.
+	blames    map[fileAt]BlameSegments
+	mainlines map[fileSteps]BlameSegments
+}
+
+type fileAt struct {
+	hash string
+	path string
+}
+
+// fileSteps is a file after the first n diffs in its history.
+type fileSteps struct {
+	path string
+	n    int
+}
+
+func (b *mergeBuilder) build(last *logCommit) {
+	mainline := []*logCommit{}
+	for lc := last; lc != nil; {
+		mainline = append(mainline, lc)
+		if len(lc.parents) == 0 {
+			break
+		}
+		lc = b.commits[lc.parents[0]]
+	}
+
+	b.position = make(map[string]int, len(mainline))
+	for i := len(mainline) - 1; i >= 0; i-- {
+		lc := mainline[i]
+		b.position[lc.commit.Hash] = len(b.history.Hashes)
+		b.history.add(lc.commit, lc.firstParentDiffs())
+		if len(lc.parents) > 1 {
+			for _, d := range lc.commit.Diffs {
+				d.Origins = b.origins(lc, d.Path, d.Hunks, d.LineCountAfter)
+			}
+		}
+	}
+	for hash, lc := range b.commits {
+		if _, ok := b.history.Commits[hash]; !ok {
+			b.history.Commits[hash] = lc.commit
+		}
+	}
+}
+
+// origins returns where the lines that a merge's hunks add to a file,
+// compared with its first parent, came from. A line that one of the
+// other parents already had is blamed on whatever that parent blames
+// it on; the rest are left to the merge, with a nil Commit. If every
+// line is the merge's own, nil is returned.
+func (b *mergeBuilder) origins(lc *logCommit, path string, hunks []Hunk, lineCount int) []BlameLine {
+	type side struct {
+		lines  []int
+		vector BlameVector
+	}
+	sides := []side{}
+	for _, parent := range lc.parents[1:] {
+		d := lc.diff(parent, path)
+		parentPath := path
+		var parentHunks []Hunk
+		if d != nil {
+			if d.created {
+				continue
+			}
+			if d.oldPath != "" {
+				parentPath = d.oldPath
+			}
+			parentHunks = d.hunks
+		}
+		segments, ok := b.blame(parent, parentPath)
+		if !ok {
+			continue
+		}
+		sides = append(sides, side{lineMap(parentHunks, lineCount), segments.flatten()})
+	}
+
+	origins := []BlameLine{}
+	found := false
+	for _, h := range hunks {
+		for n := h.NewStart; n < h.NewStart+h.NewLength; n++ {
+			o := BlameLine{nil, n}
+			for _, s := range sides {
+				if n >= len(s.lines) {
+					continue
+				}
+				i := s.lines[n]
+				if i > 0 && i <= len(s.vector) && s.vector[i-1].Commit != nil {
+					o = s.vector[i-1]
+					found = true
+					break
+				}
+			}
+			origins = append(origins, o)
+		}
+	}
+	if !found {
+		return nil
+	}
+	return origins
+}
+
+// blame returns the blame of a file as it was at a commit, or false
+// if that can't be known.
+func (b *mergeBuilder) blame(hash string, path string) (BlameSegments, bool) {
+	at := fileAt{hash, path}
+	if segments, ok := b.blames[at]; ok {
+		return segments, segments != nil
+	}
+
+	// Walk back along the commit's first parents until reaching
+	// the first-parent line of the history, the file's creation,
+	// or a blame worked out before, then step forward again.
+	type change struct {
+		lc   *logCommit
+		path string
+		diff *logDiff
+	}
+	changes := []change{}
+	var segments BlameSegments
+	for {
+		if pos, ok := b.position[hash]; ok {
+			segments = b.mainlineBlame(pos, path)
+			break
+		}
+		if s, ok := b.blames[fileAt{hash, path}]; ok {
+			segments = s
+			break
+		}
+		lc := b.commits[hash]
+		if lc == nil {
+			break // a commit the log doesn't include
+		}
+		d := lc.diff(lc.firstParent(), path)
+		changes = append(changes, change{lc, path, d})
+		if len(lc.parents) == 0 || d != nil && d.created {
+			segments = BlameSegments{}
+			break
+		}
+		if d != nil && d.oldPath != "" {
+			path = d.oldPath
+		}
+		hash = lc.parents[0]
+	}
+
+	for i := len(changes) - 1; i >= 0 && segments != nil; i-- {
+		c := changes[i]
+		if c.diff == nil {
+			continue
+		}
+		if !fits(c.diff.hunks, segments.lineCount()) {
+			segments = nil
+			break
+		}
+		diff := Diff{Commit: c.lc.commit, Hunks: c.diff.hunks}
+		if len(c.lc.parents) > 1 {
+			lineCount := segments.lineCount() + lineDelta(c.diff.hunks)
+			diff.Origins = b.origins(c.lc, c.path, c.diff.hunks, lineCount)
+		}
+		segments = diff.stepForward(segments)
+	}
+	b.blames[at] = segments
+	return segments, segments != nil
+}
+
+// mainlineBlame returns the blame of a file at the commit in position
+// pos of the history, or nil if it can't be known.
+func (b *mergeBuilder) mainlineBlame(pos int, path string) BlameSegments {
+	file := b.history.Files[path]
+	n := sort.Search(len(file), func(i int) bool {
+		return b.position[file[i].Commit.Hash] > pos
+	})
+	at := fileSteps{path, n}
+	if segments, ok := b.mainlines[at]; ok {
+		return segments
+	}
+	segments := BlameSegments{}
+	for _, d := range file[:n] {
+		if !fits(d.Hunks, segments.lineCount()) {
+			segments = nil
+			break
+		}
+		segments = d.stepForward(segments)
+	}
+	b.mainlines[at] = segments
+	return segments
+}
+
+// fits reports whether hunks can apply to a file of lineCount lines.
+func fits(hunks []Hunk, lineCount int) bool {
+	for _, h := range hunks {
+		if h.OldStart+h.OldLength-1 > lineCount {
+			return false
+		}
+	}
+	return true
+}
+
+// lineMap maps each line of a file after a diff with the given hunks
+// to its line before the diff, or to 0 if the diff added it.
+func lineMap(hunks []Hunk, lineCount int) []int {
+	m := make([]int, lineCount+1)
+	n, old := 1, 1
+	for _, h := range hunks {
+		// A hunk that adds or removes nothing gives the line
+		// before its position, rather than the first line.
+		newStart, oldStart := h.NewStart, h.OldStart
+		if h.NewLength == 0 {
+			newStart++
+		}
+		if h.OldLength == 0 {
+			oldStart++
+		}
+		for ; n < newStart && n <= lineCount; n, old = n+1, old+1 {
+			m[n] = old
+		}
+		n, old = newStart+h.NewLength, oldStart+h.OldLength
+	}
+	for ; n <= lineCount; n, old = n+1, old+1 {
+		m[n] = old
+	}
+	return m
+}
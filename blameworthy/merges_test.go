@@ -0,0 +1,120 @@
+package blameworthy
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMergeParsing(t *testing.T) {
+	test_merge_parsing_file(t, "test_data/git-log.merges")
+	test_merge_parsing_file(t, "test_data/git-log.merges.stripped")
+}
+
+// The commits of test_data/git-log.merges, where "merge" merges
+// side1 and side2 into main1, rewriting the first line, and "ours"
+// merges g (a child of side1) but keeps none of its changes.
+var mergeCommits = map[string]string{
+	"9f118b71119a6b5e": "base",
+	"d7cd802ed9a27c59": "main1",
+	"dd5efe22c1ffcf1a": "side1",
+	"89224e5a43dad62b": "side2",
+	"e11f6ffcfe34bb23": "merge",
+	"37af76825f495838": "g",
+	"5bf9d3f9a8c60ff5": "ours",
+}
+
+func test_merge_parsing_file(t *testing.T, path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	history, err := ParseGitLogWithMerges(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check_merge_history(t, history)
+
+	// A cache keeps where merged lines came from.
+	var buf bytes.Buffer
+	if err := history.WriteCache(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := ReadCache(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check_merge_history(t, loaded)
+}
+
+func check_merge_history(t *testing.T, history *GitHistory) {
+	name := func(s string) string {
+		for h, n := range mergeCommits {
+			s = strings.Replace(s, h, n, -1)
+			if c := history.Commits[h]; c != nil {
+				s = strings.Replace(s, fmt.Sprintf("%p", c), n, -1)
+			}
+		}
+		return s
+	}
+
+	if !history.WithMerges {
+		t.Errorf("Wanted the history to be marked as following merges")
+	}
+
+	// Only the first parents are in the history proper.
+	if s := name(fmt.Sprint(history.Hashes)); s != "[base main1 merge ours]" {
+		t.Errorf("Wanted the first-parent commits, got %s", s)
+	}
+	if n := len(history.Commits); n != len(mergeCommits) {
+		t.Errorf("Wanted %d commits, got %d", len(mergeCommits), n)
+	}
+	side := history.Commits["dd5efe22c1ffcf1a"]
+	if side == nil || side.Author != "side@example.com" || side.Date != 20180102 {
+		t.Errorf("Side commit read as %v", side)
+	}
+	if _, ok := history.Files["g.txt"]; ok {
+		t.Errorf("g.txt, which was never merged, has a history")
+	}
+
+	var tests = []struct {
+		path     string
+		expected string
+	}{
+		{"f.txt", "[{merge 1} {side1 2} {base 3} {main1 4} {base 5} {side2 6}]"},
+		{"h.txt", "[{side1 1} {side1 2}]"},
+	}
+	for _, test := range tests {
+		r, err := history.FileBlame(history.Hashes[3], test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out := name(fmt.Sprint(r.BlameVector)); out != test.expected {
+			t.Errorf("Blame of %s\n  Wanted %s\n  Got    %s",
+				test.path, test.expected, out)
+		}
+	}
+}
+
+func TestLineMap(t *testing.T) {
+	var tests = []struct {
+		hunks     []Hunk
+		lineCount int
+		expected  string
+	}{
+		{nil, 3, "[1 2 3]"},
+		{[]Hunk{{0, 0, 1, 2}}, 4, "[0 0 1 2]"},
+		{[]Hunk{{1, 1, 1, 1}, {4, 0, 5, 1}}, 5, "[0 2 3 4 0]"},
+		{[]Hunk{{2, 2, 1, 0}}, 2, "[1 4]"},
+	}
+	for _, test := range tests {
+		m := lineMap(test.hunks, test.lineCount)
+		if s := fmt.Sprint(m[1:]); s != test.expected {
+			t.Errorf("lineMap(%v, %d)\n  Wanted %s\n  Got    %s",
+				test.hunks, test.lineCount, test.expected, s)
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/livegrep/livegrep/server/api"
+)
+
+// How long to wait after a keystroke before searching, as the web UI
+// does.
+const searchDelay = 100 * time.Millisecond
+
+const (
+	keyUp = -(iota + 1)
+	keyDown
+	keyPageUp
+	keyPageDown
+)
+
+const (
+	keyCtrlC     = 0x03
+	keyCtrlN     = 0x0e
+	keyCtrlO     = 0x0f
+	keyCtrlP     = 0x10
+	keyCtrlU     = 0x15
+	keyEnter     = '\r'
+	keyEscape    = 0x1b
+	keyBackspace = 0x7f
+)
+
+// tty is the terminal, switched into raw mode while lg -i runs.
+type tty struct {
+	f     *os.File
+	in    *bufio.Reader
+	saved string
+
+	mu      sync.Mutex
+	cond    *sync.Cond // signalled when paused or reading changes
+	paused  bool
+	reading bool // readKey is waiting for input
+}
+
+func (t *tty) stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = t.f
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+func openTTY() (*tty, error) {
+	f, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Opening terminal: %s", err.Error())
+	}
+	t := &tty{f: f, in: bufio.NewReader(f)}
+	t.cond = sync.NewCond(&t.mu)
+	if t.saved, err = t.stty("-g"); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Reading terminal settings: %s", err.Error())
+	}
+	if err := t.enter(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// enter switches to raw mode and the alternate screen.
+func (t *tty) enter() error {
+	if _, err := t.stty("raw", "-echo"); err != nil {
+		return fmt.Errorf("Setting terminal mode: %s", err.Error())
+	}
+	fmt.Fprint(t.f, "\x1b[?1049h")
+	return nil
+}
+
+// leave puts the terminal back the way we found it.
+func (t *tty) leave() {
+	fmt.Fprint(t.f, "\x1b[?1049l")
+	t.stty(t.saved)
+}
+
+func (t *tty) close() {
+	t.leave()
+	t.f.Close()
+}
+
+func (t *tty) size() (rows, cols int) {
+	rows, cols = 24, 80
+	out, err := t.stty("size")
+	if err != nil {
+		return
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return
+	}
+	if r, err := strconv.Atoi(fields[0]); err == nil && r > 0 {
+		rows = r
+	}
+	if c, err := strconv.Atoi(fields[1]); err == nil && c > 0 {
+		cols = c
+	}
+	return
+}
+
+// pause stops readKey from reading the terminal until resume is
+// called, interrupting a read that is waiting for input, so that
+// another program can be given the terminal without readKey taking
+// what is typed into it.
+func (t *tty) pause() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.paused = true
+	if err := t.f.SetReadDeadline(time.Now()); err != nil {
+		return // the read can't be interrupted
+	}
+	for t.reading {
+		t.cond.Wait()
+	}
+}
+
+func (t *tty) resume() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.f.SetReadDeadline(time.Time{})
+	t.paused = false
+	t.cond.Broadcast()
+}
+
+// readKey reads one keystroke, waiting while the terminal is paused.
+func (t *tty) readKey() (rune, error) {
+	for {
+		t.mu.Lock()
+		for t.paused {
+			t.cond.Wait()
+		}
+		t.reading = true
+		t.mu.Unlock()
+
+		k, err := t.decodeKey()
+
+		t.mu.Lock()
+		t.reading = false
+		interrupted := t.paused
+		t.cond.Broadcast()
+		t.mu.Unlock()
+		if !interrupted || !os.IsTimeout(err) {
+			return k, err
+		}
+	}
+}
+
+// decodeKey reads one keystroke, decoding the escape sequences for
+// the arrow and page keys.
+func (t *tty) decodeKey() (rune, error) {
+	r, _, err := t.in.ReadRune()
+	if err != nil || r != keyEscape {
+		return r, err
+	}
+	// A bare escape is not followed by anything straight away.
+	if t.in.Buffered() == 0 {
+		return keyEscape, nil
+	}
+	if b, _ := t.in.ReadByte(); b != '[' && b != 'O' {
+		return keyEscape, nil
+	}
+	b, err := t.in.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	switch b {
+	case 'A':
+		return keyUp, nil
+	case 'B':
+		return keyDown, nil
+	case '5', '6':
+		t.in.ReadByte() // the trailing '~'
+		if b == '5' {
+			return keyPageUp, nil
+		}
+		return keyPageDown, nil
+	}
+	return 0, nil
+}
+
+// searchReply is the answer to the search for a query.
+type searchReply struct {
+	seq   int
+	reply *api.ReplySearch
+	err   error
+}
+
+// browser is the state of an interactive search.
+type browser struct {
+	t *tty
+
+	query   string
+	seq     int // incremented whenever the query changes
+	status  string
+	results []*api.Result
+
+	selected int
+	top      int // the first result shown
+}
+
+// runInteractive searches as the user types a query, showing the
+// results in a list from which they can open a match in $EDITOR or
+// print its path:lno and exit.
+func runInteractive(client *http.Client, query string) error {
+	t, err := openTTY()
+	if err != nil {
+		return err
+	}
+	defer t.close()
+
+	keys := make(chan rune)
+	keyErrs := make(chan error, 1)
+	go func() {
+		for {
+			k, err := t.readKey()
+			if err != nil {
+				keyErrs <- err
+				return
+			}
+			keys <- k
+		}
+	}()
+
+	replies := make(chan searchReply)
+	var timer *time.Timer
+	b := &browser{t: t, query: query}
+	warnf = func(format string, args ...interface{}) {
+		b.status = "warning: " + fmt.Sprintf(format, args...)
+	}
+	schedule := func() {
+		b.seq++
+		if timer != nil {
+			timer.Stop()
+		}
+		if b.query == "" {
+			b.results, b.status = nil, ""
+			return
+		}
+		seq, q := b.seq, buildQuery([]string{b.query})
+		timer = time.AfterFunc(searchDelay, func() {
+			reply, err := search(client, searchURL(q, false))
+			replies <- searchReply{seq: seq, reply: reply, err: err}
+		})
+		b.status = "Searching..."
+	}
+	schedule()
+
+	for {
+		b.draw()
+		select {
+		case err := <-keyErrs:
+			return err
+		case r := <-replies:
+			if r.seq != b.seq {
+				continue // the query has changed since
+			}
+			b.show(r.reply, r.err)
+		case k := <-keys:
+			switch k {
+			case keyCtrlC, keyEscape:
+				return nil
+			case keyUp, keyCtrlP:
+				b.move(-1)
+			case keyDown, keyCtrlN:
+				b.move(1)
+			case keyPageUp:
+				b.move(-b.pageSize())
+			case keyPageDown:
+				b.move(b.pageSize())
+			case keyEnter:
+				if r := b.current(); r != nil {
+					if err := b.edit(r); err != nil {
+						b.status = err.Error()
+					}
+				}
+			case keyCtrlO:
+				if r := b.current(); r != nil {
+					t.close()
+					fmt.Printf("%s:%d\n", editPath(r), r.LineNumber)
+					os.Exit(exitMatch)
+				}
+			case keyBackspace, '\b':
+				if q := []rune(b.query); len(q) > 0 {
+					b.query = string(q[:len(q)-1])
+					schedule()
+				}
+			case keyCtrlU:
+				b.query = ""
+				schedule()
+			default:
+				if k >= ' ' {
+					b.query += string(k)
+					schedule()
+				}
+			}
+		}
+	}
+}
+
+func (b *browser) show(reply *api.ReplySearch, err error) {
+	b.selected, b.top = 0, 0
+	if err != nil {
+		b.results, b.status = nil, err.Error()
+		return
+	}
+	b.results = reply.Results
+	b.status = fmt.Sprintf("%d matches", len(b.results))
+	if reply.Info != nil && reply.Info.ExitReason != "" && reply.Info.ExitReason != "NONE" {
+		b.status += fmt.Sprintf(" (%s)", reply.Info.ExitReason)
+	}
+	for _, e := range reply.Errors {
+		b.status += fmt.Sprintf("; %s: %s", e.Backend, e.Message)
+	}
+}
+
+func (b *browser) current() *api.Result {
+	if b.selected < len(b.results) {
+		return b.results[b.selected]
+	}
+	return nil
+}
+
+// pageSize is the number of results that fit on the screen below the
+// prompt and status lines.
+func (b *browser) pageSize() int {
+	rows, _ := b.t.size()
+	if rows < 3 {
+		return 1
+	}
+	return rows - 2
+}
+
+func (b *browser) move(n int) {
+	b.selected += n
+	if b.selected >= len(b.results) {
+		b.selected = len(b.results) - 1
+	}
+	if b.selected < 0 {
+		b.selected = 0
+	}
+}
+
+// edit opens r in $EDITOR, giving it the terminal while it runs.
+func (b *browser) edit(r *api.Result) error {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	b.t.pause()
+	defer b.t.resume()
+	b.t.leave()
+	defer b.t.enter()
+	cmd := exec.Command("sh", "-c", editor+` "$@"`, editor,
+		"+"+strconv.Itoa(r.LineNumber), editPath(r))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = b.t.f, b.t.f, b.t.f
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Running %s: %s", editor, err.Error())
+	}
+	return nil
+}
+
+// editPath is the file to open for r: its local checkout if there is
+// one, and otherwise its path relative to the current directory.
+func editPath(r *api.Result) string {
+	if local, ok := localPath(r.Tree, r.Version, r.Path); ok {
+		return local
+	}
+	return r.Path
+}
+
+// truncate cuts s to n characters, keeping bounds within it.
+func truncate(s string, n int, bounds [2]int) (string, [2]int) {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s, bounds
+	}
+	runes = runes[:n]
+	bounds[0], bounds[1] = minInt(bounds[0], n), minInt(bounds[1], n)
+	return string(runes), bounds
+}
+
+func (b *browser) draw() {
+	rows, cols := b.t.size()
+	p := &printer{color: true}
+
+	var buf strings.Builder
+	buf.WriteString("\x1b[H\x1b[2J")
+	prompt, _ := truncate("> "+b.query, cols, [2]int{})
+	status, _ := truncate(b.status, cols, [2]int{})
+	buf.WriteString(prompt + "\r\n")
+	buf.WriteString(p.paint(colorSep, status))
+
+	page := rows - 2
+	if b.selected < b.top {
+		b.top = b.selected
+	} else if page > 0 && b.selected >= b.top+page {
+		b.top = b.selected - page + 1
+	}
+	for i := b.top; i < len(b.results) && i < b.top+page; i++ {
+		r := b.results[i]
+		prefix := fmt.Sprintf("%s:%d: ", resultPrefix(r.Tree, r.Version, r.Path), r.LineNumber)
+		width := cols - len([]rune(prefix))
+		if width < 0 {
+			width = 0
+		}
+		line, bounds := truncate(strings.Replace(r.Line, "\t", " ", -1), width, r.Bounds)
+		buf.WriteString("\r\n")
+		if i == b.selected {
+			buf.WriteString("\x1b[7m" + prefix + line + colorReset)
+			continue
+		}
+		buf.WriteString(p.paint(colorFile, prefix) + p.highlight(line, bounds))
+	}
+
+	// Leave the cursor at the end of the query.
+	fmt.Fprintf(&buf, "\x1b[1;%dH", minInt(len([]rune(prompt))+1, cols))
+	fmt.Fprint(b.t.f, buf.String())
+}
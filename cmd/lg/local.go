@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// localDirs is a flag mapping tree names to local checkouts, given as
+// TREE=DIR. It may be given more than once, including in ~/.lgrc as
+//
+//	local = livegrep=/home/me/src/livegrep
+type localDirs map[string]string
+
+func (m localDirs) String() string {
+	var pairs []string
+	for tree, dir := range m {
+		pairs = append(pairs, tree+"="+dir)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m localDirs) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i <= 0 || i == len(v)-1 {
+		return fmt.Errorf("expected TREE=DIR, not %q", v)
+	}
+	dir := v[i+1:]
+	if strings.HasPrefix(dir, "~/") {
+		dir = filepath.Join(os.Getenv("HOME"), dir[2:])
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	m[v[:i]] = abs
+	return nil
+}
+
+var (
+	localTrees = make(localDirs)
+
+	// The trees whose checkouts have been compared to the index.
+	checkedTrees = make(map[string]bool)
+
+	// warnf reports a checkout that doesn't match the index. lg -i
+	// shows warnings in its status line instead.
+	warnf = func(format string, args ...interface{}) {
+		fmt.Fprintf(os.Stderr, "lg: warning: "+format+"\n", args...)
+	}
+)
+
+// localPath returns where a result's file is in the local checkout of
+// its tree, if there is one. The first time it sees each tree, it warns
+// if the checkout is not at the version that was searched.
+func localPath(tree, version, path string) (string, bool) {
+	dir, ok := localTrees[tree]
+	if !ok {
+		return "", false
+	}
+	if !checkedTrees[tree] {
+		checkedTrees[tree] = true
+		checkLocalVersion(tree, dir, version)
+	}
+	return filepath.Join(dir, filepath.FromSlash(path)), true
+}
+
+// displayPath is how to print a result's file: its absolute local path
+// if its tree is checked out, and otherwise tree:version:path.
+func displayPath(tree, version, path string) string {
+	if local, ok := localPath(tree, version, path); ok {
+		return local
+	}
+	return resultPrefix(tree, version, path)
+}
+
+func revParse(dir, rev string) (string, error) {
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "--verify", "-q", rev+"^{commit}").Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+func checkLocalVersion(tree, dir, version string) {
+	if version == "" {
+		return
+	}
+	head, err := revParse(dir, "HEAD")
+	if err != nil {
+		warnf("can't find HEAD of %s in %s", tree, dir)
+		return
+	}
+	indexed, err := revParse(dir, version)
+	if err != nil {
+		warnf("%s was indexed at %s, which is not in %s; line numbers may be off",
+			tree, version, dir)
+		return
+	}
+	if head != indexed {
+		warnf("%s is at %.12s, but was indexed at %.12s; line numbers may be off",
+			dir, head, indexed)
+	}
+}
@@ -4,53 +4,136 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/livegrep/livegrep/server/api"
 	"github.com/nelhage/go.cli/config"
 )
 
+// Exit statuses, as for grep.
+const (
+	exitMatch   = 0
+	exitNoMatch = 1
+	exitError   = 2
+)
+
+// stringList is a flag that may be given more than once.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
 var (
 	server      = flag.String("server", "http://localhost:8910", "The livegrep server to connect to")
 	unixSocket  = flag.String("unix_socket", "", "unix socket path to connect() to as a proxy")
 	showVersion = flag.Bool("show_version", false, "Show versions of matched packages")
+	stream      = flag.Bool("stream", false, "Print results as the server finds them")
+
+	afterContext  = flag.Int("A", -1, "Print `NUM` lines of context after each match")
+	beforeContext = flag.Int("B", -1, "Print `NUM` lines of context before each match")
+	contextFlag   int
+
+	filesWithMatches = flag.Bool("l", false, "Print only the names of files with matches")
+	count            = flag.Bool("c", false, "Print only the number of matches in each file")
+	jsonOutput       = flag.Bool("json", false, "Print the server's reply as JSON")
+	color            = flag.String("color", "auto", "Highlight matches: `WHEN` is always, never or auto")
+	interactive      = flag.Bool("i", false, "Search interactively as you type")
+	column           = flag.Bool("column", false, "Print the column of each match, for vim's quickfix or emacs' compilation mode")
+
+	repoFilters stringList
+	fileFilters stringList
 )
 
-func main() {
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [flags] REGEX\n", os.Args[0])
-		flag.PrintDefaults()
+func init() {
+	flag.IntVar(&contextFlag, "C", -1, "Print `NUM` lines of context around each match")
+	flag.IntVar(&contextFlag, "context", -1, "Same as -C")
+	flag.Var(&repoFilters, "repo", "Only search repositories matching `REGEX` (may be repeated)")
+	flag.Var(&fileFilters, "file", "Only search files matching `REGEX` (may be repeated)")
+	flag.Var(localTrees, "local", "Print paths in `TREE=DIR`, a local checkout of TREE, as absolute paths (may be repeated)")
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format, args...)
+	os.Exit(exitError)
+}
+
+// buildQuery turns the arguments and filter flags into a query.
+func buildQuery(args []string) string {
+	terms := []string{strings.Join(args, " ")}
+	for _, r := range repoFilters {
+		terms = append(terms, "repo:"+r)
 	}
-	if err := config.LoadConfig(flag.CommandLine, "lgrc"); err != nil {
-		fmt.Fprintf(os.Stderr, "Loading config: %s\n", err)
-		os.Exit(1)
+	for _, f := range fileFilters {
+		terms = append(terms, "file:"+f)
 	}
-	flag.Parse()
+	return strings.Join(terms, " ")
+}
 
-	if len(flag.Args()) == 0 {
-		flag.Usage()
-		os.Exit(1)
+func readStream(resp *http.Response, p *printer) {
+	m := api.NewStreamMarshaler()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		op, err := m.Decode(dec)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			fatalf("Error reading reply: %s\n", err.Error())
+		}
+		switch op := op.(type) {
+		case *api.Result:
+			p.result(op)
+		case *api.FileResult:
+			p.fileResult(op)
+		case *api.InnerError:
+			fatalf("Error: %s: %s\n", op.Code, op.Message)
+		case *api.ReplyStats:
+			for _, e := range op.Errors {
+				fmt.Fprintf(os.Stderr, "Error from %s: %s: %s\n", e.Backend, e.Code, e.Message)
+			}
+		}
 	}
+}
 
+// searchURL returns the API URL to search for query.
+func searchURL(query string, stream bool) *url.URL {
 	var uri *url.URL
 	var err error
 
 	if strings.Contains(*server, ":") {
 		if uri, err = url.Parse(*server); err != nil {
-			fmt.Fprintf(os.Stderr, "Parsing server %s: %s\n", *server, err.Error())
-			os.Exit(1)
+			fatalf("Parsing server %s: %s\n", *server, err.Error())
 		}
 	} else {
 		uri = &url.URL{Scheme: "http", Host: *server}
 	}
 
 	uri.Path = "/api/v1/search/"
-	uri.RawQuery = url.Values{"q": []string{strings.Join(flag.Args(), " ")}}.Encode()
+	if stream {
+		uri.Path = "/api/v1/search/stream/"
+	}
+	params := url.Values{"q": []string{query}}
+	if contextRequested() {
+		before, after := contextLines()
+		if after > before {
+			before = after
+		}
+		params.Set("context", strconv.Itoa(before))
+	}
+	uri.RawQuery = params.Encode()
+	return uri
+}
 
+func newClient() *http.Client {
 	var transport http.RoundTripper
 	if *unixSocket == "" {
 		transport = http.DefaultTransport
@@ -64,42 +147,101 @@ func main() {
 			DisableKeepAlives: true,
 		}
 	}
-	client := http.Client{Transport: transport}
+	return &http.Client{Transport: transport}
+}
 
+// get requests uri, turning an error reply into an error.
+func get(client *http.Client, uri *url.URL) (*http.Response, error) {
 	resp, err := client.Get(uri.String())
-
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Requesting %s: %s\n", uri.String(), err.Error())
-		os.Exit(1)
+		return nil, fmt.Errorf("Requesting %s: %s", uri.String(), err.Error())
 	}
 
 	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
 		var reply api.ReplyError
 		if e := json.NewDecoder(resp.Body).Decode(&reply); e != nil {
-			fmt.Fprintf(os.Stderr,
-				"Error reading reply (status=%d): %s\n", resp.StatusCode, e.Error())
-		} else {
-			fmt.Fprintf(os.Stderr, "Error: %s: %s\n", reply.Err.Code, reply.Err.Message)
+			return nil, fmt.Errorf("Error reading reply (status=%d): %s", resp.StatusCode, e.Error())
 		}
-		os.Exit(1)
+		return nil, fmt.Errorf("Error: %s: %s", reply.Err.Code, reply.Err.Message)
 	}
+	return resp, nil
+}
 
-	var reply api.ReplySearch
+// search runs a search, returning the whole reply.
+func search(client *http.Client, uri *url.URL) (*api.ReplySearch, error) {
+	resp, err := get(client, uri)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 
+	var reply api.ReplySearch
 	if e := json.NewDecoder(resp.Body).Decode(&reply); e != nil {
-		fmt.Fprintf(os.Stderr,
-			"Error reading reply (status=%d): %s\n", resp.StatusCode, e.Error())
-		os.Exit(1)
+		return nil, fmt.Errorf("Error reading reply (status=%d): %s", resp.StatusCode, e.Error())
+	}
+	return &reply, nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] REGEX\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -i [flags] [REGEX]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	if err := config.LoadConfig(flag.CommandLine, "lgrc"); err != nil {
+		fatalf("Loading config: %s\n", err)
 	}
+	flag.Parse()
 
-	for _, r := range reply.Results {
-		if r.Tree != "" {
-			fmt.Printf("%s:", r.Tree)
+	if *interactive {
+		if err := runInteractive(newClient(), strings.Join(flag.Args(), " ")); err != nil {
+			fatalf("%s\n", err)
 		}
-		if *showVersion && r.Version != "" {
-			fmt.Printf("%s:", r.Version)
+		return
+	}
+
+	if len(flag.Args()) == 0 {
+		flag.Usage()
+		os.Exit(exitError)
+	}
+
+	client := newClient()
+	useStream := *stream && !*jsonOutput
+	uri := searchURL(buildQuery(flag.Args()), useStream)
+
+	p := newPrinter()
+	if useStream {
+		resp, err := get(client, uri)
+		if err != nil {
+			fatalf("%s\n", err)
 		}
-		fmt.Printf("%s:%d: ", r.Path, r.LineNumber)
-		fmt.Printf("%s\n", r.Line)
+		readStream(resp, p)
+	} else {
+		reply, err := search(client, uri)
+		if err != nil {
+			fatalf("%s\n", err)
+		}
+
+		if *jsonOutput {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(reply); err != nil {
+				fatalf("Writing reply: %s\n", err)
+			}
+			p.matched = len(reply.Results) > 0 || len(reply.FileResults) > 0
+		} else {
+			for _, r := range reply.Results {
+				p.result(r)
+			}
+			for _, r := range reply.FileResults {
+				p.fileResult(r)
+			}
+		}
+	}
+	p.finish()
+
+	if !p.matched {
+		os.Exit(exitNoMatch)
 	}
 }
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/livegrep/livegrep/server/api"
+)
+
+// ANSI colours, matching GNU grep's defaults.
+const (
+	colorFile  = "\x1b[35m"
+	colorLine  = "\x1b[32m"
+	colorSep   = "\x1b[36m"
+	colorMatch = "\x1b[1;31m"
+	colorReset = "\x1b[0m"
+)
+
+// useColor decides whether to colour output, following --color.
+func useColor() bool {
+	switch *color {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	if os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// printer writes search results as they arrive, in the format chosen
+// by the flags.
+type printer struct {
+	color bool
+
+	// For -l and -c: the files seen, in order, and their counts.
+	files  []string
+	counts map[string]int
+
+	// The file and line of the last line printed, so that
+	// overlapping context is only printed once.
+	lastFile string
+	lastLine int
+
+	matched bool
+}
+
+func newPrinter() *printer {
+	return &printer{
+		color:  useColor(),
+		counts: make(map[string]int),
+	}
+}
+
+func (p *printer) paint(color, s string) string {
+	if !p.color {
+		return s
+	}
+	return color + s + colorReset
+}
+
+func resultPrefix(tree, version, path string) string {
+	prefix := ""
+	if tree != "" {
+		prefix += tree + ":"
+	}
+	if *showVersion && version != "" {
+		prefix += version + ":"
+	}
+	return prefix + path
+}
+
+func (p *printer) countFile(file string) {
+	if _, ok := p.counts[file]; !ok {
+		p.files = append(p.files, file)
+		if *filesWithMatches {
+			fmt.Println(p.paint(colorFile, file))
+		}
+	}
+	p.counts[file]++
+}
+
+// highlight colours the part of line between bounds, which count
+// characters rather than bytes.
+func (p *printer) highlight(line string, bounds [2]int) string {
+	if !p.color {
+		return line
+	}
+	runes := []rune(line)
+	left, right := bounds[0], bounds[1]
+	if left < 0 || right > len(runes) || left >= right {
+		return line
+	}
+	return string(runes[:left]) + colorMatch + string(runes[left:right]) + colorReset + string(runes[right:])
+}
+
+func (p *printer) printLine(file string, lno int, sep string, col int, line string) {
+	if contextRequested() && file == p.lastFile && lno <= p.lastLine {
+		return
+	}
+	if contextRequested() && p.lastFile != "" && (file != p.lastFile || lno > p.lastLine+1) {
+		fmt.Println(p.paint(colorSep, "--"))
+	}
+	pos := p.paint(colorLine, fmt.Sprint(lno))
+	if *column && col > 0 {
+		pos += p.paint(colorSep, sep) + p.paint(colorLine, fmt.Sprint(col))
+	}
+	fmt.Printf("%s%s%s%s %s\n",
+		p.paint(colorFile, file), p.paint(colorSep, sep),
+		pos, p.paint(colorSep, sep),
+		line)
+	p.lastFile, p.lastLine = file, lno
+}
+
+func (p *printer) result(r *api.Result) {
+	p.matched = true
+	file := displayPath(r.Tree, r.Version, r.Path)
+	if *filesWithMatches || *count {
+		p.countFile(file)
+		return
+	}
+	before, after := contextLines()
+	for i := minInt(before, len(r.ContextBefore)) - 1; i >= 0; i-- {
+		p.printLine(file, r.LineNumber-i-1, "-", 0, r.ContextBefore[i])
+	}
+	p.printLine(file, r.LineNumber, ":", r.Bounds[0]+1, p.highlight(r.Line, r.Bounds))
+	for i := 0; i < minInt(after, len(r.ContextAfter)); i++ {
+		p.printLine(file, r.LineNumber+i+1, "-", 0, r.ContextAfter[i])
+	}
+}
+
+// fileResult prints a match from a filename-only search, highlighting
+// the part of the path that matched.
+func (p *printer) fileResult(r *api.FileResult) {
+	p.matched = true
+	if *filesWithMatches || *count {
+		p.countFile(displayPath(r.Tree, r.Version, r.Path))
+		return
+	}
+	prefix := resultPrefix(r.Tree, r.Version, "")
+	if dir, ok := localTrees[r.Tree]; ok {
+		localPath(r.Tree, r.Version, r.Path)
+		prefix = dir + string(filepath.Separator)
+	}
+	fmt.Println(p.paint(colorFile, prefix) + p.highlight(r.Path, r.Bounds))
+}
+
+// finish prints anything that needs every result first.
+func (p *printer) finish() {
+	if !*count {
+		return
+	}
+	for _, f := range p.files {
+		fmt.Printf("%s%s%d\n", p.paint(colorFile, f), p.paint(colorSep, ":"), p.counts[f])
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func contextRequested() bool {
+	return *afterContext >= 0 || *beforeContext >= 0 || contextFlag >= 0
+}
+
+// contextLines returns how many lines of context to print before and
+// after each match, following grep: -A and -B override -C.
+func contextLines() (before, after int) {
+	before, after = contextFlag, contextFlag
+	if *beforeContext >= 0 {
+		before = *beforeContext
+	}
+	if *afterContext >= 0 {
+		after = *afterContext
+	}
+	if before < 0 {
+		before = 0
+	}
+	if after < 0 {
+		after = 0
+	}
+	return before, after
+}
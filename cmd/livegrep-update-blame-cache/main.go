@@ -1,82 +1,155 @@
+/*
+This package is a utility that writes the blame history of a git
+repository to a cache file, which livegrep loads far more quickly
+than it can parse the repository's git log.
+
+If the cache file already exists and the repository has only moved
+forward since it was written, only the new commits are logged and
+added to it. Point a repository's "blame" metadata at the cache file,
+or set "blame" to "git" and "blame_cache" to the file to have livegrep
+start from the cache and log only newer commits itself.
+
+With -merges, lines that merges brought in from other branches are
+blamed on the commits there that wrote them; set the repository's
+"blame_mode" metadata to "merges" to match. Such a history is always
+logged in full.
+*/
 package main
 
 import (
-	// "flag"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/livegrep/livegrep/blameworthy"
 )
 
+var (
+	flagRevision = flag.String("revision", "HEAD", "Revision whose history to cache")
+	flagFull     = flag.Bool("full", false, "Log the whole history even if the cache could be updated")
+	flagMerges   = flag.Bool("merges", false, "Follow merges to the commits that wrote their lines")
+)
+
 func main() {
-	// flag.Parse()
-	// log.SetFlags(0)
-	file, err := os.Open("/home/brhodes/log3.server")
-	if err != nil {
-		log.Fatal(err)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <repo path> <cache file>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
 	}
-	defer file.Close()
+	repo, cachePath := flag.Arg(0), flag.Arg(1)
 
 	start := time.Now()
-	histories, _ := blameworthy.ParseGitLog(file)
-	elapsed := time.Since(start)
-	log.Printf("Git log loaded in %s", elapsed)
-
-	// fmt.Printf("%d commits\n", len(*commits))
-
-	fmt.Printf("%d commits\n", len(histories.Commits))
-	fmt.Printf("%d files\n", len(histories.Files))
-
-	// Which file has the longest history?
-
-	// Which file had the most lines changed?
-
-	// Which file had the most expensive history?
-	// file_lengths := make(map[string]int)
-	// m := make(map[string]int)
-	// for _, commit := range *commits {
-	// 	for _, file := range commit.Files {
-	// 		for _, h := range file.Hunks {
-	// 			file_lengths[file.Path] -= h.Old_length
-	// 			file_lengths[file.Path] += h.New_length
-	// 			m[file.Path] += file_lengths[file.Path]
-	// 		}
-	// 	}
-	// }
-
-	// f, err := os.Create("/home/brhodes/tmp.out")
-	// for k, v := range m {
-	// 	fmt.Fprintf(f, "%d %s\n", v, k)
-	// }
-
-	target_path := "quarantine.txt"
-	//target_path = "dropbox/api/v2/datatypes/team_log.py"
-
-	small_history := histories.Files[target_path]
-
-	fmt.Printf("history length: %d\n", len(small_history))
-
-	// start = time.Now()
-	// small_history.FileBlame(len(small_history) - 2)
-	// elapsed = time.Since(start)
-
-	// log.Printf("Small history loaded in %s", elapsed)
+	var old *blameworthy.GitHistory
+	if !*flagFull && !*flagMerges {
+		var err error
+		old, err = readCache(cachePath)
+		if os.IsNotExist(err) {
+			old = nil
+		} else if err != nil {
+			log.Printf("Ignoring cache: %s", err)
+			old = nil
+		} else if old.WithMerges {
+			log.Printf("Ignoring cache: it was written with -merges")
+			old = nil
+		}
+	}
 
-	// start = time.Now()
-	// //i := 0b159401a6ebde40093ac8ace25944e81f4d3836
-	// i := 1
-	// blameVector, futureVector := small_history.DiffBlame(i)
-	// elapsed = time.Since(start)
+	history, err := update(repo, old)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if history == old {
+		log.Printf("%s is up to date", cachePath)
+		return
+	}
+	if err := writeCache(cachePath, history); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Wrote %d commits and %d files to %s in %s",
+		len(history.Hashes), len(history.Files), cachePath, time.Since(start))
+}
 
-	// log.Printf("Diff history loaded in %s", elapsed)
-	// log.Print(blameVector, "\n")
-	// log.Print(futureVector, "\n")
+func readCache(path string) (*blameworthy.GitHistory, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return blameworthy.ReadCache(f)
+}
 
-	//time.Sleep(10 * time.Second)
+// update returns the history of the repository, extending old if it
+// can, or old itself if there is nothing new.
+func update(repo string, old *blameworthy.GitHistory) (*blameworthy.GitHistory, error) {
+	revision := *flagRevision
+	if old != nil && len(old.Hashes) > 0 {
+		last := old.Hashes[len(old.Hashes)-1]
+		ok, err := blameworthy.IsFirstParentAncestor(repo, last, revision)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			revision = last + ".." + revision
+		} else {
+			log.Printf("%s is no longer a first-parent ancestor of %s; logging the whole history", last, revision)
+			old = nil
+		}
+	}
+	if *flagMerges {
+		gitLogOutput, err := blameworthy.RunGitLogWithMerges(repo, revision)
+		if err != nil {
+			return nil, err
+		}
+		history, err := blameworthy.ParseGitLogWithMerges(gitLogOutput)
+		if e := gitLogOutput.Close(); err == nil {
+			err = e
+		}
+		return history, err
+	}
+	gitLogOutput, err := blameworthy.RunGitLog(repo, revision)
+	if err != nil {
+		return nil, err
+	}
+	var history *blameworthy.GitHistory
+	if old != nil {
+		history, err = old.Extend(gitLogOutput)
+	} else {
+		history, err = blameworthy.ParseGitLog(gitLogOutput)
+	}
+	if e := gitLogOutput.Close(); err == nil {
+		err = e
+	}
+	return history, err
+}
 
-	//blame_index :=
-	//blameworthy.Build_index(commits)
-	//fmt.Print((*blame_index)["8e18c6e7:README.md"])
+// writeCache replaces the cache file, so that a server reading it
+// never sees it half-written.
+func writeCache(path string, history *blameworthy.GitHistory) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := history.WriteCache(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
 }
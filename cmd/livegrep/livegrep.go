@@ -4,12 +4,15 @@ import (
 	"encoding/json"
 	_ "expvar"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"path"
+	"syscall"
 
 	libhoney "github.com/honeycombio/libhoney-go"
 	"github.com/livegrep/livegrep/server"
@@ -34,17 +37,9 @@ func runfilesPath(sourcePath string) (string, error) {
 	return path.Join(programPath+".runfiles", "com_github_livegrep_livegrep", sourcePath), nil
 }
 
-func main() {
-	flag.Parse()
-
-	if *docRoot == "" {
-		var err error
-		*docRoot, err = runfilesPath("web")
-		if err != nil {
-			log.Fatalf(err.Error())
-		}
-	}
-
+// loadConfig builds the config from the flags and the config file,
+// which is re-read whenever the config is reloaded.
+func loadConfig() (*config.Config, error) {
 	cfg := &config.Config{
 		DocRoot: *docRoot,
 		Listen:  *serveAddr,
@@ -61,32 +56,63 @@ func main() {
 	if *indexConfig != "" {
 		data, err := ioutil.ReadFile(*indexConfig)
 		if err != nil {
-			log.Fatalf(err.Error())
+			return nil, err
 		}
 
 		if err = json.Unmarshal(data, &cfg.IndexConfig); err != nil {
-			log.Fatalf("reading %s: %s", flag.Arg(0), err.Error())
+			return nil, fmt.Errorf("reading %s: %s", *indexConfig, err.Error())
 		}
 	}
 
 	if len(flag.Args()) != 0 {
 		data, err := ioutil.ReadFile(flag.Arg(0))
 		if err != nil {
-			log.Fatalf(err.Error())
+			return nil, err
 		}
 
 		if err = json.Unmarshal(data, &cfg); err != nil {
-			log.Fatalf("reading %s: %s", flag.Arg(0), err.Error())
+			return nil, fmt.Errorf("reading %s: %s", flag.Arg(0), err.Error())
+		}
+	}
+	return cfg, nil
+}
+
+func main() {
+	flag.Parse()
+
+	if *docRoot == "" {
+		var err error
+		*docRoot, err = runfilesPath("web")
+		if err != nil {
+			log.Fatalf(err.Error())
 		}
 	}
 
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+
 	libhoney.Init(libhoney.Config{})
 
-	handler, err := server.New(cfg)
+	reloader, err := server.NewReloader(loadConfig)
 	if err != nil {
 		panic(err.Error())
 	}
 
+	// SIGHUP reloads the config. The listen address and
+	// reverse_proxy setting only take effect on a restart.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reloader.Reload(); err != nil {
+				log.Printf("Reloading config: %s", err.Error())
+			}
+		}
+	}()
+
+	var handler http.Handler = reloader
 	if cfg.ReverseProxy {
 		handler = middleware.UnwrapProxyHeaders(handler)
 	}
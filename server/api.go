@@ -4,9 +4,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"google.golang.org/grpc"
@@ -38,18 +41,27 @@ func writeError(ctx context.Context, w http.ResponseWriter, status int, code, me
 	replyJSON(ctx, w, status, &api.ReplyError{Err: api.InnerError{Code: code, Message: message}})
 }
 
-func writeQueryError(ctx context.Context, w http.ResponseWriter, err error) {
+// queryError maps an error from a search to the HTTP status and API
+// error it should be reported as.
+func queryError(err error) (int, api.InnerError) {
 	if code := grpc.Code(err); code == codes.InvalidArgument {
-		writeError(ctx, w, 400, "query", grpc.ErrorDesc(err))
-	} else {
-		writeError(ctx, w, 500, "internal_error",
-			fmt.Sprintf("Talking to backend: %s", err.Error()))
+		return 400, api.InnerError{Code: "query", Message: grpc.ErrorDesc(err)}
+	}
+	return 500, api.InnerError{
+		Code:    "internal_error",
+		Message: fmt.Sprintf("Talking to backend: %s", err.Error()),
 	}
 }
 
-func extractQuery(ctx context.Context, r *http.Request) (pb.Query, bool, error) {
+func writeQueryError(ctx context.Context, w http.ResponseWriter, err error) {
+	status, e := queryError(err)
+	writeError(ctx, w, status, e.Code, e.Message)
+}
+
+func extractQuery(ctx context.Context, r *http.Request) (pb.Query, *QueryExpr, bool, error) {
 	params := r.URL.Query()
 	var query pb.Query
+	var expr *QueryExpr
 	var err error
 
 	regex := true
@@ -58,8 +70,11 @@ func extractQuery(ctx context.Context, r *http.Request) (pb.Query, bool, error)
 	}
 
 	if q, ok := params["q"]; ok {
-		query, err = ParseQuery(q[0], regex)
+		query, expr, err = ParseQueryExpr(q[0], regex)
 		log.Printf(ctx, "parsing query q=%q out=%s", q[0], asJSON{query})
+		if expr != nil {
+			log.Printf(ctx, "parsed boolean query expr=%s", asJSON{expr})
+		}
 	}
 
 	// Support old-style query arguments
@@ -92,23 +107,40 @@ func extractQuery(ctx context.Context, r *http.Request) (pb.Query, bool, error)
 		}
 	}
 
+	if c, ok := params["context"]; ok && err == nil {
+		query.ContextLines, err = parseContextLines(c[0])
+	}
+
 	if fc, ok := params["fold_case"]; ok {
-		if fc[0] == "false" {
-			query.FoldCase = false
-		} else if fc[0] == "true" {
-			query.FoldCase = true
-		} else {
-			query.FoldCase = strings.IndexAny(query.Line, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") == -1
+		foldCase := func(line string) bool {
+			if fc[0] == "false" {
+				return false
+			} else if fc[0] == "true" {
+				return true
+			}
+			return strings.IndexAny(line, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") == -1
+		}
+		query.FoldCase = foldCase(query.Line)
+		if expr != nil {
+			expr.walk(func(e *QueryExpr) {
+				if e.Op == OpLine {
+					e.FoldCase = foldCase(e.Line)
+				}
+			})
 		}
 	}
 
-	return query, regex, err
+	return query, expr, regex, err
 }
 
 var (
 	ErrTimedOut = errors.New("timed out talking to backend")
 )
 
+// allBackends is the backend name that asks for a search to be sent to
+// every configured backend.
+const allBackends = "*"
+
 func stringSlice(ss []string) []string {
 	if ss != nil {
 		return ss
@@ -116,28 +148,139 @@ func stringSlice(ss []string) []string {
 	return []string{}
 }
 
+// backendContext is the context for a call to a backend on behalf of
+// a request.
+func backendContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	if id, ok := reqid.FromContext(ctx); ok {
+		ctx = metadata.AppendToOutgoingContext(ctx, "Request-Id", string(id))
+	}
+	return ctx, cancel
+}
+
+// cacheable reports whether the result of a search may be cached. A
+// search that was cut short by a timeout might find more another time.
+func cacheable(stats *pb.SearchStats) bool {
+	switch stats.ExitReason {
+	case pb.SearchStats_NONE, pb.SearchStats_MATCH_LIMIT:
+		return true
+	}
+	return false
+}
+
+// visibleQuery returns q narrowed to the repositories of backend that
+// the user making a request may see, so that matches in the others
+// don't use up its max_matches. Being part of the query, the narrowing
+// is part of its cache key too.
+func (s *server) visibleQuery(ctx context.Context, backend *Backend, q *pb.Query) *pb.Query {
+	hidden := s.hiddenRepos(ctx, backend)
+	if hidden == "" {
+		return q
+	}
+	visible := *q
+	mergeFilter(&visible.NotRepo, hidden)
+	return &visible
+}
+
 func (s *server) doSearch(ctx context.Context, backend *Backend, q *pb.Query) (*api.ReplySearch, error) {
 	var search *pb.CodeSearchResult
 	var err error
 
 	start := time.Now()
 
-	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	ctx, cancel := backendContext(ctx)
 	defer cancel()
 
-	if id, ok := reqid.FromContext(ctx); ok {
-		ctx = metadata.AppendToOutgoingContext(ctx, "Request-Id", string(id))
+	q = s.visibleQuery(ctx, backend, q)
+
+	var key cacheKey
+	if s.cache != nil {
+		key = makeCacheKey(backend, q)
+		search = s.cache.get(key)
+	}
+	if search == nil {
+		search, err = backend.Codesearch.Search(
+			ctx, q,
+			grpc.FailFast(false),
+		)
+		s.metrics.observeRPC(backend.Id, time.Since(start), err)
+		if err != nil {
+			log.Printf(ctx, "error talking to backend err=%s", err)
+			return nil, err
+		}
+		if cacheable(search.Stats) {
+			s.cache.put(key, search)
+		}
+	}
+	s.metrics.observeExit(backend.Id, search.Stats.ExitReason.String())
+
+	reply := s.convertResults(ctx, q, search)
+	reply.Info = convertStats(search.Stats, start)
+	return reply, nil
+}
+
+// doStreamSearch runs q on backend like doSearch, but passes its
+// results to emit as the backend finds them, rather than all at the
+// end. It returns the search's stats. If emit fails, the search is
+// abandoned and its error returned.
+func (s *server) doStreamSearch(ctx context.Context, backend *Backend, q *pb.Query, emit func(*api.ReplySearch) error) (*api.Stats, error) {
+	start := time.Now()
+
+	ctx, cancel := backendContext(ctx)
+	defer cancel()
+
+	q = s.visibleQuery(ctx, backend, q)
+
+	var key cacheKey
+	if s.cache != nil {
+		key = makeCacheKey(backend, q)
+		if search := s.cache.get(key); search != nil {
+			s.metrics.observeExit(backend.Id, search.Stats.ExitReason.String())
+			if err := emit(s.convertResults(ctx, q, search)); err != nil {
+				return nil, err
+			}
+			return convertStats(search.Stats, start), nil
+		}
 	}
 
-	search, err = backend.Codesearch.Search(
-		ctx, q,
-		grpc.FailFast(false),
-	)
+	// Everything the backend sends, to be cached at the end.
+	search := &pb.CodeSearchResult{}
+	stream, err := backend.Codesearch.StreamSearch(ctx, q, grpc.FailFast(false))
+	for err == nil && search.Stats == nil {
+		var part *pb.CodeSearchResult
+		if part, err = stream.Recv(); err != nil {
+			if err == io.EOF {
+				err = errors.New("search ended without stats")
+			}
+			break
+		}
+		search.Results = append(search.Results, part.Results...)
+		search.FileResults = append(search.FileResults, part.FileResults...)
+		search.Stats = part.Stats
+		if len(part.Results) == 0 && len(part.FileResults) == 0 {
+			continue
+		}
+		if err := emit(s.convertResults(ctx, q, part)); err != nil {
+			return nil, err
+		}
+	}
+	s.metrics.observeRPC(backend.Id, time.Since(start), err)
 	if err != nil {
 		log.Printf(ctx, "error talking to backend err=%s", err)
 		return nil, err
 	}
+	if cacheable(search.Stats) {
+		s.cache.put(key, search)
+	}
+	s.metrics.observeExit(backend.Id, search.Stats.ExitReason.String())
+	return convertStats(search.Stats, start), nil
+}
 
+// convertResults converts the results of a search for q to a reply,
+// keeping only those the user may see: visibleQuery can't exclude
+// repositories the backend has added since it last reported its
+// trees.
+func (s *server) convertResults(ctx context.Context, q *pb.Query, search *pb.CodeSearchResult) *api.ReplySearch {
 	reply := &api.ReplySearch{
 		Results:     make([]*api.Result, 0),
 		FileResults: make([]*api.FileResult, 0),
@@ -149,6 +292,9 @@ func (s *server) doSearch(ctx context.Context, backend *Backend, q *pb.Query) (*
 	}
 
 	for _, r := range search.Results {
+		if !s.canSee(ctx, r.Tree) {
+			continue
+		}
 		reply.Results = append(reply.Results, &api.Result{
 			Tree:          r.Tree,
 			Version:       r.Version,
@@ -162,6 +308,9 @@ func (s *server) doSearch(ctx context.Context, backend *Backend, q *pb.Query) (*
 	}
 
 	for _, r := range search.FileResults {
+		if !s.canSee(ctx, r.Tree) {
+			continue
+		}
 		reply.FileResults = append(reply.FileResults, &api.FileResult{
 			Tree:    r.Tree,
 			Version: r.Version,
@@ -169,88 +318,417 @@ func (s *server) doSearch(ctx context.Context, backend *Backend, q *pb.Query) (*
 			Bounds:  [2]int{int(r.Bounds.Left), int(r.Bounds.Right)},
 		})
 	}
+	return reply
+}
 
-	reply.Info = &api.Stats{
-		RE2Time:     search.Stats.Re2Time,
-		GitTime:     search.Stats.GitTime,
-		SortTime:    search.Stats.SortTime,
-		IndexTime:   search.Stats.IndexTime,
-		AnalyzeTime: search.Stats.AnalyzeTime,
+func convertStats(stats *pb.SearchStats, start time.Time) *api.Stats {
+	return &api.Stats{
+		RE2Time:     stats.Re2Time,
+		GitTime:     stats.GitTime,
+		SortTime:    stats.SortTime,
+		IndexTime:   stats.IndexTime,
+		AnalyzeTime: stats.AnalyzeTime,
 		TotalTime:   int64(time.Since(start) / time.Millisecond),
-		ExitReason:  search.Stats.ExitReason.String(),
+		ExitReason:  stats.ExitReason.String(),
+	}
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// mergeStats folds the stats of a search that ran in parallel with
+// others into info. The slowest search is what the user waited for, so
+// each time is the maximum seen.
+func mergeStats(info, other *api.Stats) {
+	info.RE2Time = maxInt64(info.RE2Time, other.RE2Time)
+	info.GitTime = maxInt64(info.GitTime, other.GitTime)
+	info.SortTime = maxInt64(info.SortTime, other.SortTime)
+	info.IndexTime = maxInt64(info.IndexTime, other.IndexTime)
+	info.AnalyzeTime = maxInt64(info.AnalyzeTime, other.AnalyzeTime)
+	if other.ExitReason != pb.SearchStats_NONE.String() &&
+		info.ExitReason != pb.SearchStats_TIMEOUT.String() {
+		info.ExitReason = other.ExitReason
+	}
+}
+
+// limitResults truncates a merged reply to at most limit results of
+// each kind. Results are grouped by the backend that found them, and
+// the limit is divided between the groups by fairShares, so that the
+// first backends of a fan-out can't crowd out the rest; each group
+// keeps its first results, in the order they were merged.
+func limitResults(reply *api.ReplySearch, limit int) {
+	if limit <= 0 {
+		return
+	}
+	if len(reply.Results) > limit {
+		ids := make([]string, len(reply.Results))
+		for i, res := range reply.Results {
+			ids[i] = res.Backend
+		}
+		keep := keepFair(ids, limit)
+		results := reply.Results[:0]
+		for i, res := range reply.Results {
+			if keep[i] {
+				results = append(results, res)
+			}
+		}
+		reply.Results = results
+		reply.Info.ExitReason = pb.SearchStats_MATCH_LIMIT.String()
+	}
+	if len(reply.FileResults) > limit {
+		ids := make([]string, len(reply.FileResults))
+		for i, res := range reply.FileResults {
+			ids[i] = res.Backend
+		}
+		keep := keepFair(ids, limit)
+		results := reply.FileResults[:0]
+		for i, res := range reply.FileResults {
+			if keep[i] {
+				results = append(results, res)
+			}
+		}
+		reply.FileResults = results
+		reply.Info.ExitReason = pb.SearchStats_MATCH_LIMIT.String()
+	}
+}
+
+// keepFair reports which of a list of results, found by the backends
+// named in ids, to keep so that there are at most limit of them, each
+// backend keeping the first of its results up to its fair share.
+func keepFair(ids []string, limit int) []bool {
+	group := make(map[string]int)
+	var counts []int
+	for _, id := range ids {
+		g, ok := group[id]
+		if !ok {
+			g = len(counts)
+			group[id] = g
+			counts = append(counts, 0)
+		}
+		counts[g]++
+	}
+	shares := fairShares(counts, limit)
+	keep := make([]bool, len(ids))
+	for i, id := range ids {
+		if g := group[id]; shares[g] > 0 {
+			keep[i] = true
+			shares[g]--
+		}
+	}
+	return keep
+}
+
+// fairShares divides limit between backends that found counts[i]
+// results each, as evenly as it can: a backend that found fewer than an
+// even share keeps them all, and what it leaves over is divided between
+// the others.
+func fairShares(counts []int, limit int) []int {
+	shares := make([]int, len(counts))
+	for limit > 0 {
+		open := 0
+		for i, n := range counts {
+			if shares[i] < n {
+				open++
+			}
+		}
+		if open == 0 {
+			break
+		}
+		each := limit / open
+		if each == 0 {
+			each = 1
+		}
+		for i, n := range counts {
+			if limit == 0 {
+				break
+			}
+			if shares[i] < n {
+				add := n - shares[i]
+				if add > each {
+					add = each
+				}
+				shares[i] += add
+				limit -= add
+			}
+		}
 	}
+	return shares
+}
+
+func backendError(backend *Backend, err error) *api.BackendError {
+	_, e := queryError(err)
+	return &api.BackendError{Backend: backend.Id, Code: e.Code, Message: e.Message}
+}
+
+// doFanOutSearch sends q to every backend concurrently and merges the
+// replies. A backend that fails is reported in the reply's Errors; only
+// if every backend fails is an error returned. Each backend is asked for
+// up to q.MaxMatches results, so that the share of one that finds fewer
+// can go to the others when limitResults divides the limit.
+func (s *server) doFanOutSearch(ctx context.Context, backends []*Backend, q *pb.Query) (*api.ReplySearch, error) {
+	start := time.Now()
+
+	replies := make([]*api.ReplySearch, len(backends))
+	errs := make([]error, len(backends))
+	var wg sync.WaitGroup
+	for i, backend := range backends {
+		wg.Add(1)
+		go func(i int, backend *Backend) {
+			defer wg.Done()
+			replies[i], errs[i] = s.doSearch(ctx, backend, q)
+		}(i, backend)
+	}
+	wg.Wait()
+
+	reply := &api.ReplySearch{
+		Results:     make([]*api.Result, 0),
+		FileResults: make([]*api.FileResult, 0),
+		SearchType:  "normal",
+		Info:        &api.Stats{ExitReason: pb.SearchStats_NONE.String()},
+		BackendInfo: make(map[string]*api.Stats),
+	}
+
+	if q.FilenameOnly {
+		reply.SearchType = "filename_only"
+	}
+
+	var firstErr error
+	for i, backend := range backends {
+		if errs[i] != nil {
+			if firstErr == nil {
+				firstErr = errs[i]
+			}
+			reply.Errors = append(reply.Errors, backendError(backend, errs[i]))
+			continue
+		}
+		r := replies[i]
+		for _, res := range r.Results {
+			res.Backend = backend.Id
+			reply.Results = append(reply.Results, res)
+		}
+		for _, res := range r.FileResults {
+			res.Backend = backend.Id
+			reply.FileResults = append(reply.FileResults, res)
+		}
+		reply.BackendInfo[backend.Id] = r.Info
+		mergeStats(reply.Info, r.Info)
+	}
+
+	if len(reply.BackendInfo) == 0 {
+		return nil, firstErr
+	}
+
+	limitResults(reply, int(q.MaxMatches))
+	reply.Info.TotalTime = int64(time.Since(start) / time.Millisecond)
 	return reply, nil
 }
 
-func (s *server) ServeAPISearch(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+// apiSearch is a search request parsed from an API call.
+type apiSearch struct {
+	// backend is the backend to search, or nil if the search is
+	// fanned out to all of backends.
+	backend  *Backend
+	backends []*Backend
+	query    pb.Query
+	expr     *QueryExpr
+
+	// cursor is set if the caller asked for a page of results.
+	cursor *searchCursor
+
+	// summary is set if the caller asked for groups or facets.
+	summary *resultSummary
+}
+
+// parseAPICursor sets up the search for the next page of a paginated
+// search. The cursor carries the whole search, so the rest of the
+// request is ignored.
+func (s *server) parseAPICursor(ctx context.Context, w http.ResponseWriter, cur string) *apiSearch {
+	c, err := decodeCursor(cur, s.cursorKey)
+	if err != nil {
+		writeError(ctx, w, 400, "bad_cursor", err.Error())
+		return nil
+	}
+	// A cursor from before a reload may carry a limit that the
+	// config no longer allows.
+	c.Query.MaxMatches = s.pageMaxMatches(c.Query.MaxMatches)
+	search := &apiSearch{query: c.pageQuery(), expr: c.Expr, cursor: c}
+	if c.Backend == allBackends {
+		for _, id := range s.bkOrder {
+			search.backends = append(search.backends, s.bk[id])
+		}
+	} else if search.backend = s.bk[c.Backend]; search.backend == nil {
+		writeError(ctx, w, 400, "bad_cursor",
+			fmt.Sprintf("Unknown backend: %s", c.Backend))
+		return nil
+	}
+	if err := c.check(search.searchedBackends()); err != nil {
+		writeError(ctx, w, 400, "cursor_expired", err.Error())
+		return nil
+	}
+	return search
+}
+
+// The most results a page of a paginated search may ask for.
+const maxPageSize = 1000
+
+// pageMaxMatches returns the limit a paginated search asking for
+// maxMatches results runs with. Every page reruns the search, so it may
+// not be unlimited, nor exceed what an export may return.
+func (s *server) pageMaxMatches(maxMatches int32) int32 {
+	if limit := s.exportMaxMatches(); maxMatches <= 0 || maxMatches > limit {
+		return limit
+	}
+	return maxMatches
+}
+
+// parseAPISearch extracts the backend and query from an API request.
+// On failure it writes an error reply and returns nil.
+func (s *server) parseAPISearch(ctx context.Context, w http.ResponseWriter, r *http.Request) *apiSearch {
+	return s.parseAPISearchLimit(ctx, w, r, s.config.DefaultMaxMatches)
+}
+
+// parseAPISearchLimit is parseAPISearch, limiting the search to
+// maxMatches results unless the query asks for another limit.
+func (s *server) parseAPISearchLimit(ctx context.Context, w http.ResponseWriter, r *http.Request, maxMatches int32) *apiSearch {
+	if cur := r.URL.Query().Get("cursor"); cur != "" {
+		return s.parseAPICursor(ctx, w, cur)
+	}
+
+	search := &apiSearch{}
+
 	backendName := r.URL.Query().Get(":backend")
-	var backend *Backend
-	if backendName != "" {
-		backend = s.bk[backendName]
-		if backend == nil {
+	if backendName == "" && s.config.FanOutSearch {
+		backendName = allBackends
+	}
+	if backendName == allBackends {
+		for _, id := range s.bkOrder {
+			search.backends = append(search.backends, s.bk[id])
+		}
+	} else if backendName != "" {
+		search.backend = s.bk[backendName]
+		if search.backend == nil {
 			writeError(ctx, w, 400, "bad_backend",
 				fmt.Sprintf("Unknown backend: %s", backendName))
-			return
+			return nil
 		}
 	} else {
-		for _, backend = range s.bk {
+		for _, search.backend = range s.bk {
 			break
 		}
 	}
 
-	q, is_regex, err := extractQuery(ctx, r)
+	q, expr, is_regex, err := extractQuery(ctx, r)
 
 	if err != nil {
 		writeError(ctx, w, 400, "bad_query", err.Error())
-		return
+		return nil
 	}
 
-	if q.Line == "" {
+	if q.Line == "" && expr == nil {
 		kind := "string"
 		if is_regex {
 			kind = "regex"
 		}
 		msg := fmt.Sprintf("You must specify a %s to match", kind)
 		writeError(ctx, w, 400, "bad_query", msg)
-		return
+		return nil
 	}
 
 	if q.MaxMatches == 0 {
-		q.MaxMatches = s.config.DefaultMaxMatches
+		q.MaxMatches = maxMatches
 	}
 
-	reply, err := s.doSearch(ctx, backend, &q)
+	search.query = q
+	search.expr = expr
 
-	if err != nil {
-		log.Printf(ctx, "error in search err=%s", err)
-		writeQueryError(ctx, w, err)
-		return
+	if ps := r.URL.Query().Get("page_size"); ps != "" {
+		pageSize, err := strconv.Atoi(ps)
+		if err != nil || pageSize <= 0 || pageSize > maxPageSize {
+			writeError(ctx, w, 400, "bad_query",
+				fmt.Sprintf("page_size must be an integer from 1 to %d", maxPageSize))
+			return nil
+		}
+		if backendName == "" {
+			backendName = search.backend.Id
+		}
+		q.MaxMatches = s.pageMaxMatches(q.MaxMatches)
+		search.cursor = &searchCursor{
+			Backend:    backendName,
+			Query:      q,
+			Expr:       expr,
+			IndexTimes: indexTimes(search.searchedBackends()),
+			PageSize:   pageSize,
+			key:        s.cursorKey,
+		}
+		search.query = search.cursor.pageQuery()
 	}
+	return search
+}
 
-	if s.honey != nil {
-		e := s.honey.NewEvent()
-		reqid, ok := reqid.FromContext(ctx)
-		if ok {
-			e.AddField("request_id", reqid)
+func (s *server) runAPISearch(ctx context.Context, search *apiSearch) (*api.ReplySearch, error) {
+	run := func(ctx context.Context, q *pb.Query) (*api.ReplySearch, error) {
+		if search.backends != nil {
+			return s.doFanOutSearch(ctx, search.backends, q)
 		}
-		e.AddField("backend", backend.Id)
-		e.AddField("query_line", q.Line)
-		e.AddField("query_file", q.File)
-		e.AddField("query_repo", q.Repo)
-		e.AddField("query_foldcase", q.FoldCase)
-		e.AddField("query_not_file", q.NotFile)
-		e.AddField("query_not_repo", q.NotRepo)
-		e.AddField("max_matches", q.MaxMatches)
+		return s.doSearch(ctx, search.backend, q)
+	}
 
-		e.AddField("result_count", len(reply.Results))
-		e.AddField("re2_time", reply.Info.RE2Time)
-		e.AddField("git_time", reply.Info.GitTime)
-		e.AddField("sort_time", reply.Info.SortTime)
-		e.AddField("index_time", reply.Info.IndexTime)
-		e.AddField("analyze_time", reply.Info.AnalyzeTime)
+	q := search.query
+	var reply *api.ReplySearch
+	var err error
+	if search.expr != nil {
+		reply, err = s.doExprSearch(ctx, run, &q, search.expr)
+	} else {
+		reply, err = run(ctx, &q)
+	}
+	if err != nil {
+		return reply, err
+	}
+	// Summarize before paginating, so that the groups and facets
+	// cover the whole search rather than one page of it.
+	if search.summary != nil {
+		search.summary.apply(reply)
+	}
+	if search.cursor != nil {
+		search.cursor.paginate(reply)
+	}
+	return reply, nil
+}
 
-		e.AddField("exit_reason", reply.Info.ExitReason)
-		e.Send()
+func (s *server) recordSearch(ctx context.Context, search *apiSearch, reply *api.ReplySearch) {
+	if s.events != nil {
+		q := &search.query
+		e := map[string]interface{}{}
+		if search.backend != nil {
+			e["backend"] = search.backend.Id
+		} else {
+			e["backend"] = allBackends
+			e["backend_errors"] = len(reply.Errors)
+		}
+		e["query_line"] = q.Line
+		if search.expr != nil {
+			e["query_expr"] = asJSON{search.expr}.String()
+		}
+		e["query_file"] = q.File
+		e["query_repo"] = q.Repo
+		e["query_foldcase"] = q.FoldCase
+		e["query_not_file"] = q.NotFile
+		e["query_not_repo"] = q.NotRepo
+		e["max_matches"] = q.MaxMatches
+
+		e["result_count"] = len(reply.Results)
+		e["re2_time"] = reply.Info.RE2Time
+		e["git_time"] = reply.Info.GitTime
+		e["sort_time"] = reply.Info.SortTime
+		e["index_time"] = reply.Info.IndexTime
+		e["analyze_time"] = reply.Info.AnalyzeTime
+
+		e["exit_reason"] = reply.Info.ExitReason
+		s.sendEvent(ctx, "search", e)
 	}
 
 	log.Printf(ctx,
@@ -258,6 +736,29 @@ func (s *server) ServeAPISearch(ctx context.Context, w http.ResponseWriter, r *h
 		len(reply.Results),
 		reply.Info.ExitReason,
 		asJSON{reply.Info})
+}
+
+func (s *server) ServeAPISearch(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	summary, err := parseResultSummary(r)
+	if err != nil {
+		writeError(ctx, w, 400, "bad_query", err.Error())
+		return
+	}
+	search := s.parseAPISearch(ctx, w, r)
+	if search == nil {
+		return
+	}
+	search.summary = summary
+
+	reply, err := s.runAPISearch(ctx, search)
+
+	if err != nil {
+		log.Printf(ctx, "error in search err=%s", err)
+		writeQueryError(ctx, w, err)
+		return
+	}
+
+	s.recordSearch(ctx, search, reply)
 
 	replyJSON(ctx, w, 200, reply)
 }
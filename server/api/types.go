@@ -1,5 +1,9 @@
 package api
 
+import (
+	"github.com/livegrep/livegrep/jsonframe"
+)
+
 type InnerError struct {
 	Code    string `json:"code"`
 	Message string `json:"message"`
@@ -16,6 +20,53 @@ type ReplySearch struct {
 	Results     []*Result     `json:"results"`
 	FileResults []*FileResult `json:"file_results"`
 	SearchType  string        `json:"search_type"`
+
+	// BackendInfo and Errors are only filled in when a search is
+	// fanned out across every backend; they report the stats of
+	// each backend that answered and the failure of each one that
+	// didn't.
+	BackendInfo map[string]*Stats `json:"backend_info,omitempty"`
+	Errors      []*BackendError   `json:"errors,omitempty"`
+
+	// NextCursor is set on a page of a paginated search (one
+	// requested with page_size or cursor) if there are more
+	// results; pass it back as cursor to fetch the next page.
+	// Each page reruns the search, so if its exit reason says it
+	// stopped early the pages may repeat or miss results; raise
+	// max_matches: to page through all of them.
+	NextCursor string `json:"next_cursor,omitempty"`
+
+	// Groups and Facets summarize the results when requested with
+	// the group_by and facets parameters. On a page of a paginated
+	// search, they cover every page.
+	Groups []*ResultGroup           `json:"groups,omitempty"`
+	Facets map[string][]*FacetCount `json:"facets,omitempty"`
+}
+
+// ResultGroup counts the results in one tree, or one file of a tree
+// when grouping by path.
+type ResultGroup struct {
+	Backend string `json:"backend,omitempty"`
+	Tree    string `json:"tree"`
+	Version string `json:"version"`
+	Path    string `json:"path,omitempty"`
+	Files   int    `json:"files"`
+	Count   int    `json:"count"`
+}
+
+// FacetCount is the number of results sharing one value of a facet,
+// such as the repository or file extension.
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// BackendError describes a single backend that failed during a
+// fanned-out search.
+type BackendError struct {
+	Backend string `json:"backend"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
 type Stats struct {
@@ -37,6 +88,7 @@ type Result struct {
 	ContextAfter  []string `json:"context_after"`
 	Bounds        [2]int   `json:"bounds"`
 	Line          string   `json:"line"`
+	Backend       string   `json:"backend,omitempty"`
 }
 
 type FileResult struct {
@@ -44,4 +96,66 @@ type FileResult struct {
 	Version string `json:"version"`
 	Path    string `json:"path"`
 	Bounds  [2]int `json:"bounds"`
+	Backend string `json:"backend,omitempty"`
+}
+
+// ReplyStats is the last frame of a streamed search from
+// /api/v1/search/stream/:backend; it carries everything in a
+// ReplySearch except the results, which precede it as "result" and
+// "file_result" frames.
+type ReplyStats struct {
+	Info        *Stats            `json:"info"`
+	SearchType  string            `json:"search_type"`
+	BackendInfo map[string]*Stats `json:"backend_info,omitempty"`
+	Errors      []*BackendError   `json:"errors,omitempty"`
+}
+
+// ReplyBlame is returned to /api/v1/blame/:repo/:hash/<path>
+type ReplyBlame struct {
+	Repo   string       `json:"repo"`
+	Path   string       `json:"path"`
+	Commit *BlameCommit `json:"commit"`
+
+	// The commits before and after this one that changed the file.
+	PreviousCommit string `json:"previous_commit,omitempty"`
+	NextCommit     string `json:"next_commit,omitempty"`
+
+	Lines []*BlameLine `json:"lines"`
+}
+
+type BlameCommit struct {
+	Hash    string `json:"hash"`
+	Author  string `json:"author"`
+	Date    string `json:"date"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// BlameLine names the commit that wrote a line of the file and the
+// next commit to change or remove it, if any, with the line's number
+// in each of their versions of the file.
+type BlameLine struct {
+	LineNumber         int    `json:"lno"`
+	PreviousCommit     string `json:"previous_commit"`
+	PreviousLineNumber int    `json:"previous_lno"`
+	Author             string `json:"author"`
+	Date               string `json:"date"`
+	NextCommit         string `json:"next_commit,omitempty"`
+	NextLineNumber     int    `json:"next_lno,omitempty"`
+}
+
+func (r *Result) Opcode() string     { return "result" }
+func (r *FileResult) Opcode() string { return "file_result" }
+func (r *ReplyStats) Opcode() string { return "stats" }
+func (e *InnerError) Opcode() string { return "error" }
+
+// NewStreamMarshaler returns a marshaler that knows the frames of a
+// streamed search.
+func NewStreamMarshaler() *jsonframe.Marshaler {
+	m := &jsonframe.Marshaler{}
+	m.Register(&Result{})
+	m.Register(&FileResult{})
+	m.Register(&ReplyStats{})
+	m.Register(&InnerError{})
+	return m
 }
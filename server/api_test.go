@@ -0,0 +1,1419 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+type fakeCodeSearch struct {
+	result   *pb.CodeSearchResult
+	err      error
+	searches int32
+
+	// If set, a search waits for hold to be closed before it
+	// finishes: a streamed one sends its results first.
+	hold chan struct{}
+}
+
+func (f *fakeCodeSearch) Info(ctx context.Context, in *pb.InfoRequest, opts ...grpc.CallOption) (*pb.ServerInfo, error) {
+	return &pb.ServerInfo{}, nil
+}
+
+func (f *fakeCodeSearch) Search(ctx context.Context, in *pb.Query, opts ...grpc.CallOption) (*pb.CodeSearchResult, error) {
+	if f.hold != nil {
+		select {
+		case <-f.hold:
+		case <-ctx.Done():
+			return nil, grpc.Errorf(codes.Canceled, "%v", ctx.Err())
+		}
+	}
+	return f.search(in)
+}
+
+func (f *fakeCodeSearch) search(in *pb.Query) (*pb.CodeSearchResult, error) {
+	atomic.AddInt32(&f.searches, 1)
+	if f.result == nil {
+		return f.result, f.err
+	}
+	r := *f.result
+	if in.NotRepo != "" {
+		r.Results = nil
+		notRepo := regexp.MustCompile(in.NotRepo)
+		for _, res := range f.result.Results {
+			if !notRepo.MatchString(res.Tree) {
+				r.Results = append(r.Results, res)
+			}
+		}
+	}
+	if in.MaxMatches == 0 || len(r.Results) <= int(in.MaxMatches) {
+		return &r, f.err
+	}
+	// Stop at the limit, as codesearch does.
+	r.Results = r.Results[:in.MaxMatches]
+	r.Stats = &pb.SearchStats{ExitReason: pb.SearchStats_MATCH_LIMIT}
+	return &r, f.err
+}
+
+func (f *fakeCodeSearch) StreamSearch(ctx context.Context, in *pb.Query, opts ...grpc.CallOption) (pb.CodeSearch_StreamSearchClient, error) {
+	r, err := f.search(in)
+	if err != nil {
+		return nil, err
+	}
+	// Send each result on its own, then the stats, as codesearch
+	// does.
+	stream := &fakeStream{hold: f.hold}
+	for _, res := range r.Results {
+		stream.parts = append(stream.parts, &pb.CodeSearchResult{Results: []*pb.SearchResult{res}})
+	}
+	for _, res := range r.FileResults {
+		stream.parts = append(stream.parts, &pb.CodeSearchResult{FileResults: []*pb.FileResult{res}})
+	}
+	stream.parts = append(stream.parts, &pb.CodeSearchResult{Stats: r.Stats})
+	return stream, nil
+}
+
+type fakeStream struct {
+	grpc.ClientStream
+	parts []*pb.CodeSearchResult
+	hold  chan struct{}
+}
+
+func (s *fakeStream) Recv() (*pb.CodeSearchResult, error) {
+	if len(s.parts) == 0 {
+		return nil, io.EOF
+	}
+	if len(s.parts) == 1 && s.hold != nil {
+		<-s.hold
+	}
+	part := s.parts[0]
+	s.parts = s.parts[1:]
+	return part, nil
+}
+
+func (f *fakeCodeSearch) Reload(ctx context.Context, in *pb.Empty, opts ...grpc.CallOption) (*pb.Empty, error) {
+	return &pb.Empty{}, nil
+}
+
+func fakeResult(tree string, n int, why pb.SearchStats_ExitReason) *pb.CodeSearchResult {
+	r := &pb.CodeSearchResult{
+		Stats: &pb.SearchStats{ExitReason: why},
+	}
+	for i := 0; i < n; i++ {
+		r.Results = append(r.Results, &pb.SearchResult{
+			Tree:       tree,
+			Path:       "file.go",
+			LineNumber: int64(i + 1),
+			Bounds:     &pb.Bounds{},
+		})
+	}
+	return r
+}
+
+func TestFanOutSearch(t *testing.T) {
+	s := &server{}
+	backends := []*Backend{
+		{Id: "a", Codesearch: &fakeCodeSearch{result: fakeResult("ra", 5, pb.SearchStats_NONE)}},
+		{Id: "b", Codesearch: &fakeCodeSearch{err: errors.New("connection refused")}},
+		{Id: "c", Codesearch: &fakeCodeSearch{result: fakeResult("rc", 3, pb.SearchStats_NONE)}},
+	}
+
+	reply, err := s.doFanOutSearch(context.Background(), backends, &pb.Query{Line: "x", MaxMatches: 4})
+	if err != nil {
+		t.Fatalf("fan-out search failed: %v", err)
+	}
+	if len(reply.Results) != 4 {
+		t.Errorf("expected 4 results, got %d", len(reply.Results))
+	}
+	if reply.Info.ExitReason != "MATCH_LIMIT" {
+		t.Errorf("expected MATCH_LIMIT, got %s", reply.Info.ExitReason)
+	}
+	want := []string{"a", "a", "c", "c"}
+	for i, r := range reply.Results {
+		if r.Backend != want[i] {
+			t.Errorf("result %d: expected backend %s, got %s", i, want[i], r.Backend)
+		}
+	}
+	if len(reply.BackendInfo) != 2 || reply.BackendInfo["a"] == nil || reply.BackendInfo["c"] == nil {
+		t.Errorf("expected stats for backends a and c, got %v", reply.BackendInfo)
+	}
+	if len(reply.Errors) != 1 || reply.Errors[0].Backend != "b" {
+		t.Errorf("expected an error from backend b, got %v", reply.Errors)
+	}
+
+	backends = backends[1:2]
+	if _, err := s.doFanOutSearch(context.Background(), backends, &pb.Query{Line: "x"}); err == nil {
+		t.Errorf("expected an error when every backend fails")
+	}
+}
+
+func TestFairShares(t *testing.T) {
+	cases := []struct {
+		counts []int
+		limit  int
+		want   []int
+	}{
+		{[]int{5, 3}, 4, []int{2, 2}},
+		{[]int{5, 1}, 4, []int{3, 1}},
+		{[]int{1, 5, 5}, 7, []int{1, 3, 3}},
+		{[]int{2, 2}, 10, []int{2, 2}},
+		{[]int{3, 3, 3}, 2, []int{1, 1, 0}},
+		{[]int{0, 4}, 3, []int{0, 3}},
+	}
+	for _, tc := range cases {
+		if got := fairShares(tc.counts, tc.limit); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("fairShares(%v, %d) = %v, want %v", tc.counts, tc.limit, got, tc.want)
+		}
+	}
+}
+
+func TestExprSearch(t *testing.T) {
+	files := map[string][]*api.Result{
+		"foo": {
+			{Path: "a.go", LineNumber: 1, Line: "foo"},
+			{Path: "a.go", LineNumber: 3, Line: "foo test"},
+			{Path: "b.go", LineNumber: 2, Line: "foo"},
+		},
+		"bar": {
+			{Path: "a.go", LineNumber: 2, Line: "bar"},
+			{Path: "c.go", LineNumber: 1, Line: "bar"},
+		},
+		"many": {
+			{Path: "a.go", LineNumber: 4, Line: "many"},
+			{Path: "b.go", LineNumber: 4, Line: "many"},
+			{Path: "c.go", LineNumber: 4, Line: "many"},
+		},
+		"rare": {
+			{Path: "c.go", LineNumber: 1, Line: "rare"},
+		},
+	}
+	search := func(ctx context.Context, q *pb.Query) (*api.ReplySearch, error) {
+		reply := &api.ReplySearch{Info: &api.Stats{ExitReason: "NONE"}}
+		for _, r := range files[q.Line] {
+			if q.File != "" && !regexp.MustCompile(q.File).MatchString(r.Path) {
+				continue
+			}
+			if q.MaxMatches > 0 && len(reply.Results) == int(q.MaxMatches) {
+				reply.Info.ExitReason = "MATCH_LIMIT"
+				break
+			}
+			reply.Results = append(reply.Results, r)
+		}
+		return reply, nil
+	}
+
+	cases := []struct {
+		in   string
+		want []string
+	}{
+		{"foo AND bar", []string{"a.go:1", "a.go:2", "a.go:3"}},
+		{"foo OR bar", []string{"a.go:1", "a.go:2", "a.go:3", "b.go:2", "c.go:1"}},
+		{"foo -line:test", []string{"a.go:1", "b.go:2"}},
+		{"bar AND (foo -line:test)", []string{"a.go:1", "a.go:2"}},
+		{"foo file:a OR bar file:c", []string{"a.go:1", "a.go:3", "c.go:1"}},
+	}
+
+	s := &server{}
+	for _, tc := range cases {
+		q, expr, err := ParseQueryExpr(tc.in, true)
+		if err != nil {
+			t.Fatalf("parse(%v) error=%v", tc.in, err)
+		}
+		reply, err := s.doExprSearch(context.Background(), search, &q, expr)
+		if err != nil {
+			t.Fatalf("search(%v) error=%v", tc.in, err)
+		}
+		var got []string
+		for _, r := range reply.Results {
+			got = append(got, fmt.Sprintf("%s:%d", r.Path, r.LineNumber))
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("search(%v): expected %v got %v", tc.in, tc.want, got)
+		}
+	}
+
+	// A term that hits the limit is searched again in the files the
+	// other side of an AND matched.
+	q, expr, err := ParseQueryExpr("many AND rare", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.MaxMatches = 2
+	reply, err := s.doExprSearch(context.Background(), search, &q, expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range reply.Results {
+		got = append(got, fmt.Sprintf("%s:%d", r.Path, r.LineNumber))
+	}
+	if want := []string{"c.go:1", "c.go:4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("search(many AND rare): expected %v got %v", want, got)
+	}
+	if reply.Info.ExitReason != "NONE" {
+		t.Errorf("expected a complete search, got %s", reply.Info.ExitReason)
+	}
+}
+
+func TestSearchStream(t *testing.T) {
+	s := &server{
+		config: &config.Config{},
+		bk: map[string]*Backend{
+			"a": {Id: "a", Codesearch: &fakeCodeSearch{result: fakeResult("ra", 2, pb.SearchStats_NONE)}},
+			"b": {Id: "b", Codesearch: &fakeCodeSearch{err: errors.New("connection refused")}},
+		},
+		bkOrder: []string{"a", "b"},
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/search/stream/?q=x&%3Abackend=*", nil)
+	w := httptest.NewRecorder()
+	s.ServeAPISearchStream(context.Background(), w, r)
+
+	if w.Code != 200 {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	m := api.NewStreamMarshaler()
+	dec := json.NewDecoder(w.Body)
+	var ops []string
+	for {
+		op, err := m.Decode(dec)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("decoding stream: %v", err)
+		}
+		ops = append(ops, op.Opcode())
+		if stats, ok := op.(*api.ReplyStats); ok {
+			if len(stats.Errors) != 1 || stats.Errors[0].Backend != "b" {
+				t.Errorf("expected an error from backend b, got %v", stats.Errors)
+			}
+		}
+	}
+	want := []string{"result", "result", "stats"}
+	if !reflect.DeepEqual(ops, want) {
+		t.Errorf("expected frames %v, got %v", want, ops)
+	}
+}
+
+func TestSearchStreamFairLimit(t *testing.T) {
+	s := &server{
+		config: &config.Config{DefaultMaxMatches: 4},
+		bk: map[string]*Backend{
+			"a": {Id: "a", Codesearch: &fakeCodeSearch{result: fakeResult("ra", 5, pb.SearchStats_NONE)}},
+			"c": {Id: "c", Codesearch: &fakeCodeSearch{result: fakeResult("rc", 1, pb.SearchStats_NONE)}},
+		},
+		bkOrder: []string{"a", "c"},
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/search/stream/?q=x&%3Abackend=*", nil)
+	w := httptest.NewRecorder()
+	s.ServeAPISearchStream(context.Background(), w, r)
+
+	m := api.NewStreamMarshaler()
+	dec := json.NewDecoder(w.Body)
+	found := make(map[string]int)
+	var stats *api.ReplyStats
+	for {
+		op, err := m.Decode(dec)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("decoding stream: %v", err)
+		}
+		switch op := op.(type) {
+		case *api.Result:
+			found[op.Backend]++
+		case *api.ReplyStats:
+			stats = op
+		}
+	}
+	if found["a"] != 3 || found["c"] != 1 {
+		t.Errorf("expected 3 results from a and 1 from c, got %v", found)
+	}
+	if stats == nil || stats.Info.ExitReason != "MATCH_LIMIT" {
+		t.Errorf("expected MATCH_LIMIT, got %+v", stats)
+	}
+}
+
+// flushRecorder is a ResponseRecorder that passes on what has been
+// written each time it is flushed.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed chan string
+}
+
+func (f *flushRecorder) Flush() {
+	f.flushed <- f.Body.String()
+	f.Body.Reset()
+}
+
+func TestSearchStreamIncremental(t *testing.T) {
+	hold := make(chan struct{})
+	s := &server{
+		config: &config.Config{},
+		bk: map[string]*Backend{
+			"a": {Id: "a", Codesearch: &fakeCodeSearch{result: fakeResult("ra", 2, pb.SearchStats_NONE), hold: hold}},
+		},
+		bkOrder: []string{"a"},
+	}
+
+	w := &flushRecorder{httptest.NewRecorder(), make(chan string)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ServeAPISearchStream(context.Background(), w, httptest.NewRequest("GET", "/api/v1/search/stream/?q=x&%3Abackend=a", nil))
+	}()
+
+	// The results arrive while the backend is still searching.
+	for i := 0; i < 2; i++ {
+		select {
+		case frame := <-w.flushed:
+			if !strings.Contains(frame, `"opcode":"result"`) {
+				t.Errorf("expected a result frame, got %q", frame)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no result before the search finished")
+		}
+	}
+	close(hold)
+	for {
+		select {
+		case frame := <-w.flushed:
+			if !strings.Contains(frame, `"opcode":"stats"`) {
+				t.Errorf("expected the stats frame, got %q", frame)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func TestSearchPagination(t *testing.T) {
+	// The backend returns results out of order, with a file result
+	// among them.
+	result := fakeResult("ra", 5, pb.SearchStats_NONE)
+	rs := result.Results
+	for i, j := 0, len(rs)-1; i < j; i, j = i+1, j-1 {
+		rs[i], rs[j] = rs[j], rs[i]
+	}
+	result.FileResults = []*pb.FileResult{{Tree: "ra", Path: "file.go", Bounds: &pb.Bounds{}}}
+	s := &server{
+		config: &config.Config{DefaultMaxMatches: 10},
+		bk: map[string]*Backend{
+			"a": {Id: "a", I: &I{Name: "a"}, Codesearch: &fakeCodeSearch{result: result}},
+		},
+		bkOrder: []string{"a"},
+	}
+
+	var got []int
+	url := "/api/v1/search/a?q=x&%3Abackend=a&page_size=2"
+	for pages := 0; url != ""; pages++ {
+		if pages > 3 {
+			t.Fatalf("expected 3 pages, kept going")
+		}
+		r := httptest.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		s.ServeAPISearch(context.Background(), w, r)
+		if w.Code != 200 {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var reply api.ReplySearch
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+			t.Fatalf("decoding reply: %v", err)
+		}
+		for _, r := range reply.FileResults {
+			got = append(got, 0)
+			if r.Path != "file.go" {
+				t.Errorf("unexpected file result %v", r)
+			}
+		}
+		for _, r := range reply.Results {
+			got = append(got, r.LineNumber)
+		}
+		url = ""
+		if reply.NextCursor != "" {
+			url = "/api/v1/search/?cursor=" + reply.NextCursor
+		}
+	}
+	if want := []int{0, 1, 2, 3, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected lines %v, got %v", want, got)
+	}
+
+	// Facets count the results of every page.
+	r := httptest.NewRequest("GET", "/api/v1/search/a?q=x&%3Abackend=a&page_size=2&facets=repo", nil)
+	w := httptest.NewRecorder()
+	s.ServeAPISearch(context.Background(), w, r)
+	var reply api.ReplySearch
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatalf("decoding reply: %v", err)
+	}
+	if f := reply.Facets["repo"]; len(f) != 1 || f[0].Count != 6 {
+		t.Errorf("expected facets for all 6 results, got %v", f)
+	}
+
+	r = httptest.NewRequest("GET", "/api/v1/search/a?q=x&%3Abackend=a&page_size=100000", nil)
+	w = httptest.NewRecorder()
+	s.ServeAPISearch(context.Background(), w, r)
+	if w.Code != 400 {
+		t.Errorf("expected status 400 for a huge page_size, got %d", w.Code)
+	}
+
+	r = httptest.NewRequest("GET", "/api/v1/search/?cursor=bogus", nil)
+	w = httptest.NewRecorder()
+	s.ServeAPISearch(context.Background(), w, r)
+	if w.Code != 400 {
+		t.Errorf("expected status 400 for a bad cursor, got %d", w.Code)
+	}
+
+	// A cursor must be signed with the server's key, and its limit
+	// is held to the configured one.
+	s.cursorKey = []byte("key")
+	s.config.ExportMaxMatches = 3
+	c := &searchCursor{
+		Backend:    "a",
+		Query:      pb.Query{Line: "x", MaxMatches: 1000},
+		IndexTimes: indexTimes([]*Backend{s.bk["a"]}),
+		PageSize:   10,
+		key:        []byte("other"),
+	}
+	r = httptest.NewRequest("GET", "/api/v1/search/?cursor="+encodeCursor(c), nil)
+	w = httptest.NewRecorder()
+	s.ServeAPISearch(context.Background(), w, r)
+	if w.Code != 400 {
+		t.Errorf("expected status 400 for a cursor signed with another key, got %d", w.Code)
+	}
+	c.key = s.cursorKey
+	r = httptest.NewRequest("GET", "/api/v1/search/?cursor="+encodeCursor(c), nil)
+	w = httptest.NewRecorder()
+	s.ServeAPISearch(context.Background(), w, r)
+	reply = api.ReplySearch{}
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatalf("decoding reply: %v", err)
+	}
+	if len(reply.Results) != 3 {
+		t.Errorf("expected the search to stop at 3 results, got %d", len(reply.Results))
+	}
+}
+
+func TestResultSummary(t *testing.T) {
+	reply := &api.ReplySearch{
+		Results: []*api.Result{
+			{Tree: "r1", Path: "src/a.go", LineNumber: 1},
+			{Tree: "r1", Path: "src/a.go", LineNumber: 2},
+			{Tree: "r1", Path: "README", LineNumber: 1},
+			{Tree: "r2", Path: "lib/b.py", LineNumber: 1},
+		},
+	}
+	r := httptest.NewRequest("GET", "/api/v1/search/?q=x&group_by=tree&facets=repo,dir,ext", nil)
+	sum, err := parseResultSummary(r)
+	if err != nil {
+		t.Fatalf("parseResultSummary: %v", err)
+	}
+	sum.apply(reply)
+
+	var groups []string
+	for _, g := range reply.Groups {
+		groups = append(groups, fmt.Sprintf("%s:%d/%d", g.Tree, g.Files, g.Count))
+	}
+	if want := []string{"r1:2/3", "r2:1/1"}; !reflect.DeepEqual(groups, want) {
+		t.Errorf("expected groups %v, got %v", want, groups)
+	}
+
+	facets := make(map[string][]string)
+	for name, counts := range reply.Facets {
+		for _, c := range counts {
+			facets[name] = append(facets[name], fmt.Sprintf("%s=%d", c.Value, c.Count))
+		}
+	}
+	want := map[string][]string{
+		"repo": {"r1=3", "r2=1"},
+		"dir":  {"src/=2", "/=1", "lib/=1"},
+		"ext":  {".go=2", "=1", ".py=1"},
+	}
+	if !reflect.DeepEqual(facets, want) {
+		t.Errorf("expected facets %v, got %v", want, facets)
+	}
+
+	r = httptest.NewRequest("GET", "/api/v1/search/?q=x&facets=color", nil)
+	if _, err := parseResultSummary(r); err == nil {
+		t.Errorf("expected an error for an unknown facet")
+	}
+}
+
+func TestReplicaFailover(t *testing.T) {
+	down := &Replica{Addr: "down", Codesearch: &fakeCodeSearch{err: grpc.Errorf(codes.Unavailable, "connection refused")}}
+	down.health.LastSuccess = time.Now()
+	up := &Replica{Addr: "up", Codesearch: &fakeCodeSearch{result: fakeResult("r", 1, pb.SearchStats_NONE)}}
+	rs := &replicaSet{replicas: []*Replica{down, up}}
+
+	for i := 0; i < 4*maxReplicaFailures; i++ {
+		if _, err := rs.Search(context.Background(), &pb.Query{Line: "x"}); err != nil {
+			t.Fatalf("search %d failed: %v", i, err)
+		}
+	}
+	if !up.Health().Healthy() {
+		t.Errorf("expected replica %s to be healthy", up.Addr)
+	}
+	// Once unhealthy, the replica should no longer be tried.
+	if h := down.Health(); h.Healthy() || h.ConsecutiveFailures != maxReplicaFailures {
+		t.Errorf("expected replica %s to be unhealthy, got %+v", down.Addr, h)
+	}
+
+	// Streamed searches fail over too.
+	down = &Replica{Addr: "down", Codesearch: &fakeCodeSearch{err: grpc.Errorf(codes.Unavailable, "connection refused")}}
+	down.health.LastSuccess = time.Now()
+	rs = &replicaSet{replicas: []*Replica{down, up}}
+	for i := 0; i < 2; i++ {
+		stream, err := rs.StreamSearch(context.Background(), &pb.Query{Line: "x"})
+		if err != nil {
+			t.Fatalf("streamed search %d failed: %v", i, err)
+		}
+		if part, err := stream.Recv(); err != nil || len(part.Results) != 1 {
+			t.Errorf("expected a result from replica %s, got %v %v", up.Addr, part, err)
+		}
+	}
+	if h := down.Health(); h.ConsecutiveFailures != 1 {
+		t.Errorf("expected replica %s to have failed once, got %+v", down.Addr, h)
+	}
+
+	// So do searches a replica fails internally, or never answers.
+	broken := &Replica{Addr: "broken", Codesearch: &fakeCodeSearch{err: grpc.Errorf(codes.Internal, "crashed")}}
+	broken.health.LastSuccess = time.Now()
+	hung := &Replica{Addr: "hung", Codesearch: &fakeCodeSearch{result: fakeResult("r", 1, pb.SearchStats_NONE), hold: make(chan struct{})}}
+	hung.health.LastSuccess = time.Now()
+	// Start the rotation at the first replica.
+	rs = &replicaSet{replicas: []*Replica{broken, hung, up}, next: 2}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if _, err := rs.Search(ctx, &pb.Query{Line: "x"}); err != nil {
+		t.Fatalf("search failed: %v", err)
+	}
+	for _, r := range []*Replica{broken, hung} {
+		if h := r.Health(); h.ConsecutiveFailures != 1 {
+			t.Errorf("expected replica %s to have failed once, got %+v", r.Addr, h)
+		}
+	}
+
+	// A search the caller gives up on isn't the replica's fault.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	rs = &replicaSet{replicas: []*Replica{hung, up}, next: 1}
+	if _, err := rs.Search(ctx, &pb.Query{Line: "x"}); grpc.Code(err) != codes.Canceled {
+		t.Errorf("expected Canceled, got %v", err)
+	}
+	if h := hung.Health(); h.ConsecutiveFailures != 1 {
+		t.Errorf("expected a cancelled search not to count against replica %s, got %+v", hung.Addr, h)
+	}
+
+	bad := &Replica{Addr: "bad", Codesearch: &fakeCodeSearch{err: grpc.Errorf(codes.InvalidArgument, "bad regex")}}
+	bad.health.LastSuccess = time.Now()
+	rs = &replicaSet{replicas: []*Replica{bad}}
+	if _, err := rs.Search(context.Background(), &pb.Query{Line: "("}); grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument, got %v", err)
+	}
+	if !bad.Health().Healthy() {
+		t.Errorf("expected a replica returning InvalidArgument to stay healthy")
+	}
+}
+
+func TestQueryCache(t *testing.T) {
+	cs := &fakeCodeSearch{result: fakeResult("r", 2, pb.SearchStats_NONE)}
+	s := &server{cache: newQueryCache(10, 0)}
+	bk := &Backend{Id: "a", I: &I{Name: "a"}, Codesearch: cs, cache: s.cache}
+
+	search := func(line string) {
+		if _, err := s.doSearch(context.Background(), bk, &pb.Query{Line: line}); err != nil {
+			t.Fatalf("search failed: %v", err)
+		}
+	}
+	search("x")
+	search("x")
+	search("y")
+	if cs.searches != 2 {
+		t.Errorf("expected 2 searches to reach the backend, got %d", cs.searches)
+	}
+
+	bk.refresh(&pb.ServerInfo{IndexTime: 1234})
+	search("x")
+	if cs.searches != 3 {
+		t.Errorf("expected a new index to invalidate the cache, got %d searches", cs.searches)
+	}
+
+	st := s.cache.stats()
+	if st.Hits != 1 || st.Misses != 3 || st.Entries != 1 {
+		t.Errorf("unexpected cache stats %+v", st)
+	}
+	// Searches that timed out aren't cached.
+	cs.result = fakeResult("r", 1, pb.SearchStats_TIMEOUT)
+	search("z")
+	search("z")
+	if cs.searches != 5 {
+		t.Errorf("expected a timed-out search to be repeated, got %d searches", cs.searches)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s := &server{
+		config: &config.Config{},
+		bk: map[string]*Backend{
+			"a": {Id: "a", I: &I{Name: "a", IndexTime: time.Now()}, Codesearch: &fakeCodeSearch{result: fakeResult("ra", 1, pb.SearchStats_TIMEOUT)}},
+		},
+		bkOrder: []string{"a"},
+	}
+	s.metrics = newServerMetrics(s)
+
+	search := s.instrument("search", s.ServeAPISearch)
+	search(context.Background(), httptest.NewRecorder(),
+		httptest.NewRequest("GET", "/api/v1/search/?q=x&%3Abackend=a", nil))
+	search(context.Background(), httptest.NewRecorder(),
+		httptest.NewRequest("GET", "/api/v1/search/?q=&%3Abackend=a", nil))
+
+	w := httptest.NewRecorder()
+	s.ServeMetrics(context.Background(), w, httptest.NewRequest("GET", "/debug/metrics", nil))
+	out := w.Body.String()
+	for _, want := range []string{
+		`livegrep_http_requests_total{handler="search",code="200"} 1`,
+		`livegrep_http_requests_total{handler="search",code="400"} 1`,
+		`livegrep_http_request_duration_seconds_count{handler="search"} 2`,
+		`livegrep_backend_rpc_duration_seconds_count{backend="a"} 1`,
+		`livegrep_search_exit_reason_total{backend="a",reason="TIMEOUT"} 1`,
+		`livegrep_backend_index_age_seconds{backend="a"}`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected metrics to contain %q, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestSearchEvents(t *testing.T) {
+	var buf bytes.Buffer
+	s := &server{
+		config: &config.Config{},
+		bk: map[string]*Backend{
+			"a": {Id: "a", Codesearch: &fakeCodeSearch{result: fakeResult("ra", 2, pb.SearchStats_NONE)}},
+		},
+		bkOrder: []string{"a"},
+		events:  &jsonLinesSink{w: &buf},
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/search/?q=x&%3Abackend=a", nil)
+	s.ServeAPISearch(context.Background(), httptest.NewRecorder(), r)
+
+	var ev map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &ev); err != nil {
+		t.Fatalf("decoding event %q: %v", buf.String(), err)
+	}
+	if ev["event_type"] != "search" || ev["backend"] != "a" || ev["query_line"] != "x" || ev["result_count"] != 2.0 {
+		t.Errorf("unexpected event %v", ev)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	s := &server{
+		config: &config.Config{},
+		bk: map[string]*Backend{
+			"a": {Id: "a", Codesearch: &fakeCodeSearch{result: fakeResult("ra", 1, pb.SearchStats_NONE)}},
+		},
+		bkOrder: []string{"a"},
+	}
+	var err error
+	s.limiter, err = newRateLimiter(&config.Config{
+		APIKeys:   []config.APIKey{{Name: "bot", Key: "s3kr1t"}},
+		RateLimit: config.RateLimit{PerKey: 0.001, PerKeyBurst: 2, PerIP: 0.001, PerIPBurst: 1},
+	})
+	if err != nil {
+		t.Fatalf("newRateLimiter: %v", err)
+	}
+	h := s.APIHandler(s.ServeAPISearch)
+
+	get := func(key, ip string) (int, string) {
+		r := httptest.NewRequest("GET", "/api/v1/search/?q=x&%3Abackend=a", nil)
+		r.RemoteAddr = ip + ":1234"
+		if key != "" {
+			r.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		var reply api.ReplyError
+		json.Unmarshal(w.Body.Bytes(), &reply)
+		return w.Code, reply.Err.Code
+	}
+
+	want := []struct {
+		key, ip string
+		status  int
+		code    string
+	}{
+		{"s3kr1t", "10.0.0.1", 200, ""},
+		{"s3kr1t", "10.0.0.2", 200, ""},
+		{"s3kr1t", "10.0.0.1", 429, "rate_limited"},
+		{"", "10.0.0.1", 200, ""},
+		{"", "10.0.0.1", 429, "rate_limited"},
+		{"", "10.0.0.2", 200, ""},
+		{"wrong", "10.0.0.3", 401, "bad_api_key"},
+	}
+	for i, w := range want {
+		if status, code := get(w.key, w.ip); status != w.status || code != w.code {
+			t.Errorf("request %d: expected %d %q, got %d %q", i, w.status, w.code, status, code)
+		}
+	}
+
+	usage := s.limiter.stats()["bot"]
+	if usage.Requests != 3 || usage.RateLimited != 1 {
+		t.Errorf("unexpected usage for bot: %+v", usage)
+	}
+}
+
+func TestRateLimitRequireKey(t *testing.T) {
+	cfg := &config.Config{
+		APIKeys:      []config.APIKey{{Name: "bot", Key: "s3kr1t"}},
+		RateLimit:    config.RateLimit{PerIP: 0.001, PerIPBurst: 1, RequireKey: true},
+		ReverseProxy: true,
+	}
+	s := &server{
+		config: cfg,
+		bk: map[string]*Backend{
+			"a": {Id: "a", Codesearch: &fakeCodeSearch{result: fakeResult("ra", 1, pb.SearchStats_NONE)}},
+		},
+		bkOrder: []string{"a"},
+	}
+	var err error
+	if s.limiter, err = newRateLimiter(cfg); err != nil {
+		t.Fatalf("newRateLimiter: %v", err)
+	}
+	h := s.APIHandler(s.ServeAPISearch)
+
+	// The search page hands the web UI a cookie to search with,
+	// good only for the address it was given to.
+	page := httptest.NewRequest("GET", "/search/", nil)
+	page.Header.Set("X-Real-Ip", "10.0.0.1")
+	w := httptest.NewRecorder()
+	s.limiter.setUICookie(w, page)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected the search page to set a cookie, got %v", cookies)
+	}
+	expired := &http.Cookie{Name: uiCookie, Value: s.limiter.uiToken(page, time.Now().Add(-time.Minute).Unix())}
+
+	get := func(query, ip string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/v1/search/?q=x&%3Abackend=a"+query, nil)
+		r.Header.Set("X-Real-Ip", ip)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	want := []struct {
+		query, ip string
+		cookie    *http.Cookie
+		status    int
+	}{
+		{"", "10.0.0.1", nil, 401},
+		{"&api_key=s3kr1t", "10.0.0.1", nil, 401},
+		{"", "10.0.0.1", &http.Cookie{Name: uiCookie, Value: "forged"}, 401},
+		{"", "10.0.0.1", expired, 401},
+		{"", "10.0.0.2", cookies[0], 401},
+		{"", "10.0.0.1", cookies[0], 200},
+		// Limited by the address the proxy reports.
+		{"", "10.0.0.1", cookies[0], 429},
+	}
+	for i, want := range want {
+		w := get(want.query, want.ip, want.cookie)
+		if w.Code != want.status {
+			t.Errorf("request %d: expected %d, got %d", i, want.status, w.Code)
+		}
+		// Using the cookie keeps it from expiring.
+		if w.Code == 200 && len(w.Result().Cookies()) != 1 {
+			t.Errorf("request %d: expected the cookie to be renewed", i)
+		}
+	}
+}
+
+func TestSavedSearches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "livegrep-saved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &config.SavedSearches{
+		Path:    filepath.Join(dir, "saved.json"),
+		Mailbox: filepath.Join(dir, "mbox"),
+	}
+	store, err := newSavedSearchStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs := &fakeCodeSearch{result: fakeResult("ra", 2, pb.SearchStats_NONE)}
+	bk := &Backend{Id: "a", I: &I{Name: "a", IndexTime: time.Unix(100, 0)}, Codesearch: cs}
+	s := &server{
+		config:  &config.Config{},
+		bk:      map[string]*Backend{"a": bk},
+		bkOrder: []string{"a"},
+		saved:   store,
+	}
+	if err := store.add(&savedSearch{Name: "uses of x", Query: "x", Backend: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first run records the matches without reporting them.
+	s.runSavedSearches(bk)
+	if _, err := os.Stat(cfg.Mailbox); !os.IsNotExist(err) {
+		t.Errorf("expected no mail after the first run, got err=%v", err)
+	}
+
+	// After a reindex, a line that has moved isn't new, but one
+	// that appeared is.
+	result := fakeResult("ra", 2, pb.SearchStats_NONE)
+	result.Results[0].LineNumber = 10
+	result.Results = append(result.Results, &pb.SearchResult{
+		Tree: "ra", Path: "new.go", LineNumber: 3, Line: "x := 1", Bounds: &pb.Bounds{},
+	})
+	cs.result = result
+	bk.I.IndexTime = time.Unix(200, 0)
+	s.runSavedSearches(bk)
+
+	mail, err := ioutil.ReadFile(cfg.Mailbox)
+	if err != nil {
+		t.Fatalf("reading mailbox: %v", err)
+	}
+	if !strings.Contains(string(mail), `Subject: 1 new match for "uses of x"`) ||
+		!strings.Contains(string(mail), "ra:new.go:3: x := 1") ||
+		strings.Contains(string(mail), "file.go") {
+		t.Errorf("unexpected mail:\n%s", mail)
+	}
+
+	// The matches survive a restart, and aren't reported again for
+	// the same index.
+	reloaded, err := newSavedSearchStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	searches := reloaded.list(nil)
+	if len(searches) != 1 || len(searches[0].Matches) != 3 || searches[0].IndexTime != 200 {
+		t.Fatalf("unexpected saved searches after reload: %s", asJSON{searches})
+	}
+	s.saved = reloaded
+	before := atomic.LoadInt32(&cs.searches)
+	s.runSavedSearches(bk)
+	if atomic.LoadInt32(&cs.searches) != before {
+		t.Errorf("expected no search for an index that was already searched")
+	}
+}
+
+// A saved search whose matches couldn't be delivered keeps its old
+// matches, so that the next run delivers the new ones again.
+func TestSavedSearchRedelivery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "livegrep-saved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	status := http.StatusInternalServerError
+	delivered := 0
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status == http.StatusOK {
+			delivered++
+		}
+		w.WriteHeader(status)
+	}))
+	defer hook.Close()
+
+	st, err := newSavedSearchStore(&config.SavedSearches{
+		Path:         filepath.Join(dir, "saved.json"),
+		WebhookHosts: []string{"127.0.0.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bk := &Backend{
+		Id:         "a",
+		I:          &I{Name: "a", IndexTime: time.Unix(2, 0)},
+		Codesearch: &fakeCodeSearch{result: fakeResult("ra", 2, pb.SearchStats_NONE)},
+	}
+	s := &server{
+		config:  &config.Config{},
+		bk:      map[string]*Backend{"a": bk},
+		bkOrder: []string{"a"},
+		saved:   st,
+	}
+	// The search has run before, and found nothing.
+	ss := &savedSearch{Query: "x", Backend: "a", Webhook: hook.URL, IndexTime: 1}
+	if err := st.add(ss); err != nil {
+		t.Fatal(err)
+	}
+
+	s.runSavedSearches(bk)
+	got := st.list(nil)[0]
+	if got.LastError == "" || got.IndexTime != 1 || len(got.Matches) != 0 {
+		t.Errorf("expected a failed delivery to keep the old matches, got %+v", got)
+	}
+
+	status = http.StatusOK
+	s.runSavedSearches(bk)
+	got = st.list(nil)[0]
+	if delivered != 1 || got.LastError != "" || got.IndexTime != 2 || len(got.Matches) != 2 {
+		t.Errorf("expected the matches to be delivered and recorded, got %d deliveries and %+v", delivered, got)
+	}
+}
+
+// A saved search that stops at the match limit reports what it found
+// that's new, but not what it may have cut off as removed, and doesn't
+// forget that.
+func TestSavedSearchIncomplete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "livegrep-saved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var notices []*savedSearchNotice
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n savedSearchNotice
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Errorf("decoding notice: %v", err)
+		}
+		notices = append(notices, &n)
+	}))
+	defer hook.Close()
+
+	st, err := newSavedSearchStore(&config.SavedSearches{
+		Path:         filepath.Join(dir, "saved.json"),
+		MaxMatches:   2,
+		WebhookHosts: []string{"127.0.0.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &fakeCodeSearch{result: fakeResult("ra", 2, pb.SearchStats_NONE)}
+	bk := &Backend{Id: "a", I: &I{Name: "a", IndexTime: time.Unix(2, 0)}, Codesearch: cs}
+	s := &server{
+		config:  &config.Config{},
+		bk:      map[string]*Backend{"a": bk},
+		bkOrder: []string{"a"},
+		saved:   st,
+	}
+	ss := &savedSearch{Query: "x", Backend: "a", Webhook: hook.URL}
+	if err := st.add(ss); err != nil {
+		t.Fatal(err)
+	}
+	s.runSavedSearches(bk)
+
+	// A new match sorts first, pushing an old one past the limit.
+	result := fakeResult("ra", 2, pb.SearchStats_NONE)
+	result.Results = append([]*pb.SearchResult{{
+		Tree: "ra", Path: "a.go", LineNumber: 1, Line: "x := 1", Bounds: &pb.Bounds{},
+	}}, result.Results...)
+	cs.result = result
+	bk.I.IndexTime = time.Unix(3, 0)
+	s.runSavedSearches(bk)
+
+	if len(notices) != 1 {
+		t.Fatalf("expected 1 notice, got %d", len(notices))
+	}
+	if n := notices[0]; !n.Incomplete || n.Removed != 0 || len(n.New) != 1 || n.New[0].Path != "a.go" {
+		t.Errorf("unexpected notice %s", asJSON{n})
+	}
+	if got := st.list(nil)[0]; len(got.Matches) != 3 {
+		t.Errorf("expected the cut off match to be remembered, got %v", got.Matches)
+	}
+}
+
+// A webhook that is slow to answer doesn't hold up other backends'
+// saved searches.
+func TestSavedSearchSlowWebhook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "livegrep-saved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	called := make(chan struct{}, 1)
+	release := make(chan struct{})
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called <- struct{}{}
+		<-release
+	}))
+	defer hook.Close()
+	defer close(release)
+
+	st, err := newSavedSearchStore(&config.SavedSearches{
+		Path:         filepath.Join(dir, "saved.json"),
+		WebhookHosts: []string{"127.0.0.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{config: &config.Config{}, bk: map[string]*Backend{}, saved: st}
+	for _, id := range []string{"a", "b"} {
+		s.bk[id] = &Backend{
+			Id:         id,
+			I:          &I{Name: id, IndexTime: time.Unix(2, 0)},
+			Codesearch: &fakeCodeSearch{result: fakeResult("r"+id, 1, pb.SearchStats_NONE)},
+		}
+		s.bkOrder = append(s.bkOrder, id)
+		// Each search has run before, and found nothing.
+		if err := st.add(&savedSearch{Query: "x", Backend: id, Webhook: hook.URL, IndexTime: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	go s.runSavedSearches(s.bk["a"])
+	<-called
+	done := make(chan struct{})
+	go func() {
+		s.runSavedSearches(s.bk["b"])
+		close(done)
+	}()
+	<-called
+	// Backend a's search isn't run again while its notice is
+	// still being delivered.
+	s.runSavedSearches(s.bk["a"])
+	select {
+	case <-called:
+		t.Errorf("expected a search being delivered not to run again")
+	default:
+	}
+	release <- struct{}{}
+	release <- struct{}{}
+	<-done
+}
+
+// Other sites' pages can't save searches, nor send their matches
+// anywhere but the allowed hosts.
+func TestSaveSearchChecks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "livegrep-saved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := newSavedSearchStore(&config.SavedSearches{
+		Path:         filepath.Join(dir, "saved.json"),
+		WebhookHosts: []string{"hooks.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{
+		config: &config.Config{},
+		bk: map[string]*Backend{
+			"a": {Id: "a", I: &I{Name: "a"}, Codesearch: &fakeCodeSearch{result: fakeResult("ra", 1, pb.SearchStats_NONE)}},
+		},
+		bkOrder: []string{"a"},
+		saved:   st,
+	}
+
+	tests := []struct {
+		origin  string
+		webhook string
+		code    int
+	}{
+		{"", "", 403},
+		{"http://evil.example.com", "", 403},
+		{"null", "", 403},
+		{"http://example.com", "", 200},
+		{"http://example.com", "https://hooks.example.com/new", 200},
+		{"http://example.com", "http://169.254.169.254/", 400},
+		{"http://example.com", "file:///etc/passwd", 400},
+	}
+	for _, test := range tests {
+		form := url.Values{"q": {"x"}, "webhook": {test.webhook}}
+		r := httptest.NewRequest("POST", "http://example.com/api/v1/saved/", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		w := httptest.NewRecorder()
+		s.ServeAPISaveSearch(context.Background(), w, r)
+		if w.Code != test.code {
+			t.Errorf("origin %q, webhook %q: expected status %d, got %d: %s",
+				test.origin, test.webhook, test.code, w.Code, w.Body.String())
+		}
+	}
+}
+
+// A saved search runs with its owner's current groups, and is dropped
+// once they can no longer see its backend.
+func TestSavedSearchOwnerAccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "livegrep-saved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := newSavedSearchStore(&config.SavedSearches{Path: filepath.Join(dir, "saved.json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl, err := newAccessControl(&config.Auth{
+		ACL: []config.ACLRule{{Repos: []string{"ra"}, Groups: []string{"eng"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bk := &Backend{
+		Id:         "a",
+		I:          &I{Name: "a", Trees: []Tree{{Name: "ra"}}, IndexTime: time.Unix(2, 0)},
+		Codesearch: &fakeCodeSearch{result: fakeResult("ra", 2, pb.SearchStats_NONE)},
+	}
+	s := &server{
+		config:  &config.Config{},
+		bk:      map[string]*Backend{"a": bk},
+		bkOrder: []string{"a"},
+		saved:   st,
+		acl:     acl,
+	}
+	ss := &savedSearch{Query: "x", Backend: "a", Owner: "alice", Groups: []string{"eng"}}
+	if err := st.add(ss); err != nil {
+		t.Fatal(err)
+	}
+
+	s.runSavedSearches(bk)
+	if got := st.list(nil); len(got) != 1 || len(got[0].Matches) != 2 {
+		t.Fatalf("expected the search to find 2 matches, got %+v", got)
+	}
+
+	// Alice has since left the group.
+	if err := st.refreshGroups(&user{Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	bk.I.IndexTime = time.Unix(3, 0)
+	s.runSavedSearches(bk)
+	if got := st.list(nil); len(got) != 0 {
+		t.Errorf("expected the search to be dropped, got %+v", got)
+	}
+}
+
+func TestExport(t *testing.T) {
+	s := &server{
+		config: &config.Config{DefaultMaxMatches: 1, ExportMaxMatches: 3},
+		bk: map[string]*Backend{
+			"a": {Id: "a", Codesearch: &fakeCodeSearch{result: fakeResult("ra", 4, pb.SearchStats_NONE)}},
+		},
+		bkOrder: []string{"a"},
+	}
+
+	// Exports ignore the default limit, but not the export limit.
+	w := httptest.NewRecorder()
+	s.ServeAPIExport(context.Background(), w, httptest.NewRequest("GET", "/api/v1/export/?q=x&%3Abackend=a", nil))
+	if w.Code != 200 {
+		t.Fatalf("export failed: %d %s", w.Code, w.Body.String())
+	}
+	want := "tree,version,path,lno,line,start,end\n" +
+		"ra,,file.go,1,,0,0\n" +
+		"ra,,file.go,2,,0,0\n" +
+		"ra,,file.go,3,,0,0\n"
+	if w.Body.String() != want {
+		t.Errorf("unexpected CSV export:\n%s", w.Body.String())
+	}
+	if reason := w.Result().Trailer.Get("X-Livegrep-Exit-Reason"); reason != "MATCH_LIMIT" {
+		t.Errorf("expected the export to report its limit, got %q", reason)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeAPIExport(context.Background(), w, httptest.NewRequest("GET", "/api/v1/export/?q=x+max_matches:2&format=json&%3Abackend=a", nil))
+	var rows []exportRow
+	dec := json.NewDecoder(w.Body)
+	for dec.More() {
+		var row exportRow
+		if err := dec.Decode(&row); err != nil {
+			t.Fatalf("decoding JSON export: %v", err)
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) != 2 || rows[1].Tree != "ra" || rows[1].LineNumber != 2 {
+		t.Errorf("unexpected JSON export: %+v", rows)
+	}
+
+	s.bk["a"].Codesearch = &fakeCodeSearch{result: fakeResult("ra", 2, pb.SearchStats_NONE)}
+	w = httptest.NewRecorder()
+	s.ServeAPIExport(context.Background(), w, httptest.NewRequest("GET", "/api/v1/export/?q=x&%3Abackend=a", nil))
+	if reason := w.Result().Trailer.Get("X-Livegrep-Exit-Reason"); reason != "NONE" {
+		t.Errorf("expected a complete export, got %q", reason)
+	}
+}
+
+// A fanned out export writes each backend's rows as it finishes.
+func TestExportIncremental(t *testing.T) {
+	hold := make(chan struct{})
+	s := &server{
+		config: &config.Config{},
+		bk: map[string]*Backend{
+			"a": {Id: "a", Codesearch: &fakeCodeSearch{result: fakeResult("ra", 2, pb.SearchStats_NONE)}},
+			"b": {Id: "b", Codesearch: &fakeCodeSearch{result: fakeResult("rb", 2, pb.SearchStats_NONE), hold: hold}},
+			"c": {Id: "c", Codesearch: &fakeCodeSearch{err: grpc.Errorf(codes.Unavailable, "down")}},
+		},
+		bkOrder: []string{"a", "b", "c"},
+	}
+
+	w := &flushRecorder{httptest.NewRecorder(), make(chan string)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ServeAPIExport(context.Background(), w, httptest.NewRequest("GET", "/api/v1/export/?q=x&%3Abackend=*", nil))
+	}()
+	select {
+	case rows := <-w.flushed:
+		if !strings.Contains(rows, "ra,,file.go,2,,0,0\n") {
+			t.Errorf("expected backend a's rows, got %q", rows)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no rows before every backend finished")
+	}
+	close(hold)
+	for finished := false; !finished; {
+		select {
+		case <-w.flushed:
+		case <-done:
+			finished = true
+		}
+	}
+	if reason := w.Result().Trailer.Get("X-Livegrep-Exit-Reason"); reason != "NONE" {
+		t.Errorf("expected a complete export, got %q", reason)
+	}
+	if e := w.Result().Trailer.Get("X-Livegrep-Error"); !strings.Contains(e, "down") {
+		t.Errorf("expected backend c's failure to be reported, got %q", e)
+	}
+}
+
+func TestPermalink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "livegrep-permalinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bk := &Backend{
+		Id:         "a",
+		I:          &I{Name: "a", IndexTime: time.Unix(100, 0), Trees: []Tree{{Name: "ra", Version: "v1"}}},
+		Codesearch: &fakeCodeSearch{result: fakeResult("ra", 2, pb.SearchStats_NONE)},
+	}
+	s := &server{
+		config:  &config.Config{Permalinks: config.Permalinks{Dir: dir}},
+		bk:      map[string]*Backend{"a": bk},
+		bkOrder: []string{"a"},
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeNewPermalink(context.Background(), w, httptest.NewRequest("GET", "/permalink/new/a?q=x&%3Abackend=a", nil))
+	if w.Code != 303 {
+		t.Fatalf("expected a redirect, got %d %s", w.Code, w.Body.String())
+	}
+	id := strings.TrimPrefix(w.Header().Get("Location"), "/permalink/")
+
+	bk.I.IndexTime = time.Unix(200, 0)
+	bk.I.Trees = []Tree{{Name: "ra", Version: "v2"}}
+	bk.Codesearch = &fakeCodeSearch{err: errors.New("permalinks shouldn't search")}
+
+	w = httptest.NewRecorder()
+	s.ServeAPIPermalink(context.Background(), w, httptest.NewRequest("GET", "/api/v1/permalink/"+id+"?%3Aid="+id, nil))
+	var view permalinkView
+	if err := json.Unmarshal(w.Body.Bytes(), &view); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+	if view.Query != "x" || !view.IndexTime.Equal(time.Unix(100, 0)) || view.SearchURL != "/search/a?q=x" {
+		t.Errorf("unexpected permalink %s", asJSON{view})
+	}
+	if !reflect.DeepEqual(view.Moved, []movedTree{{"ra", "v1", "v2"}}) {
+		t.Errorf("expected ra to have moved from v1 to v2, got %v", view.Moved)
+	}
+	if len(view.Results) != 2 || !view.Results[1].Moved || view.Results[1].LineNumber != 2 {
+		t.Errorf("unexpected results %s", asJSON{view.Results})
+	}
+}
+
+func TestBlameAPI(t *testing.T) {
+	repo := newTestRepo(t)
+	defer repo.remove()
+	repo.commit("f.txt", "one\ntwo\n", "first")
+	repo.commit("f.txt", "one\n2\nthree\n", "second")
+	history := repo.history()
+	setHistory("blame-api", history)
+	defer setHistory("blame-api", nil)
+	first, second := history.Hashes[0], history.Hashes[1]
+
+	s := &server{repos: map[string]config.RepoConfig{
+		"blame-api": {Name: "blame-api", Path: repo.dir},
+	}}
+	blame := func(hash, path string) (int, *api.ReplyBlame) {
+		return blameAPI(t, s, "blame-api", hash, path)
+	}
+
+	// HEAD is the last commit we know of.
+	code, reply := blame("HEAD", "f.txt")
+	if code != 200 {
+		t.Fatalf("blame failed: %d", code)
+	}
+	if reply.Commit.Hash != second || reply.Commit.Subject != "second" ||
+		reply.PreviousCommit != first || reply.NextCommit != "" {
+		t.Errorf("unexpected commit: %+v %+v", reply, reply.Commit)
+	}
+	var lines []string
+	for _, l := range reply.Lines {
+		lines = append(lines, fmt.Sprintf("%d %v %d %s %s %v", l.LineNumber,
+			l.PreviousCommit == second, l.PreviousLineNumber,
+			l.Author, l.Date, l.NextCommit != ""))
+	}
+	want := []string{
+		"1 false 1 a@example.com 2018-01-02 false",
+		"2 true 2 a@example.com 2018-01-02 false",
+		"3 true 3 a@example.com 2018-01-02 false",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("unexpected lines:\n%s", strings.Join(lines, "\n"))
+	}
+
+	// An earlier commit says when each line changes next.
+	_, reply = blame(first, "f.txt")
+	if l := reply.Lines[1]; l.PreviousCommit != first || l.NextCommit != second || l.NextLineNumber != 2 {
+		t.Errorf("unexpected line: %+v", l)
+	}
+	if l := reply.Lines[0]; l.NextCommit != "" {
+		t.Errorf("unexpected line: %+v", l)
+	}
+
+	if code, _ := blame("HEAD", "missing.txt"); code != 404 {
+		t.Errorf("blame of a missing file returned %d", code)
+	}
+}
+
+func blameAPI(t *testing.T, s *server, repo, hash, path string) (int, *api.ReplyBlame) {
+	w := httptest.NewRecorder()
+	url := fmt.Sprintf("/api/v1/blame/%s/%s/%s?%%3Arepo=%s&%%3Ahash=%s", repo, hash, path, repo, hash)
+	s.ServeAPIBlame(context.Background(), w, httptest.NewRequest("GET", url, nil))
+	var reply api.ReplyBlame
+	if w.Code == 200 {
+		if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, &reply
+}
@@ -0,0 +1,329 @@
+package server
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/config"
+)
+
+// user is someone who has authenticated to livegrep.
+type user struct {
+	Name   string
+	Groups []string
+}
+
+type userKey struct{}
+
+// userFromContext returns the user making a request, or nil if
+// authentication is disabled.
+func userFromContext(ctx context.Context) *user {
+	u, _ := ctx.Value(userKey{}).(*user)
+	return u
+}
+
+// An authenticator identifies the user making a request. If it can't,
+// it responds to the request itself, with an error or a redirect to a
+// login page, and returns nil.
+type authenticator interface {
+	authenticate(w http.ResponseWriter, r *http.Request) *user
+}
+
+func newAuthenticator(cfg *config.Auth) (authenticator, error) {
+	switch cfg.Method {
+	case "":
+		return nil, nil
+	case "proxy":
+		a := &proxyAuth{userHeader: cfg.UserHeader, groupsHeader: cfg.GroupsHeader}
+		if a.userHeader == "" {
+			a.userHeader = "X-Forwarded-User"
+		}
+		if a.groupsHeader == "" {
+			a.groupsHeader = "X-Forwarded-Groups"
+		}
+		return a, nil
+	case "basic":
+		return newBasicAuth(cfg.Htpasswd)
+	case "oidc":
+		return newOIDCAuth(&cfg.OIDC)
+	default:
+		return nil, fmt.Errorf("unknown auth method: %q", cfg.Method)
+	}
+}
+
+// authHandler requires every request to be authenticated, and passes
+// the user along to the handlers in the request's context. API
+// requests may instead carry an API key known to keys.
+type authHandler struct {
+	auth  authenticator
+	keys  *rateLimiter
+	inner http.Handler
+}
+
+func (h *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Load balancers need to check on us without logging in, and
+	// config reloads check the admin key themselves.
+	if r.URL.Path == "/debug/healthcheck" || r.URL.Path == "/debug/reload-config" {
+		h.inner.ServeHTTP(w, r)
+		return
+	}
+	u := h.keys.keyUser(r)
+	if u == nil {
+		u = h.auth.authenticate(w, r)
+	}
+	if u == nil {
+		return
+	}
+	h.inner.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, u)))
+}
+
+// proxyAuth trusts a reverse proxy in front of livegrep to have
+// authenticated the user.
+type proxyAuth struct {
+	userHeader   string
+	groupsHeader string
+}
+
+func (a *proxyAuth) authenticate(w http.ResponseWriter, r *http.Request) *user {
+	name := r.Header.Get(a.userHeader)
+	if name == "" {
+		http.Error(w, "401 Not authenticated", 401)
+		return nil
+	}
+	u := &user{Name: name}
+	for _, g := range strings.Split(r.Header.Get(a.groupsHeader), ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			u.Groups = append(u.Groups, g)
+		}
+	}
+	return u
+}
+
+// basicAuth checks HTTP basic credentials against an htpasswd file.
+type basicAuth struct {
+	passwords map[string]string
+}
+
+func newBasicAuth(path string) (*basicAuth, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := &basicAuth{passwords: make(map[string]string)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("%s: malformed line %q", path, line)
+		}
+		name, hash := line[:i], line[i+1:]
+		if !strings.HasPrefix(hash, "$apr1$") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("%s: unsupported password hash for %s", path, name)
+		}
+		a.passwords[name] = hash
+	}
+	return a, scanner.Err()
+}
+
+func (a *basicAuth) authenticate(w http.ResponseWriter, r *http.Request) *user {
+	name, password, ok := r.BasicAuth()
+	if ok {
+		if hash, found := a.passwords[name]; found && checkHtpasswd(hash, password) {
+			return &user{Name: name}
+		}
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="livegrep"`)
+	http.Error(w, "401 Not authenticated", 401)
+	return nil
+}
+
+func checkHtpasswd(hash, password string) bool {
+	var want string
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		want = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.TrimPrefix(hash, "$apr1$")
+		if i := strings.Index(salt, "$"); i >= 0 {
+			salt = salt[:i]
+		}
+		want = apr1(password, salt)
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(want)) == 1
+}
+
+// apr1 computes Apache's variant of the MD5-based crypt(3) hash.
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+	h := md5.New()
+	h.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(alt[:])
+		} else {
+			h.Write(alt[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	sum := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(pw)
+		}
+		sum = h.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out []byte
+	encode := func(a, b, c byte, n int) {
+		v := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	encode(sum[0], sum[6], sum[12], 4)
+	encode(sum[1], sum[7], sum[13], 4)
+	encode(sum[2], sum[8], sum[14], 4)
+	encode(sum[3], sum[9], sum[15], 4)
+	encode(sum[4], sum[10], sum[5], 4)
+	encode(0, 0, sum[11], 2)
+	return magic + salt + "$" + string(out)
+}
+
+// accessControl decides which repositories each user can see.
+type accessControl struct {
+	rules  []aclRule
+	groups map[string][]string // user -> groups from the config
+}
+
+type aclRule struct {
+	repos  *regexp.Regexp
+	users  map[string]bool
+	groups map[string]bool
+}
+
+func newAccessControl(cfg *config.Auth) (*accessControl, error) {
+	if len(cfg.ACL) == 0 {
+		return nil, nil
+	}
+	acl := &accessControl{groups: make(map[string][]string)}
+	for group, members := range cfg.Groups {
+		for _, m := range members {
+			acl.groups[m] = append(acl.groups[m], group)
+		}
+	}
+	for _, rule := range cfg.ACL {
+		re, err := regexp.Compile("^(?:" + alternation(rule.Repos, false) + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("acl: %v", err)
+		}
+		r := aclRule{repos: re, users: make(map[string]bool), groups: make(map[string]bool)}
+		for _, u := range rule.Users {
+			r.users[u] = true
+		}
+		for _, g := range rule.Groups {
+			r.groups[g] = true
+		}
+		acl.rules = append(acl.rules, r)
+	}
+	return acl, nil
+}
+
+// allowed reports whether u may see repo. A nil *accessControl allows
+// everything.
+func (acl *accessControl) allowed(u *user, repo string) bool {
+	if acl == nil {
+		return true
+	}
+	restricted := false
+	for _, rule := range acl.rules {
+		if !rule.repos.MatchString(repo) {
+			continue
+		}
+		restricted = true
+		if u == nil {
+			continue
+		}
+		if rule.users[u.Name] {
+			return true
+		}
+		for _, g := range u.Groups {
+			if rule.groups[g] {
+				return true
+			}
+		}
+		for _, g := range acl.groups[u.Name] {
+			if rule.groups[g] {
+				return true
+			}
+		}
+	}
+	return !restricted
+}
+
+// canSee reports whether the user making a request may see repo.
+func (s *server) canSee(ctx context.Context, repo string) bool {
+	return s.acl.allowed(userFromContext(ctx), repo)
+}
+
+// hiddenRepos returns a pattern matching the repositories of bk that
+// the user making a request may not see, or "" if they may see all of
+// them.
+func (s *server) hiddenRepos(ctx context.Context, bk *Backend) string {
+	if s.acl == nil {
+		return ""
+	}
+	var hidden []string
+	bk.I.Lock()
+	defer bk.I.Unlock()
+	for _, t := range bk.I.Trees {
+		if !s.canSee(ctx, t.Name) {
+			hidden = append(hidden, "^"+regexp.QuoteMeta(t.Name)+"$")
+		}
+	}
+	return alternation(hidden, false)
+}
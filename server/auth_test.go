@@ -0,0 +1,184 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/config"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+func TestCheckHtpasswd(t *testing.T) {
+	cases := []struct {
+		hash, password string
+		want           bool
+	}{
+		{"$apr1$5Ls.bXgT$G/H5ChsI7TyD3zYlbdvHL/", "secret", true},
+		{"$apr1$5Ls.bXgT$G/H5ChsI7TyD3zYlbdvHL/", "Secret", false},
+		{"$apr1$ab$ngw.CbCd0iFg7FKpgYg3J1", "longerpassword12345678", true},
+		{"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret", true},
+		{"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secrets", false},
+		{"secret", "secret", false},
+	}
+	for _, tc := range cases {
+		if got := checkHtpasswd(tc.hash, tc.password); got != tc.want {
+			t.Errorf("checkHtpasswd(%q, %q) = %v, want %v", tc.hash, tc.password, got, tc.want)
+		}
+	}
+}
+
+func TestAccessControl(t *testing.T) {
+	acl, err := newAccessControl(&config.Auth{
+		Groups: map[string][]string{"infra": {"carol"}},
+		ACL: []config.ACLRule{
+			{Repos: []string{"private/.*"}, Users: []string{"alice"}},
+			{Repos: []string{"private/ops"}, Groups: []string{"infra"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("newAccessControl: %v", err)
+	}
+
+	alice := &user{Name: "alice"}
+	bob := &user{Name: "bob"}
+	carol := &user{Name: "carol"}
+	dave := &user{Name: "dave", Groups: []string{"infra"}}
+	cases := []struct {
+		u    *user
+		repo string
+		want bool
+	}{
+		{bob, "public", true},
+		{nil, "public", true},
+		{alice, "private/code", true},
+		{bob, "private/code", false},
+		{nil, "private/code", false},
+		{carol, "private/ops", true},
+		{carol, "private/code", false},
+		{dave, "private/ops", true},
+	}
+	for _, tc := range cases {
+		if got := acl.allowed(tc.u, tc.repo); got != tc.want {
+			t.Errorf("allowed(%v, %q) = %v, want %v", tc.u, tc.repo, got, tc.want)
+		}
+	}
+
+	result := &pb.CodeSearchResult{Stats: &pb.SearchStats{}}
+	for _, tree := range []string{"private/code", "public"} {
+		result.Results = append(result.Results, &pb.SearchResult{Tree: tree, Bounds: &pb.Bounds{}})
+	}
+	s := &server{
+		config: &config.Config{},
+		acl:    acl,
+		repos:  map[string]config.RepoConfig{"private/code": {Name: "private/code"}},
+		cache:  newQueryCache(10, 0),
+	}
+	bk := &Backend{
+		Id:         "a",
+		I:          &I{Name: "a", Trees: []Tree{{Name: "public"}, {Name: "private/code"}}},
+		Codesearch: &fakeCodeSearch{result: result},
+		cache:      s.cache,
+	}
+	// Hidden matches mustn't use up max_matches, nor be served to
+	// others from the cache.
+	ctx := context.WithValue(context.Background(), userKey{}, bob)
+	reply, err := s.doSearch(ctx, bk, &pb.Query{Line: "x", MaxMatches: 1})
+	if err != nil {
+		t.Fatalf("search failed: %v", err)
+	}
+	if len(reply.Results) != 1 || reply.Results[0].Tree != "public" {
+		t.Errorf("expected only the public result, got %v", reply.Results)
+	}
+	aliceCtx := context.WithValue(context.Background(), userKey{}, alice)
+	reply, err = s.doSearch(aliceCtx, bk, &pb.Query{Line: "x", MaxMatches: 1})
+	if err != nil {
+		t.Fatalf("search failed: %v", err)
+	}
+	if len(reply.Results) != 1 || reply.Results[0].Tree != "private/code" {
+		t.Errorf("expected the private result, got %v", reply.Results)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/diff/private/code/abcdef/?%3Arepo=private%2Fcode&%3Ahash=abcdef", nil)
+	s.ServeDiff(ctx, w, r)
+	if w.Code != 403 {
+		t.Errorf("expected a diff of a hidden repo to be forbidden, got status %d", w.Code)
+	}
+}
+
+func TestAuthHandlerAPIKey(t *testing.T) {
+	keys, err := newRateLimiter(&config.Config{
+		APIKeys: []config.APIKey{{Name: "bot", Key: "s3kr1t"}},
+	})
+	if err != nil {
+		t.Fatalf("newRateLimiter: %v", err)
+	}
+	var got *user
+	h := &authHandler{
+		auth: &proxyAuth{userHeader: "X-Forwarded-User"},
+		keys: keys,
+		inner: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = userFromContext(r.Context())
+		}),
+	}
+
+	cases := []struct {
+		path, key string
+		status    int
+		user      string
+	}{
+		{"/api/v1/search/", "s3kr1t", 200, "bot"},
+		{"/api/v1/search/", "wrong", 401, ""},
+		{"/search/", "s3kr1t", 401, ""},
+	}
+	for _, tc := range cases {
+		got = nil
+		r := httptest.NewRequest("GET", tc.path, nil)
+		r.Header.Set("Authorization", "Bearer "+tc.key)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s with key %q: expected %d, got %d", tc.path, tc.key, tc.status, w.Code)
+		}
+		if tc.user != "" && (got == nil || got.Name != tc.user) {
+			t.Errorf("%s with key %q: expected user %s, got %v", tc.path, tc.key, tc.user, got)
+		}
+	}
+}
+
+// Scrapers reach the metrics with the metrics key, without logging in.
+func TestMetricsKey(t *testing.T) {
+	dir := testDocRoot(t)
+	defer os.RemoveAll(dir)
+	srv, err := newServer(&config.Config{
+		DocRoot:    dir,
+		Auth:       config.Auth{Method: "proxy"},
+		MetricsKey: "scrape",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		path, key string
+		status    int
+	}{
+		{"/debug/metrics", "scrape", 200},
+		{"/debug/metrics", "wrong", 401},
+		{"/debug/stats", "scrape", 401},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest("GET", tc.path, nil)
+		r.Header.Set("Authorization", "Bearer "+tc.key)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s with key %q: expected %d, got %d", tc.path, tc.key, tc.status, w.Code)
+		}
+	}
+}
@@ -2,8 +2,10 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,6 +13,10 @@ import (
 	"google.golang.org/grpc"
 )
 
+// pollTimeout is how long poll waits for a replica to answer before
+// counting it as down.
+const pollTimeout = 10 * time.Second
+
 type Tree struct {
 	Name    string
 	Version string
@@ -25,22 +31,48 @@ type I struct {
 }
 
 type Backend struct {
-	Id         string
-	Addr       string
-	I          *I
+	Id   string
+	Addr string
+	I    *I
+	// Replicas are the codesearch processes serving this backend,
+	// all with the same index. Codesearch sends each call to a
+	// healthy one.
+	Replicas   []*Replica
 	Codesearch pb.CodeSearchClient
+
+	// cache, if set, holds search results that are dropped once
+	// the backend reports a new index.
+	cache *queryCache
+
+	// onReindex, if set, is called in its own goroutine whenever
+	// the backend reports a new index.
+	onReindex func(bk *Backend)
+
+	stop chan struct{}
 }
 
-func NewBackend(id string, addr string) (*Backend, error) {
-	client, err := grpc.Dial(addr, grpc.WithInsecure())
-	if err != nil {
-		return nil, err
+func NewBackend(id string, addrs ...string) (*Backend, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("backend %q has no addresses", id)
+	}
+	var replicas []*Replica
+	for _, addr := range addrs {
+		client, err := grpc.Dial(addr, grpc.WithInsecure())
+		if err != nil {
+			return nil, err
+		}
+		replicas = append(replicas, &Replica{
+			Addr:       addr,
+			Codesearch: pb.NewCodeSearchClient(client),
+			conn:       client,
+		})
 	}
 	bk := &Backend{
 		Id:         id,
-		Addr:       addr,
+		Addr:       strings.Join(addrs, ","),
 		I:          &I{Name: id},
-		Codesearch: pb.NewCodeSearchClient(client),
+		Replicas:   replicas,
+		Codesearch: &replicaSet{replicas: replicas},
 	}
 	return bk, nil
 }
@@ -49,19 +81,65 @@ func (bk *Backend) Start() {
 	if bk.I == nil {
 		bk.I = &I{Name: bk.Id}
 	}
+	bk.stop = make(chan struct{})
 	go bk.poll()
 }
 
+// Stop stops polling the backend and closes its connections.
+func (bk *Backend) Stop() {
+	if bk.stop != nil {
+		close(bk.stop)
+	}
+	for _, r := range bk.Replicas {
+		if r.conn != nil {
+			r.conn.Close()
+		}
+	}
+}
+
+// poll checks on every replica, refreshing the index info from the
+// first that answers. Replicas that are down are checked more often
+// so that they are used again soon after they come back.
 func (bk *Backend) poll() {
 	for {
-		info, e := bk.Codesearch.Info(context.Background(), &pb.InfoRequest{}, grpc.FailFast(false))
-		if e == nil {
-			bk.refresh(info)
-		} else {
-			log.Printf("refresh %s: %v", bk.Id, e)
+		refreshed := false
+		allHealthy := true
+		for _, r := range bk.Replicas {
+			start := time.Now()
+			ctx, cancel := context.WithTimeout(context.Background(), pollTimeout)
+			info, e := r.Codesearch.Info(ctx, &pb.InfoRequest{}, grpc.FailFast(true))
+			cancel()
+			r.record(context.Background(), start, e)
+			if e != nil {
+				log.Printf("refresh %s (%s): %v", bk.Id, r.Addr, e)
+				allHealthy = false
+				continue
+			}
+			if !refreshed {
+				bk.refresh(info)
+				refreshed = true
+			}
+		}
+		wait := 60 * time.Second
+		if !allHealthy {
+			wait = 10 * time.Second
+		}
+		select {
+		case <-bk.stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Healthy reports whether at least one replica of the backend is up.
+func (bk *Backend) Healthy() bool {
+	for _, r := range bk.Replicas {
+		if r.Health().Healthy() {
+			return true
 		}
-		time.Sleep(60 * time.Second)
 	}
+	return false
 }
 
 func (bk *Backend) refresh(info *pb.ServerInfo) {
@@ -71,7 +149,14 @@ func (bk *Backend) refresh(info *pb.ServerInfo) {
 	if info.Name != "" {
 		bk.I.Name = info.Name
 	}
-	bk.I.IndexTime = time.Unix(info.IndexTime, 0)
+	indexTime := time.Unix(info.IndexTime, 0)
+	if !indexTime.Equal(bk.I.IndexTime) {
+		bk.cache.invalidate(bk.Id)
+		if bk.onReindex != nil {
+			go bk.onReindex(bk)
+		}
+	}
+	bk.I.IndexTime = indexTime
 	if len(info.Trees) > 0 {
 		bk.I.Trees = nil
 		for _, r := range info.Trees {
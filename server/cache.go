@@ -0,0 +1,141 @@
+package server
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+	"time"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// queryCache is an LRU cache of search results from the backends. A
+// nil *queryCache caches nothing.
+type queryCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[cacheKey]*list.Element
+	hits    int64
+	misses  int64
+}
+
+// cacheKey identifies a search. Results are only reused for the same
+// index, so a backend that reloads its index misses until the new
+// results are cached.
+type cacheKey struct {
+	backend   string
+	indexTime int64
+	query     string
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	result  *pb.CodeSearchResult
+	expires time.Time
+}
+
+type cacheStats struct {
+	Entries int   `json:"entries"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+func newQueryCache(size int, ttl time.Duration) *queryCache {
+	if size <= 0 {
+		return nil
+	}
+	return &queryCache{
+		size:    size,
+		ttl:     ttl,
+		lru:     list.New(),
+		entries: make(map[cacheKey]*list.Element),
+	}
+}
+
+func makeCacheKey(bk *Backend, q *pb.Query) cacheKey {
+	buf, err := json.Marshal(q)
+	if err != nil {
+		panic(err.Error())
+	}
+	bk.I.Lock()
+	indexTime := bk.I.IndexTime.UnixNano()
+	bk.I.Unlock()
+	return cacheKey{bk.Id, indexTime, string(buf)}
+}
+
+// get returns the cached result for key, if any. The result is shared
+// and must not be modified.
+func (c *queryCache) get(key cacheKey) *pb.CodeSearchResult {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if ok && c.ttl > 0 && time.Now().After(el.Value.(*cacheEntry).expires) {
+		c.remove(el)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return nil
+	}
+	c.hits++
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry).result
+}
+
+func (c *queryCache) put(key cacheKey, result *pb.CodeSearchResult) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{
+		key:     key,
+		result:  result,
+		expires: time.Now().Add(c.ttl),
+	})
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *queryCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
+
+// invalidate drops every result cached for a backend, which is done
+// when it starts serving a new index.
+func (c *queryCache) invalidate(backend string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, el := range c.entries {
+		if key.backend == backend {
+			c.remove(el)
+		}
+	}
+}
+
+func (c *queryCache) stats() *cacheStats {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &cacheStats{
+		Entries: c.lru.Len(),
+		Hits:    c.hits,
+		Misses:  c.misses,
+	}
+}
@@ -7,6 +7,18 @@ import (
 type Backend struct {
 	Id   string `json:"id"`
 	Addr string `json:"addr"`
+	// Addrs lists the addresses of replicas of the backend, each
+	// serving the same index. Searches go to whichever replicas
+	// are healthy.
+	Addrs []string `json:"addrs"`
+}
+
+// Addresses returns every address the backend is served from.
+func (b *Backend) Addresses() []string {
+	if b.Addr == "" {
+		return b.Addrs
+	}
+	return append([]string{b.Addr}, b.Addrs...)
 }
 
 type Honeycomb struct {
@@ -14,6 +26,115 @@ type Honeycomb struct {
 	Dataset  string `json:"dataset"`
 }
 
+type EventSink struct {
+	// Where to send an event for each search, file view, blame
+	// and diff: "honeycomb", "file" (JSON lines, appended to Path)
+	// or "stdout". Defaults to honeycomb if it is configured, and
+	// to no events otherwise.
+	Type string `json:"type"`
+	Path string `json:"path"`
+}
+
+type Auth struct {
+	// How users are identified: "proxy" trusts headers set by a
+	// reverse proxy, "basic" checks HTTP basic credentials against
+	// an htpasswd file and "oidc" logs users in with an OpenID
+	// Connect provider. If empty, livegrep is open to anyone.
+	Method string `json:"method"`
+
+	// For "proxy", the headers naming the user and their
+	// comma-separated groups. Default to X-Forwarded-User and
+	// X-Forwarded-Groups.
+	UserHeader   string `json:"user_header"`
+	GroupsHeader string `json:"groups_header"`
+
+	// For "basic", the htpasswd file; entries must be hashed with
+	// MD5 ("htpasswd -m") or SHA-1 ("htpasswd -s").
+	Htpasswd string `json:"htpasswd"`
+
+	OIDC OIDC `json:"oidc"`
+
+	// Members of each group, in addition to any groups a proxy or
+	// OIDC provider reports.
+	Groups map[string][]string `json:"groups"`
+
+	// Repositories matching a rule are only visible to the users
+	// and groups it lists. Repositories matching no rule are
+	// visible to everyone. Users logged in with OIDC are named by
+	// their verified email, or else by their subject ("sub") claim.
+	ACL []ACLRule `json:"acl"`
+}
+
+type OIDC struct {
+	// The provider's issuer URL, used to discover its endpoints.
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	// Must point at /auth/oidc/callback on this server.
+	RedirectURL string `json:"redirect_url"`
+	// Key used to sign session cookies.
+	CookieSecret string `json:"cookie_secret"`
+}
+
+type ACLRule struct {
+	// Regular expressions, each matched against a whole
+	// repository (tree) name.
+	Repos  []string `json:"repos"`
+	Users  []string `json:"users"`
+	Groups []string `json:"groups"`
+}
+
+type APIKey struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+	// Overrides the rate_limit.per_key limits for this key.
+	RateLimit float64 `json:"rate_limit"`
+	Burst     int     `json:"burst"`
+}
+
+type RateLimit struct {
+	// Requests per second, and the burst above that, allowed to
+	// each API key and to each IP address making API requests
+	// without a key. 0 means unlimited.
+	PerKey      float64 `json:"per_key"`
+	PerKeyBurst int     `json:"per_key_burst"`
+	PerIP       float64 `json:"per_ip"`
+	PerIPBurst  int     `json:"per_ip_burst"`
+	// If set, API requests without a key are refused, except
+	// those of the web UI on livegrep's own search page.
+	RequireKey bool `json:"require_key"`
+}
+
+type QueryCache struct {
+	// Number of search results to keep; 0 disables the cache.
+	Size int `json:"size"`
+	// How long to reuse a result for, in seconds. Results are
+	// never reused across a change of index, so 0 (no expiry) is
+	// reasonable.
+	TTLSeconds int `json:"ttl_seconds"`
+}
+
+type SavedSearches struct {
+	// File that saved searches, and the matches each found when it
+	// last ran, are kept in. Saved searches are disabled if empty.
+	Path string `json:"path"`
+	// An mbox file to append new matches to, for saved searches
+	// that don't name a webhook.
+	Mailbox string `json:"mailbox"`
+	// How many matches to remember for each search. Defaults to
+	// 1000.
+	MaxMatches int32 `json:"max_matches"`
+	// Hosts that saved searches may send new matches to as
+	// webhooks. Webhooks are refused if empty.
+	WebhookHosts []string `json:"webhook_hosts"`
+}
+
+type Permalinks struct {
+	// Directory permalinks are stored in, one file each.
+	// Permalinks are disabled if empty.
+	Dir string `json:"dir"`
+}
+
 type Config struct {
 	// Location of the directory containing templates and static
 	// assets. This should point at the "web" directory of the
@@ -30,9 +151,14 @@ type Config struct {
 	ReverseProxy bool `json:"reverse_proxy"`
 
 	// List of backends to connect to. Each backend must include
-	// the "id" and "addr" fields.
+	// the "id" field and either "addr" or "addrs".
 	Backends []Backend `json:"backends"`
 
+	// If set, API searches that don't name a backend are sent to
+	// every backend and the results merged. A search can always
+	// ask for this explicitly by using "*" as the backend name.
+	FanOutSearch bool `json:"fan_out_search"`
+
 	// The address to listen on, as HOST:PORT.
 	Listen string `json:"listen"`
 
@@ -44,14 +170,61 @@ type Config struct {
 		URI string `json:"uri"`
 	} `json:"sentry"`
 
+	// Who may use livegrep, and which repositories they can see.
+	Auth Auth `json:"auth"`
+
 	// Whether to re-load templates on every request
 	Reload bool `json:"reload"`
 
+	// Secret that must be sent as a bearer token to POST
+	// /debug/reload-config, which re-reads this config. The
+	// endpoint is disabled if empty.
+	AdminKey string `json:"admin_key"`
+
+	// Secret that must be sent as a bearer token to GET
+	// /debug/metrics, which then needs no login. If empty, the
+	// metrics are served to whoever may use livegrep.
+	MetricsKey string `json:"metrics_key"`
+
 	// honeycomb API write key
 	Honeycomb Honeycomb `json:"honeycomb"`
 
+	EventSink EventSink `json:"event_sink"`
+
 	DefaultMaxMatches int32 `json:"default_max_matches"`
 
+	// The most results an export (/api/v1/export/) may return.
+	// Exports ignore default_max_matches. Defaults to 100000.
+	ExportMaxMatches int32 `json:"export_max_matches"`
+
+	// Keys identifying API clients, from the config or from a
+	// file of "name:key" lines, and the limits on API requests.
+	// With auth on, an API request with a key needs no login: it
+	// is made as a user with the key's name, whom acl rules can
+	// list.
+	APIKeys    []APIKey  `json:"api_keys"`
+	APIKeyFile string    `json:"api_key_file"`
+	RateLimit  RateLimit `json:"rate_limit"`
+
+	// Caches the results of repeated searches.
+	QueryCache QueryCache `json:"query_cache"`
+
+	// Searches that are re-run whenever a backend is reindexed,
+	// reporting any new matches.
+	SavedSearches SavedSearches `json:"saved_searches"`
+
+	// Links to a search's results as of the index they came from.
+	Permalinks Permalinks `json:"permalinks"`
+
+	// How often, in seconds, to add new commits to the blame
+	// histories of repositories whose "blame" metadata is "git".
+	// Histories whose "blame_mode" is "merges" can't be extended:
+	// each refresh that finds HEAD has moved runs git log over the
+	// whole history again and parses all of it, which for a large
+	// repository may take minutes, so give those a long interval.
+	// Histories are only refreshed by /debug/reload-indexes if 0.
+	BlameRefreshSeconds int `json:"blame_refresh_seconds"`
+
 	// Same json config structure that the backend uses when building indexes;
 	// used here for repository browsing.
 	IndexConfig IndexConfig `json:"index_config"`
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/livegrep/livegrep/server/api"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+var errCursorExpired = errors.New("The index has changed since this cursor was issued; please search again")
+
+// resultPosition is the sort key of a result in a paginated search.
+// File results have a Line of 0.
+type resultPosition struct {
+	Backend string `json:"backend,omitempty"`
+	Tree    string `json:"tree"`
+	Path    string `json:"path"`
+	Line    int    `json:"line"`
+}
+
+func (a resultPosition) less(b resultPosition) bool {
+	if a.Backend != b.Backend {
+		return a.Backend < b.Backend
+	}
+	if a.Tree != b.Tree {
+		return a.Tree < b.Tree
+	}
+	if a.Path != b.Path {
+		return a.Path < b.Path
+	}
+	return a.Line < b.Line
+}
+
+// searchCursor is the state behind the opaque cursor handed out with
+// each page of a paginated search. It carries the search itself, so a
+// request for the next page needs nothing else, along with the index
+// times of the backends so that a cursor can't be used to page through
+// a different index than the one it started with. Cursors are signed,
+// so that a client can't change the search one carries.
+type searchCursor struct {
+	Backend    string           `json:"backend"`
+	Query      pb.Query         `json:"query"`
+	Expr       *QueryExpr       `json:"expr,omitempty"`
+	IndexTimes map[string]int64 `json:"index_times"`
+	PageSize   int              `json:"page_size"`
+	// Last is the position of the final result returned on
+	// earlier pages.
+	Last *resultPosition `json:"last,omitempty"`
+
+	// key is what the cursor is signed with.
+	key []byte
+}
+
+func cursorMAC(key, buf []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf)
+	return mac.Sum(nil)
+}
+
+func encodeCursor(c *searchCursor) string {
+	buf, err := json.Marshal(c)
+	if err != nil {
+		panic(err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(buf) + "." +
+		base64.RawURLEncoding.EncodeToString(cursorMAC(c.key, buf))
+}
+
+func decodeCursor(s string, key []byte) (*searchCursor, error) {
+	invalid := errors.New("Invalid cursor")
+	i := strings.LastIndexByte(s, '.')
+	if i < 0 {
+		return nil, invalid
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(s[:i])
+	if err != nil {
+		return nil, invalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(s[i+1:])
+	if err != nil || !hmac.Equal(sig, cursorMAC(key, buf)) {
+		return nil, invalid
+	}
+	c := searchCursor{key: key}
+	if err := json.Unmarshal(buf, &c); err != nil || c.PageSize <= 0 || c.PageSize > maxPageSize {
+		return nil, invalid
+	}
+	return &c, nil
+}
+
+// searchedBackends returns the backends a search runs against.
+func (search *apiSearch) searchedBackends() []*Backend {
+	if search.backends != nil {
+		return search.backends
+	}
+	return []*Backend{search.backend}
+}
+
+func indexTimes(backends []*Backend) map[string]int64 {
+	times := make(map[string]int64, len(backends))
+	for _, bk := range backends {
+		bk.I.Lock()
+		times[bk.Id] = bk.I.IndexTime.Unix()
+		bk.I.Unlock()
+	}
+	return times
+}
+
+// check verifies that every backend still serves the index the
+// cursor was issued against.
+func (c *searchCursor) check(backends []*Backend) error {
+	now := indexTimes(backends)
+	if len(now) != len(c.IndexTimes) {
+		return errCursorExpired
+	}
+	for id, t := range now {
+		if c.IndexTimes[id] != t {
+			return errCursorExpired
+		}
+	}
+	return nil
+}
+
+// pageQuery returns the query to send to the backends for the page
+// after the cursor. The backends return results in no particular
+// order and can't skip any, so every page asks for the whole search,
+// up to its own max_matches, and picks its results out of that; the
+// query cache usually answers all but the first. Unless the search
+// hits its limit, which the reply's exit reason reports on every page,
+// the pages are complete and don't depend on the order. If it does,
+// each page comes from whichever results the run it was taken from
+// stopped at, so that pages may repeat or miss results.
+func (c *searchCursor) pageQuery() pb.Query {
+	return c.Query
+}
+
+// pageResult is a line or file result in a paginated search.
+type pageResult struct {
+	pos  resultPosition
+	line *api.Result
+	file *api.FileResult
+}
+
+// paginate trims reply down to the page following the cursor, sorting
+// the results so that the pages are stable, and sets the reply's
+// NextCursor if there is more to see. File results are paged along
+// with line results, coming before the lines of the same file.
+func (c *searchCursor) paginate(reply *api.ReplySearch) {
+	rs := make([]pageResult, 0, len(reply.Results)+len(reply.FileResults))
+	for _, r := range reply.Results {
+		rs = append(rs, pageResult{pos: resultPosition{r.Backend, r.Tree, r.Path, r.LineNumber}, line: r})
+	}
+	for _, r := range reply.FileResults {
+		rs = append(rs, pageResult{pos: resultPosition{r.Backend, r.Tree, r.Path, 0}, file: r})
+	}
+	sort.SliceStable(rs, func(i, j int) bool { return rs[i].pos.less(rs[j].pos) })
+
+	if c.Last != nil {
+		i := sort.Search(len(rs), func(i int) bool { return c.Last.less(rs[i].pos) })
+		rs = rs[i:]
+	}
+	more := false
+	if len(rs) > c.PageSize {
+		rs = rs[:c.PageSize]
+		more = true
+	}
+
+	reply.Results = make([]*api.Result, 0)
+	reply.FileResults = make([]*api.FileResult, 0)
+	for _, r := range rs {
+		if r.line != nil {
+			reply.Results = append(reply.Results, r.line)
+		} else {
+			reply.FileResults = append(reply.FileResults, r.file)
+		}
+	}
+
+	if more {
+		next := *c
+		next.Last = &rs[len(rs)-1].pos
+		reply.NextCursor = encodeCursor(&next)
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	libhoney "github.com/honeycombio/libhoney-go"
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/log"
+	"github.com/livegrep/livegrep/server/reqid"
+)
+
+// An EventSink receives an event for each search, file view, blame
+// and diff served, for analyzing how livegrep is used.
+type EventSink interface {
+	Send(fields map[string]interface{}) error
+	// Close releases the sink once nothing more will be sent to
+	// it, as when a reload replaces it.
+	Close() error
+}
+
+// honeycombSink sends events to a Honeycomb dataset.
+type honeycombSink struct {
+	builder *libhoney.Builder
+}
+
+func (h *honeycombSink) Send(fields map[string]interface{}) error {
+	e := h.builder.NewEvent()
+	for k, v := range fields {
+		e.AddField(k, v)
+	}
+	return e.Send()
+}
+
+// Close does nothing: libhoney's client belongs to the whole process.
+func (h *honeycombSink) Close() error {
+	return nil
+}
+
+// jsonLinesSink writes each event as a line of JSON.
+type jsonLinesSink struct {
+	mu sync.Mutex
+	w  io.Writer
+	c  io.Closer // if set, closed with the sink
+}
+
+func (j *jsonLinesSink) Send(fields map[string]interface{}) error {
+	line := make(map[string]interface{}, len(fields)+1)
+	for k, v := range fields {
+		line[k] = v
+	}
+	line["timestamp"] = time.Now().UTC().Format(time.RFC3339Nano)
+	buf, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err = j.w.Write(append(buf, '\n'))
+	return err
+}
+
+func (j *jsonLinesSink) Close() error {
+	if j.c == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.c.Close()
+}
+
+// newEventSink returns the sink selected by the configuration, or nil
+// if events are disabled.
+func newEventSink(cfg *config.Config) (EventSink, error) {
+	sink := cfg.EventSink.Type
+	if sink == "" && cfg.Honeycomb.WriteKey != "" {
+		sink = "honeycomb"
+	}
+	switch sink {
+	case "":
+		return nil, nil
+	case "honeycomb":
+		log.Printf(context.Background(),
+			"Enabling honeycomb dataset=%s", cfg.Honeycomb.Dataset)
+		builder := libhoney.NewBuilder()
+		builder.WriteKey = cfg.Honeycomb.WriteKey
+		builder.Dataset = cfg.Honeycomb.Dataset
+		return &honeycombSink{builder}, nil
+	case "file":
+		f, err := os.OpenFile(cfg.EventSink.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf(context.Background(), "Logging events to %s", cfg.EventSink.Path)
+		return &jsonLinesSink{w: f, c: f}, nil
+	case "stdout":
+		return &jsonLinesSink{w: os.Stdout}, nil
+	default:
+		return nil, fmt.Errorf("unknown event sink: %q", sink)
+	}
+}
+
+// sendEvent sends an event of the given type, tagged with the request
+// ID, to the configured sink.
+func (s *server) sendEvent(ctx context.Context, eventType string, fields map[string]interface{}) {
+	if s.events == nil {
+		return
+	}
+	fields["event_type"] = eventType
+	if id, ok := reqid.FromContext(ctx); ok {
+		fields["request_id"] = id
+	}
+	if err := s.events.Send(fields); err != nil {
+		log.Printf(ctx, "sending %s event err=%s", eventType, err)
+	}
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/log"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+const defaultExportMaxMatches = 100000
+
+// How many rows of an export to write between flushes, besides the
+// flush as each backend finishes.
+const exportFlushRows = 1000
+
+// exportRow is a match as written to a JSON-lines export.
+type exportRow struct {
+	Tree       string `json:"tree"`
+	Version    string `json:"version"`
+	Path       string `json:"path"`
+	LineNumber int    `json:"lno,omitempty"`
+	Line       string `json:"line,omitempty"`
+	Bounds     [2]int `json:"bounds"`
+}
+
+var exportHeader = []string{"tree", "version", "path", "lno", "line", "start", "end"}
+
+func (row *exportRow) csv() []string {
+	lno := ""
+	if row.LineNumber > 0 {
+		lno = strconv.Itoa(row.LineNumber)
+	}
+	return []string{
+		row.Tree, row.Version, row.Path, lno, row.Line,
+		strconv.Itoa(row.Bounds[0]), strconv.Itoa(row.Bounds[1]),
+	}
+}
+
+func (s *server) exportMaxMatches() int32 {
+	if s.config.ExportMaxMatches > 0 {
+		return s.config.ExportMaxMatches
+	}
+	return defaultExportMaxMatches
+}
+
+// ServeAPIExport runs a search like ServeAPISearch, but returns every
+// match, up to the export limit, as a CSV or JSON-lines download
+// chosen by the "format" parameter. Rows are written as the backends
+// find them, up to each backend's share of the limit, so what the
+// search ended with is only known at the end: the
+// X-Livegrep-Exit-Reason trailer is MATCH_LIMIT if there were more
+// matches than the limit, and the X-Livegrep-Error trailer is set if a
+// backend failed after the export began.
+func (s *server) ServeAPIExport(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "json" {
+		writeError(ctx, w, 400, "bad_format", "format must be csv or json")
+		return
+	}
+	if r.URL.Query().Get("cursor") != "" || r.URL.Query().Get("page_size") != "" {
+		writeError(ctx, w, 400, "bad_query", "Exports cannot be paginated")
+		return
+	}
+
+	limit := s.exportMaxMatches()
+	search := s.parseAPISearchLimit(ctx, w, r, limit)
+	if search == nil {
+		return
+	}
+	if search.query.MaxMatches > limit {
+		search.query.MaxMatches = limit
+	}
+
+	// Cancelled when we return, so that no search is left blocked
+	// if we give up writing the export early.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	parts, n := s.startSearch(ctx, search)
+
+	var write func(row *exportRow) error
+	flush := func() error { return nil }
+	// begin starts the reply, once there is something to export.
+	begin := func() {
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", `attachment; filename="livegrep.csv"`)
+		} else {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Content-Disposition", `attachment; filename="livegrep.jsonl"`)
+		}
+		w.Header().Set("Trailer", "X-Livegrep-Exit-Reason, X-Livegrep-Error")
+		w.WriteHeader(200)
+
+		if format == "csv" {
+			cw := csv.NewWriter(w)
+			cw.Write(exportHeader)
+			write = func(row *exportRow) error { return cw.Write(row.csv()) }
+			flush = func() error {
+				cw.Flush()
+				return cw.Error()
+			}
+		} else {
+			enc := json.NewEncoder(w)
+			write = func(row *exportRow) error { return enc.Encode(row) }
+		}
+	}
+
+	// Rows are sent on as they are written, rather than all at
+	// the end.
+	send := func() bool {
+		if err := flush(); err != nil {
+			log.Printf(ctx, "writing export err=%s", err)
+			return false
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		return true
+	}
+	rows := 0
+	emit := func(row *exportRow) bool {
+		if err := write(row); err != nil {
+			log.Printf(ctx, "writing export err=%s", err)
+			return false
+		}
+		rows++
+		return rows%exportFlushRows != 0 || send()
+	}
+
+	merged := &api.ReplySearch{Info: &api.Stats{ExitReason: pb.SearchStats_NONE.String()}}
+
+	// Don't rely on the backends to have stopped at the limit, and
+	// divide it between them as ServeAPISearchStream does.
+	lines := newFairLimit(int(search.query.MaxMatches), n)
+	files := newFairLimit(int(search.query.MaxMatches), n)
+	emitResult := func(res interface{}) bool {
+		switch res := res.(type) {
+		case *api.Result:
+			merged.Results = append(merged.Results, res)
+			return emit(&exportRow{
+				Tree:       res.Tree,
+				Version:    res.Version,
+				Path:       res.Path,
+				LineNumber: res.LineNumber,
+				Line:       res.Line,
+				Bounds:     res.Bounds,
+			})
+		case *api.FileResult:
+			merged.FileResults = append(merged.FileResults, res)
+			return emit(&exportRow{
+				Tree:    res.Tree,
+				Version: res.Version,
+				Path:    res.Path,
+				Bounds:  res.Bounds,
+			})
+		}
+		return true
+	}
+	var firstErr error
+	answered := 0
+	for done := 0; done < n; {
+		part := <-parts
+		if part.done {
+			done++
+		}
+		if part.err != nil {
+			log.Printf(ctx, "error in search err=%s", part.err)
+			if firstErr == nil {
+				firstErr = part.err
+			}
+			if part.backend != nil {
+				merged.Errors = append(merged.Errors, backendError(part.backend, part.err))
+			}
+			continue
+		}
+		if write == nil {
+			begin()
+		}
+
+		reply := part.reply
+		id := ""
+		if part.backend != nil {
+			id = part.backend.Id
+		}
+		for _, res := range reply.Results {
+			if lines.admit(id, res) && !emitResult(res) {
+				return
+			}
+		}
+		for _, res := range reply.FileResults {
+			if files.admit(id, res) && !emitResult(res) {
+				return
+			}
+		}
+		if part.done {
+			answered++
+			mergeStats(merged.Info, reply.Info)
+			merged.Errors = append(merged.Errors, reply.Errors...)
+			if done < n && !send() {
+				return
+			}
+		}
+	}
+
+	if write == nil && firstErr != nil {
+		writeQueryError(ctx, w, firstErr)
+		return
+	}
+	if write == nil {
+		begin()
+	}
+	for _, limit := range []*fairLimit{lines, files} {
+		rest, dropped := limit.rest()
+		for _, res := range rest {
+			if !emitResult(res) {
+				return
+			}
+		}
+		if dropped {
+			merged.Info.ExitReason = pb.SearchStats_MATCH_LIMIT.String()
+		}
+	}
+	if err := flush(); err != nil {
+		log.Printf(ctx, "writing export err=%s", err)
+	}
+	w.Header().Set("X-Livegrep-Exit-Reason", merged.Info.ExitReason)
+	if firstErr != nil {
+		_, e := queryError(firstErr)
+		w.Header().Set("X-Livegrep-Error", e.Message)
+	}
+	if answered > 0 {
+		s.recordSearch(ctx, search, merged)
+	}
+}
@@ -0,0 +1,348 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+type searchFunc func(ctx context.Context, q *pb.Query) (*api.ReplySearch, error)
+
+// The most files a term that hit the match limit is searched again in.
+const exprNarrowMaxFiles = 200
+
+// matchSet is the set of line matches an expression evaluates to,
+// grouped by file.
+type matchSet struct {
+	files   []string // in order of first match
+	matches map[string][]*api.Result
+	seen    map[matchKey]bool
+}
+
+type matchKey struct {
+	file string
+	line int
+}
+
+func newMatchSet() *matchSet {
+	return &matchSet{
+		matches: make(map[string][]*api.Result),
+		seen:    make(map[matchKey]bool),
+	}
+}
+
+func resultFile(r *api.Result) string {
+	return r.Backend + "\x00" + r.Tree + "\x00" + r.Version + "\x00" + r.Path
+}
+
+func (m *matchSet) add(r *api.Result) {
+	file := resultFile(r)
+	key := matchKey{file, r.LineNumber}
+	if m.seen[key] {
+		return
+	}
+	m.seen[key] = true
+	if _, ok := m.matches[file]; !ok {
+		m.files = append(m.files, file)
+	}
+	m.matches[file] = append(m.matches[file], r)
+}
+
+func (m *matchSet) results() []*api.Result {
+	out := make([]*api.Result, 0)
+	for _, f := range m.files {
+		lines := m.matches[f]
+		sort.SliceStable(lines, func(i, j int) bool {
+			return lines[i].LineNumber < lines[j].LineNumber
+		})
+		out = append(out, lines...)
+	}
+	return out
+}
+
+func (e *QueryExpr) regexp() (*regexp.Regexp, error) {
+	if e.FoldCase {
+		return regexp.Compile("(?i)" + e.Line)
+	}
+	return regexp.Compile(e.Line)
+}
+
+// doExprSearch evaluates a boolean query by running one search per
+// positive line term, each with the filters in base, and combining
+// the results by file and line.
+func (s *server) doExprSearch(ctx context.Context, search searchFunc, base *pb.Query, expr *QueryExpr) (*api.ReplySearch, error) {
+	start := time.Now()
+
+	terms := positiveTerms(expr)
+	byTerm := make(map[*QueryExpr]*api.ReplySearch, len(terms))
+	queries := make([]*pb.Query, len(terms))
+	for i, term := range terms {
+		queries[i] = termQuery(base, term)
+	}
+	if err := runTerms(ctx, search, terms, queries, byTerm); err != nil {
+		return nil, err
+	}
+	if err := narrowTerms(ctx, search, base, expr, byTerm); err != nil {
+		return nil, err
+	}
+
+	reply := &api.ReplySearch{
+		FileResults: make([]*api.FileResult, 0),
+		SearchType:  "normal",
+		Info:        &api.Stats{ExitReason: pb.SearchStats_NONE.String()},
+	}
+	for _, term := range terms {
+		mergeStats(reply.Info, byTerm[term].Info)
+		reply.Errors = append(reply.Errors, byTerm[term].Errors...)
+	}
+
+	matches, err := evalExpr(expr, byTerm)
+	if err != nil {
+		return nil, err
+	}
+	reply.Results = matches.results()
+	limitResults(reply, int(base.MaxMatches))
+	reply.Info.TotalTime = int64(time.Since(start) / time.Millisecond)
+	return reply, nil
+}
+
+func positiveTerms(e *QueryExpr) []*QueryExpr {
+	var terms []*QueryExpr
+	e.walk(func(e *QueryExpr) {
+		if e.Op == OpLine && !e.Negated {
+			terms = append(terms, e)
+		}
+	})
+	return terms
+}
+
+// termQuery is the search for term: base, with the term's own
+// filters.
+func termQuery(base *pb.Query, term *QueryExpr) *pb.Query {
+	q := *base
+	q.Line = term.Line
+	q.FoldCase = term.FoldCase
+	q.FilenameOnly = false
+	term.Filters.apply(&q)
+	return &q
+}
+
+// runTerms runs the search in queries for each of terms, and records
+// the replies in byTerm.
+func runTerms(ctx context.Context, search searchFunc, terms []*QueryExpr, queries []*pb.Query, byTerm map[*QueryExpr]*api.ReplySearch) error {
+	replies := make([]*api.ReplySearch, len(terms))
+	errs := make([]error, len(terms))
+	var wg sync.WaitGroup
+	for i := range terms {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			replies[i], errs[i] = search(ctx, queries[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for i, term := range terms {
+		if errs[i] != nil {
+			return errs[i]
+		}
+		byTerm[term] = replies[i]
+	}
+	return nil
+}
+
+// narrowTerms searches again for the terms under e that hit the match
+// limit, where they are ANDed with terms that didn't. Only the files
+// that those complete terms matched can be in the result, so searching
+// just them finds the matches that the first search cut off.
+func narrowTerms(ctx context.Context, search searchFunc, base *pb.Query, e *QueryExpr, byTerm map[*QueryExpr]*api.ReplySearch) error {
+	if e.Op == OpAnd {
+		var files map[string]bool
+		var partial []*QueryExpr
+		for _, c := range e.Children {
+			if c.Negated {
+				continue
+			}
+			if terms := truncatedTerms(c, byTerm); len(terms) > 0 {
+				partial = append(partial, terms...)
+				continue
+			}
+			m, err := evalExpr(c, byTerm)
+			if err != nil {
+				return err
+			}
+			paths := make(map[string]bool)
+			for _, f := range m.files {
+				paths[m.matches[f][0].Path] = true
+			}
+			if files == nil {
+				files = paths
+				continue
+			}
+			for p := range files {
+				if !paths[p] {
+					delete(files, p)
+				}
+			}
+		}
+
+		if files != nil && len(files) <= exprNarrowMaxFiles {
+			var rerun []*QueryExpr
+			var queries []*pb.Query
+			for _, term := range partial {
+				q := termQuery(base, term)
+				inFiles, ok := filterFiles(files, q.File)
+				if !ok {
+					continue
+				}
+				if len(inFiles) == 0 {
+					// Nothing can match, however many
+					// matches were cut off.
+					byTerm[term] = &api.ReplySearch{
+						Info: &api.Stats{ExitReason: pb.SearchStats_NONE.String()},
+					}
+					continue
+				}
+				q.File = filesPattern(inFiles)
+				rerun = append(rerun, term)
+				queries = append(queries, q)
+			}
+			if err := runTerms(ctx, search, rerun, queries, byTerm); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, c := range e.Children {
+		if c.Negated {
+			continue
+		}
+		if err := narrowTerms(ctx, search, base, c, byTerm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func truncatedTerms(e *QueryExpr, byTerm map[*QueryExpr]*api.ReplySearch) []*QueryExpr {
+	var out []*QueryExpr
+	for _, term := range positiveTerms(e) {
+		if byTerm[term].Info.ExitReason == pb.SearchStats_MATCH_LIMIT.String() {
+			out = append(out, term)
+		}
+	}
+	return out
+}
+
+// filterFiles returns the paths in files that match the file regex
+// of a term's query, so that it can be replaced by a list of them. It
+// returns false if the regex can't be checked here.
+func filterFiles(files map[string]bool, pattern string) ([]string, bool) {
+	var out []string
+	if pattern == "" {
+		for p := range files {
+			out = append(out, p)
+		}
+		return out, true
+	}
+	// As in codesearch, a file regex ignores case unless it has
+	// upper case letters.
+	if strings.IndexAny(pattern, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") == -1 {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, false
+	}
+	for p := range files {
+		if re.MatchString(p) {
+			out = append(out, p)
+		}
+	}
+	return out, true
+}
+
+// filesPattern is a file regex matching exactly the given paths.
+func filesPattern(files []string) string {
+	paths := make([]string, 0, len(files))
+	for _, p := range files {
+		paths = append(paths, regexp.QuoteMeta(p))
+	}
+	sort.Strings(paths)
+	return "^(?:" + strings.Join(paths, "|") + ")$"
+}
+
+func evalExpr(e *QueryExpr, byTerm map[*QueryExpr]*api.ReplySearch) (*matchSet, error) {
+	out := newMatchSet()
+	switch e.Op {
+	case OpLine:
+		for _, r := range byTerm[e].Results {
+			out.add(r)
+		}
+	case OpOr:
+		for _, c := range e.Children {
+			m, err := evalExpr(c, byTerm)
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range m.files {
+				for _, r := range m.matches[f] {
+					out.add(r)
+				}
+			}
+		}
+	case OpAnd:
+		var positive []*matchSet
+		var negated []*regexp.Regexp
+		for _, c := range e.Children {
+			if c.Negated {
+				re, err := c.regexp()
+				if err != nil {
+					return nil, err
+				}
+				negated = append(negated, re)
+				continue
+			}
+			m, err := evalExpr(c, byTerm)
+			if err != nil {
+				return nil, err
+			}
+			positive = append(positive, m)
+		}
+		for _, f := range positive[0].files {
+			inAll := true
+			for _, m := range positive[1:] {
+				if _, ok := m.matches[f]; !ok {
+					inAll = false
+					break
+				}
+			}
+			if !inAll {
+				continue
+			}
+			for _, m := range positive {
+			lines:
+				for _, r := range m.matches[f] {
+					for _, re := range negated {
+						if re.MatchString(r.Line) {
+							continue lines
+						}
+					}
+					out.add(r)
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown query operator: %d", e.Op)
+	}
+	return out, nil
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/livegrep/livegrep/server/api"
+)
+
+// facetFuncs maps each facet that can be requested with the facets
+// parameter to the value it takes for a result.
+var facetFuncs = map[string]func(tree, file string) string{
+	"repo": func(tree, file string) string { return tree },
+	"dir": func(tree, file string) string {
+		if i := strings.Index(file, "/"); i >= 0 {
+			return file[:i+1]
+		}
+		return "/"
+	},
+	"ext": func(tree, file string) string { return path.Ext(file) },
+}
+
+// resultSummary describes how to group and facet the results of a
+// search, as requested with the group_by and facets parameters.
+type resultSummary struct {
+	groupBy string
+	facets  []string
+}
+
+func parseResultSummary(r *http.Request) (*resultSummary, error) {
+	params := r.URL.Query()
+	sum := &resultSummary{groupBy: params.Get("group_by")}
+	switch sum.groupBy {
+	case "", "tree", "path":
+	default:
+		return nil, fmt.Errorf("Unknown group_by: %s (expected tree or path)", sum.groupBy)
+	}
+	if f := params.Get("facets"); f != "" {
+		for _, name := range strings.Split(f, ",") {
+			if _, ok := facetFuncs[name]; !ok {
+				return nil, fmt.Errorf("Unknown facet: %s (expected repo, dir or ext)", name)
+			}
+			sum.facets = append(sum.facets, name)
+		}
+	}
+	if sum.groupBy == "" && sum.facets == nil {
+		return nil, nil
+	}
+	return sum, nil
+}
+
+// apply fills in the Groups and Facets of a reply from its results,
+// which should be all of them, before any pagination.
+func (sum *resultSummary) apply(reply *api.ReplySearch) {
+	type groupKey struct {
+		backend, tree, version, path string
+	}
+	groups := make(map[groupKey]*api.ResultGroup)
+	files := make(map[groupKey]bool)
+	facets := make(map[string]map[string]int, len(sum.facets))
+	for _, name := range sum.facets {
+		facets[name] = make(map[string]int)
+	}
+
+	add := func(backend, tree, version, file string) {
+		if sum.groupBy != "" {
+			key := groupKey{backend, tree, version, ""}
+			if sum.groupBy == "path" {
+				key.path = file
+			}
+			g, ok := groups[key]
+			if !ok {
+				g = &api.ResultGroup{Backend: backend, Tree: tree, Version: version, Path: key.path}
+				groups[key] = g
+				reply.Groups = append(reply.Groups, g)
+			}
+			if f := (groupKey{backend, tree, version, file}); !files[f] {
+				files[f] = true
+				g.Files++
+			}
+			g.Count++
+		}
+		for name, counts := range facets {
+			counts[facetFuncs[name](tree, file)]++
+		}
+	}
+	for _, r := range reply.Results {
+		add(r.Backend, r.Tree, r.Version, r.Path)
+	}
+	for _, r := range reply.FileResults {
+		add(r.Backend, r.Tree, r.Version, r.Path)
+	}
+
+	if len(facets) == 0 {
+		return
+	}
+	reply.Facets = make(map[string][]*api.FacetCount, len(facets))
+	for name, counts := range facets {
+		out := make([]*api.FacetCount, 0, len(counts))
+		for value, n := range counts {
+			out = append(out, &api.FacetCount{Value: value, Count: n})
+		}
+		sort.Slice(out, func(i, j int) bool {
+			if out[i].Count != out[j].Count {
+				return out[i].Count > out[j].Count
+			}
+			return out[i].Value < out[j].Value
+		})
+		reply.Facets[name] = out
+	}
+}
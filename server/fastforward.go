@@ -215,8 +215,8 @@ func analyzeEditAndMapLine(source_lines, target_lines []string, source_lineno in
 }
 
 func FastForward(repo config.RepoConfig, file, source_commit, target_commit string, source_lineno int) (string, int, error) {
-	gitHistory, ok := histories[repo.Name]
-	if !ok {
+	gitHistory := getHistory(repo.Name)
+	if gitHistory == nil {
 		return "", 0, errors.New("Repo not configured for blame")
 	}
 	if source_lineno < 1 {
@@ -4,7 +4,6 @@ import (
 	"errors"
 	"fmt"
 	"html/template"
-	"io"
 	"log"
 	"net/http"
 	"os"
@@ -73,12 +72,6 @@ type LogData struct {
 	PrevOffset int
 }
 
-type Rename struct {
-	oldPath string
-	newPath string
-	isCopy  bool
-}
-
 const (
 	diffTimeoutSeconds = 5.0 // most costly file takes about 1.2 seconds
 )
@@ -100,7 +93,14 @@ func setHistory(key string, value *blameworthy.GitHistory) {
 	historiesLock.Unlock()
 }
 
+// blameLock keeps blame histories from being loaded by more than one
+// goroutine at a time.
+var blameLock sync.Mutex
+
 func initBlame(cfg *config.Config) error {
+	blameLock.Lock()
+	defer blameLock.Unlock()
+
 	log.Printf("Loading blame...")
 	start := time.Now()
 
@@ -109,28 +109,32 @@ func initBlame(cfg *config.Config) error {
 		if !ok {
 			continue
 		}
-		var gitLogOutput io.ReadCloser
+		var gitHistory *blameworthy.GitHistory
+		var err error
 		if path == "git" {
-			var err error
-			log.Print("Running git log on: ", r.Path)
-			gitLogOutput, err = blameworthy.RunGitLog(r.Path, "HEAD")
+			gitHistory, err = loadGitBlame(r)
 			if err != nil {
 				log.Print("Skipping blame: ", err)
 				continue
 			}
 		} else {
-			var err error
-			log.Print("Reading git log file: ", path)
-			gitLogOutput, err = os.Open(path)
+			// A git log, or a cache written by
+			// livegrep-update-blame-cache.
+			log.Print("Reading blame file: ", path)
+			blameFile, err := os.Open(path)
 			if err != nil {
 				log.Print("Skipping blame file: ", err)
 				continue
 			}
-		}
-		gitHistory, err := blameworthy.ParseGitLog(gitLogOutput)
-		if err != nil {
-			log.Print("Skipping blame: ", err)
-			continue
+			gitHistory, err = blameworthy.ReadHistory(blameFile, followsMerges(r))
+			blameFile.Close()
+			if err != nil {
+				log.Print("Skipping blame: ", err)
+				continue
+			}
+			if gitHistory.WithMerges != followsMerges(r) {
+				log.Print("Blame file ", path, " doesn't match the blame mode of ", r.Name)
+			}
 		}
 		setHistory(r.Name, gitHistory)
 	}
@@ -140,6 +144,148 @@ func initBlame(cfg *config.Config) error {
 	return nil
 }
 
+// followsMerges reports whether a repository's blame should follow
+// merges back to the commits on other branches that wrote their lines,
+// as its "blame_mode" metadata of "merges" asks.
+func followsMerges(r config.RepoConfig) bool {
+	return r.Metadata["blame_mode"] == "merges"
+}
+
+// loadGitBlame runs git log on a repository. If its history has been
+// loaded before, or a cache of it is named by its "blame_cache"
+// metadata, only the commits since are read; but a history that
+// follows merges is read again in full unless HEAD hasn't moved, as is
+// one loaded in the other blame_mode.
+func loadGitBlame(r config.RepoConfig) (*blameworthy.GitHistory, error) {
+	withMerges := followsMerges(r)
+	old := getHistory(r.Name)
+	if old != nil && old.WithMerges != withMerges {
+		log.Print("Blame mode of ", r.Name, " has changed")
+		old = nil
+	}
+	if cachePath := r.Metadata["blame_cache"]; old == nil && cachePath != "" {
+		log.Print("Reading blame cache: ", cachePath)
+		cache, err := readBlameCache(cachePath)
+		if err != nil {
+			log.Print("Skipping blame cache: ", err)
+		} else if cache.WithMerges != withMerges {
+			log.Print("Skipping blame cache: it doesn't match the blame mode of ", r.Name)
+		} else {
+			old = cache
+		}
+	}
+	if old != nil && len(old.Hashes) > 0 {
+		last := old.Hashes[len(old.Hashes)-1]
+		ok, err := blameworthy.IsFirstParentAncestor(r.Path, last, "HEAD")
+		if err != nil {
+			return nil, err
+		}
+		if ok && withMerges {
+			same, err := blameworthy.IsAncestor(r.Path, "HEAD", last)
+			if err != nil {
+				return nil, err
+			}
+			if same {
+				return old, nil
+			}
+		} else if ok {
+			log.Print("Running git log on: ", r.Path, " since ", last)
+			gitLogOutput, err := blameworthy.RunGitLog(r.Path, last+"..HEAD")
+			if err != nil {
+				return nil, err
+			}
+			gitHistory, err := old.Extend(gitLogOutput)
+			if e := gitLogOutput.Close(); err == nil {
+				err = e
+			}
+			return gitHistory, err
+		} else {
+			// HEAD was rewritten, or merged last in from
+			// another branch, so start again.
+			log.Print(last, " is no longer a first-parent ancestor of HEAD in ", r.Path)
+		}
+	}
+	log.Print("Running git log on: ", r.Path)
+	runGitLog, parseGitLog := blameworthy.RunGitLog, blameworthy.ParseGitLog
+	if withMerges {
+		runGitLog, parseGitLog = blameworthy.RunGitLogWithMerges, blameworthy.ParseGitLogWithMerges
+	}
+	gitLogOutput, err := runGitLog(r.Path, "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	gitHistory, err := parseGitLog(gitLogOutput)
+	if e := gitLogOutput.Close(); err == nil {
+		err = e
+	}
+	return gitHistory, err
+}
+
+func readBlameCache(path string) (*blameworthy.GitHistory, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return blameworthy.ReadCache(f)
+}
+
+// blameRefresh stops the goroutine started by startBlameRefresh.
+var blameRefresh struct {
+	sync.Mutex
+	stop chan struct{}
+}
+
+// startBlameRefresh keeps the blame histories that are read from git
+// up to date, replacing any refreshing started for an earlier config.
+func startBlameRefresh(cfg *config.Config) {
+	blameRefresh.Lock()
+	defer blameRefresh.Unlock()
+	if blameRefresh.stop != nil {
+		close(blameRefresh.stop)
+		blameRefresh.stop = nil
+	}
+	if cfg.BlameRefreshSeconds <= 0 {
+		return
+	}
+	var repos []config.RepoConfig
+	for _, r := range cfg.IndexConfig.Repositories {
+		if r.Metadata["blame"] == "git" {
+			repos = append(repos, r)
+		}
+	}
+	if len(repos) == 0 {
+		return
+	}
+	stop := make(chan struct{})
+	blameRefresh.stop = stop
+	interval := time.Duration(cfg.BlameRefreshSeconds) * time.Second
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+			refreshBlame(repos)
+		}
+	}()
+}
+
+// refreshBlame brings the blame histories of repos up to date.
+func refreshBlame(repos []config.RepoConfig) {
+	blameLock.Lock()
+	defer blameLock.Unlock()
+	for _, r := range repos {
+		gitHistory, err := loadGitBlame(r)
+		if err != nil {
+			log.Print("Refreshing blame for ", r.Name, ": ", err)
+			continue
+		}
+		setHistory(r.Name, gitHistory)
+	}
+}
+
 func resolveCommit(repo config.RepoConfig, commitName, path string, data *BlameData) error {
 	// TODO: this is an awkward fix for a synchronization problem.
 	// The necessary order of operations of a server will be to "git
@@ -187,7 +333,12 @@ func buildBlameData(
 ) error {
 	start := time.Now()
 
-	obj := commitHash + ":" + path
+	// The file may have had another name at this commit.
+	oldPath, err := gitHistory.PathAt(commitHash, path)
+	if err != nil {
+		oldPath = path
+	}
+	obj := commitHash + ":" + oldPath
 	content, err := gitCatBlob(obj, repo.Path)
 	if err != nil {
 		content, _ := gitObjectType(obj, repo.Path)
@@ -244,14 +395,16 @@ func fileRedirect(gitHistory *blameworthy.GitHistory, repoName, hash, path, dest
 	destHash := dest[:j]
 	fragment := dest[j+1:]
 
-	var k int
-	var diff *blameworthy.Diff
-	for k, diff = range gitHistory.Commits[destHash].Diffs {
-		if diff.Path == path {
-			break
-		}
+	if oldPath, err := gitHistory.PathAt(destHash, path); err == nil {
+		path = oldPath
+	}
+	k := indexOfFileInCommit(gitHistory, path, destHash)
+	if k == -1 {
+		// A commit from another branch, which has no diffs of
+		// its own in a history that follows merges.
+		url := fmt.Sprint("/diff/", repoName, "/", destHash, "/")
+		return url, nil
 	}
-
 	url := fmt.Sprint("/diff/", repoName, "/", destHash, "/#", k, fragment)
 	return url, nil
 }
@@ -297,6 +450,9 @@ func diffRedirect(w http.ResponseWriter, r *http.Request, repoName string, hash
 			"/", path, "/#", fragment)
 	} else {
 		//path := gitHistory.Commits[hash][commitIndex]
+		if oldPath, err := gitHistory.PathAt(destHash, path); err == nil {
+			path = oldPath
+		}
 		destIndex := indexOfFileInCommit(gitHistory, path, destHash)
 		fragment = rest[j:]
 		// TODO: need to turn path into index into that other diff
@@ -309,7 +465,11 @@ func diffRedirect(w http.ResponseWriter, r *http.Request, repoName string, hash
 }
 
 func indexOfFileInCommit(history *blameworthy.GitHistory, path string, hash string) int {
-	for k, diff := range history.Commits[hash].Diffs {
+	commit := history.Commits[hash]
+	if commit == nil {
+		return -1
+	}
+	for k, diff := range commit.Diffs {
 		if diff.Path == path {
 			return k
 		}
@@ -341,6 +501,18 @@ func buildDiffData(
 
 	start := time.Now()
 	for _, diff := range commit.Diffs {
+		if diff.OldPath != "" && diff.ChecksumBefore == diff.ChecksumAfter {
+			verb := "Renamed from:"
+			if diff.IsCopy {
+				verb = "Copied from:"
+			}
+			data.FileDiffs = append(data.FileDiffs, DiffFileData{
+				diff.Path,
+				[]BlameLine{blankLine},
+				fmt.Sprintf("%16s %s\n", verb, diff.OldPath),
+			})
+			continue
+		}
 		if diff.ChecksumBefore == "" {
 			source, _ := befores[diff.ChecksumAfter]
 			if source != nil {
@@ -389,14 +561,19 @@ git show %s`, commitHash, commitHash)
 	log.Print(elapsed, " to prepare blame for ", commitHash)
 
 	// TODO: add map so this lookup is O(1)?
-	var i int
-	for i = range gitHistory.Hashes {
-		if gitHistory.Hashes[i] == commitHash {
+	i := -1
+	for j := range gitHistory.Hashes {
+		if gitHistory.Hashes[j] == commitHash {
+			i = j
 			break
 		}
 	}
 	data.PreviousCommit = ""
 	data.NextCommit = ""
+	if i == -1 {
+		// A commit from another branch has no neighbors.
+		return nil
+	}
 	if i-1 >= 0 {
 		data.PreviousCommit = gitHistory.Hashes[i-1]
 	}
@@ -437,7 +614,11 @@ func extendDiff(
 	}
 
 	if len(blameVector) > 0 {
-		obj := result.PreviousCommitHash + ":" + path
+		oldPath, err := gitHistory.PathAt(result.PreviousCommitHash, path)
+		if err != nil {
+			oldPath = path
+		}
+		obj := result.PreviousCommitHash + ":" + oldPath
 		content, err := gitCatBlob(obj, repo.Path)
 		if err != nil {
 			err = fmt.Errorf("Error getting blob: %s", err)
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/livegrep/livegrep/blameworthy"
+	"github.com/livegrep/livegrep/server/config"
+)
+
+// testRepo is a git repository made for a test.
+type testRepo struct {
+	t   *testing.T
+	dir string
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "livegrep-blame")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &testRepo{t, dir}
+	repo.git("init", "-q")
+	return repo
+}
+
+func (repo *testRepo) remove() {
+	os.RemoveAll(repo.dir)
+}
+
+func (repo *testRepo) git(args ...string) string {
+	cmd := exec.Command("git", append([]string{"-C", repo.dir,
+		"-c", "user.name=a", "-c", "user.email=a@example.com"}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_DATE=2018-01-02T12:00:00",
+		"GIT_COMMITTER_DATE=2018-01-02T12:00:00")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		repo.t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+	return string(out)
+}
+
+// commit writes a file and commits it.
+func (repo *testRepo) commit(path, content, message string) {
+	if err := ioutil.WriteFile(filepath.Join(repo.dir, path), []byte(content), 0644); err != nil {
+		repo.t.Fatal(err)
+	}
+	repo.git("add", path)
+	repo.git("commit", "-q", "-m", message)
+}
+
+func (repo *testRepo) history() *blameworthy.GitHistory {
+	out, err := blameworthy.RunGitLog(repo.dir, "HEAD")
+	if err != nil {
+		repo.t.Fatal(err)
+	}
+	history, err := blameworthy.ParseGitLog(out)
+	out.Close()
+	if err != nil {
+		repo.t.Fatal(err)
+	}
+	return history
+}
+
+// Run with -race: refreshing blame mustn't race with requests that
+// read the histories.
+func TestBlameRefreshRace(t *testing.T) {
+	repo := newTestRepo(t)
+	defer repo.remove()
+	repo.commit("f.txt", "one\ntwo\n", "first")
+	repo.commit("f.txt", "one\n2\nthree\n", "second")
+	history := repo.history()
+	setHistory("blame-race", history)
+	defer setHistory("blame-race", nil)
+
+	rc := config.RepoConfig{
+		Name:     "blame-race",
+		Path:     repo.dir,
+		Metadata: map[string]string{"blame": "git"},
+	}
+	s := &server{repos: map[string]config.RepoConfig{rc.Name: rc}}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			refreshBlame([]config.RepoConfig{rc})
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		code, _ := blameAPI(t, s, rc.Name, "HEAD", "f.txt")
+		if code != 200 {
+			t.Errorf("blame failed: %d", code)
+		}
+		if _, _, err := FastForward(rc, "f.txt", history.Hashes[0], history.Hashes[1], 1); err != nil {
+			t.Error(err)
+		}
+	}
+	wg.Wait()
+}
+
+// A history that ends at a commit that HEAD merged in from another
+// branch, rather than one on HEAD's first parents, must be read again
+// from the start.
+func TestLoadGitBlameAfterMerge(t *testing.T) {
+	repo := newTestRepo(t)
+	defer repo.remove()
+	repo.commit("f.txt", "one\ntwo\n", "first")
+	main := strings.TrimSpace(repo.git("rev-parse", "--abbrev-ref", "HEAD"))
+	repo.git("checkout", "-q", "-b", "side")
+	repo.commit("f.txt", "one\n2\n", "side")
+	setHistory("blame-merge", repo.history())
+	defer setHistory("blame-merge", nil)
+
+	repo.git("checkout", "-q", main)
+	repo.commit("g.txt", "three\n", "main")
+	repo.git("merge", "-q", "--no-ff", "-m", "merge", "side")
+
+	rc := config.RepoConfig{
+		Name:     "blame-merge",
+		Path:     repo.dir,
+		Metadata: map[string]string{"blame": "git"},
+	}
+	history, err := loadGitBlame(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := repo.history()
+	if got := fmt.Sprint(history.Hashes); got != fmt.Sprint(want.Hashes) {
+		t.Errorf("Wanted commits %s, got %s", fmt.Sprint(want.Hashes), got)
+	}
+}
+
+// A history loaded in one blame mode is read again in full once the
+// repository's blame_mode changes, even if HEAD hasn't moved.
+func TestLoadGitBlameModeChange(t *testing.T) {
+	repo := newTestRepo(t)
+	defer repo.remove()
+	repo.commit("f.txt", "one\ntwo\n", "first")
+	setHistory("blame-mode", repo.history())
+	defer setHistory("blame-mode", nil)
+
+	rc := config.RepoConfig{
+		Name:     "blame-mode",
+		Path:     repo.dir,
+		Metadata: map[string]string{"blame": "git", "blame_mode": "merges"},
+	}
+	history, err := loadGitBlame(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !history.WithMerges {
+		t.Errorf("Wanted a history that follows merges")
+	}
+	setHistory("blame-mode", history)
+
+	delete(rc.Metadata, "blame_mode")
+	if history, err = loadGitBlame(rc); err != nil {
+		t.Fatal(err)
+	}
+	if history.WithMerges {
+		t.Errorf("Wanted a history that doesn't follow merges")
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/metrics"
+)
+
+// serverMetrics are the metrics exported on /debug/metrics.
+type serverMetrics struct {
+	registry *metrics.Registry
+
+	requests        *metrics.Counter
+	requestDuration *metrics.Histogram
+	rpcDuration     *metrics.Histogram
+	rpcErrors       *metrics.Counter
+	exitReasons     *metrics.Counter
+
+	// The server whose backends are reported on, which changes
+	// when the config is reloaded.
+	mu  sync.Mutex
+	srv *server
+}
+
+func newServerMetrics(s *server) *serverMetrics {
+	r := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry: r,
+		requests: r.NewCounter("livegrep_http_requests_total",
+			"HTTP requests served, by handler and status code.",
+			"handler", "code"),
+		requestDuration: r.NewHistogram("livegrep_http_request_duration_seconds",
+			"Time taken to serve HTTP requests, by handler.",
+			metrics.DefaultBuckets, "handler"),
+		rpcDuration: r.NewHistogram("livegrep_backend_rpc_duration_seconds",
+			"Time taken by search RPCs to codesearch, by backend.",
+			metrics.DefaultBuckets, "backend"),
+		rpcErrors: r.NewCounter("livegrep_backend_rpc_errors_total",
+			"Search RPCs to codesearch that failed, by backend.",
+			"backend"),
+		exitReasons: r.NewCounter("livegrep_search_exit_reason_total",
+			"Searches by the reason the backend stopped searching.",
+			"backend", "reason"),
+		srv: s,
+	}
+	r.NewGaugeFunc("livegrep_backend_index_age_seconds",
+		"Age of the index each backend is serving.",
+		[]string{"backend"},
+		func(set func(v float64, labelValues ...string)) {
+			now := time.Now()
+			s := m.server()
+			for _, id := range s.bkOrder {
+				bk := s.bk[id]
+				bk.I.Lock()
+				indexTime := bk.I.IndexTime
+				bk.I.Unlock()
+				if !indexTime.IsZero() {
+					set(now.Sub(indexTime).Seconds(), id)
+				}
+			}
+		})
+	return m
+}
+
+func (m *serverMetrics) server() *server {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.srv
+}
+
+func (m *serverMetrics) setServer(s *server) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.srv = s
+}
+
+// observeRPC records a search RPC to a backend. Like the other
+// methods, it does nothing on a nil *serverMetrics.
+func (m *serverMetrics) observeRPC(backend string, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.rpcDuration.Observe(d.Seconds(), backend)
+	if err != nil {
+		m.rpcErrors.Inc(backend)
+	}
+}
+
+func (m *serverMetrics) observeExit(backend, reason string) {
+	if m == nil {
+		return
+	}
+	m.exitReasons.Inc(backend, reason)
+}
+
+func (m *serverMetrics) observeRequest(handler string, status int, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.requests.Inc(handler, strconv.Itoa(status))
+	m.requestDuration.Observe(d.Seconds(), handler)
+}
+
+// statusRecorder remembers the status code written to a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// instrument wraps a handler to count its requests and their latency
+// under the given name.
+func (s *server) instrument(name string, f func(c context.Context, w http.ResponseWriter, r *http.Request)) func(c context.Context, w http.ResponseWriter, r *http.Request) {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: 200}
+		f(ctx, rec, r)
+		s.metrics.observeRequest(name, rec.status, time.Since(start))
+	}
+}
+
+func (s *server) ServeMetrics(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.metrics.registry.Write(w)
+}
+
+// ServeMetricsWithKey serves the metrics to requests carrying the
+// metrics key as a bearer token, without logging in, since scrapers
+// can't.
+func (s *server) ServeMetricsWithKey(w http.ResponseWriter, r *http.Request) {
+	if !hasBearerToken(r, s.config.MetricsKey) {
+		http.Error(w, "401 Bad metrics key", 401)
+		return
+	}
+	s.ServeMetrics(r.Context(), w, r)
+}
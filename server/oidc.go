@@ -0,0 +1,240 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/livegrep/livegrep/server/config"
+)
+
+const (
+	oidcCallbackPath  = "/auth/oidc/callback"
+	oidcSessionCookie = "livegrep_session"
+	oidcStateCookie   = "livegrep_oidc_state"
+	oidcSessionLength = 12 * time.Hour
+)
+
+// oidcAuth logs users in with the authorization code flow, asking the
+// provider's userinfo endpoint who they are, and then keeps them
+// logged in with a signed session cookie.
+type oidcAuth struct {
+	cfg    *config.OIDC
+	secret []byte
+
+	mu    sync.Mutex
+	oauth *oauth2.Config
+	// The provider's userinfo endpoint, found along with the other
+	// endpoints on first use.
+	userInfoURL string
+}
+
+// oidcSession is the content of the session cookie.
+type oidcSession struct {
+	Name    string   `json:"name"`
+	Groups  []string `json:"groups,omitempty"`
+	Expires int64    `json:"exp"`
+}
+
+func newOIDCAuth(cfg *config.OIDC) (*oidcAuth, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("oidc auth needs an issuer, client_id and redirect_url")
+	}
+	if cfg.CookieSecret == "" {
+		return nil, errors.New("oidc auth needs a cookie_secret")
+	}
+	return &oidcAuth{cfg: cfg, secret: []byte(cfg.CookieSecret)}, nil
+}
+
+// discover looks up the provider's endpoints, once it first succeeds.
+func (a *oidcAuth) discover() (*oauth2.Config, string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.oauth != nil {
+		return a.oauth, a.userInfoURL, nil
+	}
+
+	resp, err := http.Get(strings.TrimSuffix(a.cfg.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, "", fmt.Errorf("oidc discovery: %s", resp.Status)
+	}
+	var doc struct {
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, "", fmt.Errorf("oidc discovery: %v", err)
+	}
+
+	a.oauth = &oauth2.Config{
+		ClientID:     a.cfg.ClientID,
+		ClientSecret: a.cfg.ClientSecret,
+		RedirectURL:  a.cfg.RedirectURL,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  doc.AuthorizationEndpoint,
+			TokenURL: doc.TokenEndpoint,
+		},
+		Scopes: []string{"openid", "profile", "email", "groups"},
+	}
+	a.userInfoURL = doc.UserinfoEndpoint
+	return a.oauth, a.userInfoURL, nil
+}
+
+func (a *oidcAuth) sign(payload []byte) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (a *oidcAuth) verify(value string) ([]byte, bool) {
+	i := strings.Index(value, ".")
+	if i < 0 {
+		return nil, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(value[:i])
+	if err != nil {
+		return nil, false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil {
+		return nil, false
+	}
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(payload)
+	return payload, hmac.Equal(sig, mac.Sum(nil))
+}
+
+func (a *oidcAuth) authenticate(w http.ResponseWriter, r *http.Request) *user {
+	if r.URL.Path == oidcCallbackPath {
+		a.serveCallback(w, r)
+		return nil
+	}
+
+	if c, err := r.Cookie(oidcSessionCookie); err == nil {
+		var sess oidcSession
+		if payload, ok := a.verify(c.Value); ok &&
+			json.Unmarshal(payload, &sess) == nil &&
+			time.Now().Unix() < sess.Expires {
+			return &user{Name: sess.Name, Groups: sess.Groups}
+		}
+	}
+
+	// API clients can't follow a login flow.
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		http.Error(w, "401 Not authenticated", 401)
+		return nil
+	}
+
+	oauth, _, err := a.discover()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("500 Contacting login provider: %v", err), 500)
+		return nil
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		http.Error(w, err.Error(), 500)
+		return nil
+	}
+	state := base64.RawURLEncoding.EncodeToString(nonce)
+	// The state cookie remembers where to send the user back to.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    a.sign([]byte(state + " " + r.URL.RequestURI())),
+		Path:     oidcCallbackPath,
+		MaxAge:   600,
+		HttpOnly: true,
+	})
+	http.Redirect(w, r, oauth.AuthCodeURL(state), 302)
+	return nil
+}
+
+func (a *oidcAuth) serveCallback(w http.ResponseWriter, r *http.Request) {
+	c, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		http.Error(w, "400 Login expired; please try again", 400)
+		return
+	}
+	payload, ok := a.verify(c.Value)
+	parts := strings.SplitN(string(payload), " ", 2)
+	if !ok || len(parts) != 2 || parts[0] != r.URL.Query().Get("state") {
+		http.Error(w, "400 Invalid login state", 400)
+		return
+	}
+	returnTo := parts[1]
+
+	oauth, userInfoURL, err := a.discover()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("500 Contacting login provider: %v", err), 500)
+		return
+	}
+	token, err := oauth.Exchange(r.Context(), r.URL.Query().Get("code"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("401 Login failed: %v", err), 401)
+		return
+	}
+	resp, err := oauth.Client(r.Context(), token).Get(userInfoURL)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("500 Fetching user info: %v", err), 500)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		http.Error(w, fmt.Sprintf("500 Fetching user info: %s", resp.Status), 500)
+		return
+	}
+	var info struct {
+		Sub           string   `json:"sub"`
+		Email         string   `json:"email"`
+		EmailVerified bool     `json:"email_verified"`
+		Groups        []string `json:"groups"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		http.Error(w, fmt.Sprintf("500 Reading user info: %v", err), 500)
+		return
+	}
+
+	// Users pick their own preferred_username, and often their
+	// email too, so neither may name who acl rules apply to unless
+	// the provider vouches for it.
+	sess := oidcSession{
+		Name:    info.Sub,
+		Groups:  info.Groups,
+		Expires: time.Now().Add(oidcSessionLength).Unix(),
+	}
+	if info.EmailVerified && info.Email != "" {
+		sess.Name = info.Email
+	}
+	if sess.Name == "" {
+		http.Error(w, "401 Login provider did not identify the user", 401)
+		return
+	}
+	buf, err := json.Marshal(&sess)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcSessionCookie,
+		Value:    a.sign(buf),
+		Path:     "/",
+		MaxAge:   int(oidcSessionLength / time.Second),
+		HttpOnly: true,
+	})
+	http.Redirect(w, r, returnTo, 302)
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/log"
+)
+
+// A permalink records a search's results along with the index they
+// came from, so that links to it don't drift as trees are reindexed.
+type permalink struct {
+	Backend string `json:"backend"`
+	Query   string `json:"query"`
+	// The search's URL parameters, for running it again.
+	Params    string            `json:"params"`
+	IndexTime int64             `json:"index_time"`
+	Versions  map[string]string `json:"versions"`
+	Results   []*pinnedResult   `json:"results"`
+}
+
+type pinnedResult struct {
+	Tree       string `json:"tree"`
+	Version    string `json:"version"`
+	Path       string `json:"path"`
+	LineNumber int    `json:"lno"`
+	Line       string `json:"line"`
+	Bounds     [2]int `json:"bounds"`
+}
+
+// movedTree is a tree that has been reindexed at a new version since
+// a permalink was made. Current is empty if the tree is gone.
+type movedTree struct {
+	Tree    string `json:"tree"`
+	Pinned  string `json:"pinned"`
+	Current string `json:"current"`
+}
+
+// permalinkResult is a pinned result as shown to the user, with where
+// its line is now if the user asked for it to be fast-forwarded.
+type permalinkResult struct {
+	pinnedResult
+	ViewURL string `json:"view_url,omitempty"`
+	Moved   bool   `json:"moved"`
+
+	ForwardVersion string `json:"ff_version,omitempty"`
+	ForwardLine    int    `json:"ff_lno,omitempty"`
+	ForwardURL     string `json:"ff_url,omitempty"`
+	ForwardError   string `json:"ff_error,omitempty"`
+}
+
+type permalinkView struct {
+	Id          string             `json:"id"`
+	Backend     string             `json:"backend"`
+	Query       string             `json:"query"`
+	IndexTime   time.Time          `json:"index_time"`
+	SearchURL   string             `json:"search_url"`
+	Moved       []movedTree        `json:"moved"`
+	Results     []*permalinkResult `json:"results"`
+	FastForward bool               `json:"fast_forward"`
+}
+
+var permalinkIdRegex = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+func (s *server) permalinkPath(id string) string {
+	return filepath.Join(s.config.Permalinks.Dir, id+".json")
+}
+
+// savePermalink stores p, returning its ID. The ID is a hash of the
+// permalink, so saving the same results twice gives the same link.
+func (s *server) savePermalink(p *permalink) (string, error) {
+	buf, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(buf)
+	id := hex.EncodeToString(sum[:8])
+	path := s.permalinkPath(id)
+	if _, err := os.Stat(path); err == nil {
+		return id, nil
+	}
+	tmp, err := ioutil.TempFile(s.config.Permalinks.Dir, id+".")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return id, os.Rename(tmp.Name(), path)
+}
+
+func (s *server) loadPermalink(id string) (*permalink, error) {
+	buf, err := ioutil.ReadFile(s.permalinkPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var p permalink
+	if err := json.Unmarshal(buf, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// ServeNewPermalink runs the search given by the same parameters as
+// ServeAPISearch, records its results and the versions of the
+// backend's trees, and redirects to the permalink.
+func (s *server) ServeNewPermalink(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if s.config.Permalinks.Dir == "" {
+		http.Error(w, "404 Permalinks are not enabled", 404)
+		return
+	}
+	params := r.URL.Query()
+	if params.Get(":backend") == "" && s.config.FanOutSearch && len(s.bkOrder) > 0 {
+		// A permalink pins a single index.
+		params.Set(":backend", s.bkOrder[0])
+		r.URL.RawQuery = params.Encode()
+	}
+	search := s.parseAPISearch(ctx, w, r)
+	if search == nil {
+		return
+	}
+	if search.backend == nil || search.cursor != nil {
+		writeError(ctx, w, 400, "bad_query", "A permalink needs a single backend and no pagination")
+		return
+	}
+	reply, err := s.runAPISearch(ctx, search)
+	if err != nil {
+		log.Printf(ctx, "error in search err=%s", err)
+		writeQueryError(ctx, w, err)
+		return
+	}
+	s.recordSearch(ctx, search, reply)
+
+	bk := search.backend
+	p := &permalink{
+		Backend:  bk.Id,
+		Query:    params.Get("q"),
+		Versions: make(map[string]string),
+	}
+	params.Del(":backend")
+	p.Params = params.Encode()
+	bk.I.Lock()
+	p.IndexTime = bk.I.IndexTime.Unix()
+	for _, t := range bk.I.Trees {
+		if s.canSee(ctx, t.Name) {
+			p.Versions[t.Name] = t.Version
+		}
+	}
+	bk.I.Unlock()
+	for _, res := range reply.Results {
+		p.Results = append(p.Results, &pinnedResult{
+			Tree:       res.Tree,
+			Version:    res.Version,
+			Path:       res.Path,
+			LineNumber: res.LineNumber,
+			Line:       res.Line,
+			Bounds:     res.Bounds,
+		})
+	}
+
+	id, err := s.savePermalink(p)
+	if err != nil {
+		log.Printf(ctx, "saving permalink err=%s", err)
+		http.Error(w, fmt.Sprint("500 Saving permalink: ", err), 500)
+		return
+	}
+	http.Redirect(w, r, "/permalink/"+id, 303)
+}
+
+// permalinkView loads a permalink, comparing it to the current index.
+// If fastForward is set, the lines of results in trees that have moved
+// are followed to the trees' current versions.
+func (s *server) permalinkView(ctx context.Context, id string, fastForward bool) (*permalinkView, int, error) {
+	if s.config.Permalinks.Dir == "" {
+		return nil, 404, fmt.Errorf("Permalinks are not enabled")
+	}
+	if !permalinkIdRegex.MatchString(id) {
+		return nil, 404, fmt.Errorf("No such permalink")
+	}
+	p, err := s.loadPermalink(id)
+	if os.IsNotExist(err) {
+		return nil, 404, fmt.Errorf("No such permalink")
+	} else if err != nil {
+		return nil, 500, err
+	}
+
+	view := &permalinkView{
+		Id:          id,
+		Backend:     p.Backend,
+		Query:       p.Query,
+		IndexTime:   time.Unix(p.IndexTime, 0),
+		SearchURL:   "/search/" + url.PathEscape(p.Backend) + "?" + p.Params,
+		FastForward: fastForward,
+	}
+
+	current := make(map[string]string)
+	if bk, ok := s.bk[p.Backend]; ok {
+		bk.I.Lock()
+		for _, t := range bk.I.Trees {
+			current[t.Name] = t.Version
+		}
+		bk.I.Unlock()
+	}
+	moved := make(map[string]bool)
+	for tree, version := range p.Versions {
+		// If the backend hasn't told us about its trees, we can't
+		// tell whether they've moved.
+		if len(current) == 0 || !s.canSee(ctx, tree) {
+			continue
+		}
+		if current[tree] != version {
+			moved[tree] = true
+			view.Moved = append(view.Moved, movedTree{tree, version, current[tree]})
+		}
+	}
+	sort.Slice(view.Moved, func(i, j int) bool { return view.Moved[i].Tree < view.Moved[j].Tree })
+
+	view.Results = []*permalinkResult{}
+	for _, res := range p.Results {
+		if !s.canSee(ctx, res.Tree) {
+			continue
+		}
+		pr := &permalinkResult{pinnedResult: *res, Moved: moved[res.Tree]}
+		repo, internal := s.repos[res.Tree]
+		if internal {
+			pr.ViewURL = fmt.Sprintf("/view/%s/%s?commit=%s#L%d", res.Tree, res.Path, res.Version, res.LineNumber)
+		}
+		if fastForward && pr.Moved && current[res.Tree] != "" {
+			if !internal {
+				pr.ForwardError = "Repository not configured for browsing"
+			} else if commit, lno, err := FastForward(repo, res.Path,
+				shortHash(res.Version), shortHash(current[res.Tree]), res.LineNumber); err != nil {
+				pr.ForwardError = err.Error()
+			} else {
+				pr.ForwardVersion, pr.ForwardLine = commit, lno
+				pr.ForwardURL = fmt.Sprintf("/view/%s/%s?commit=%s#L%d", res.Tree, res.Path, commit, lno)
+				if commit != shortHash(current[res.Tree]) {
+					pr.ForwardError = "The line could only be followed part of the way"
+				}
+			}
+		}
+		view.Results = append(view.Results, pr)
+	}
+	return view, 200, nil
+}
+
+// shortHash abbreviates a commit hash the way blame histories do.
+func shortHash(hash string) string {
+	if len(hash) > 16 {
+		return hash[:16]
+	}
+	return hash
+}
+
+func (s *server) ServePermalink(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	view, status, err := s.permalinkView(ctx, r.URL.Query().Get(":id"), r.URL.Query().Get("fast_forward") != "")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%d %s", status, err), status)
+		return
+	}
+	s.renderPage(ctx, w, r, "permalink.html", &page{
+		Title:         view.Query + " ⋅ permalink",
+		IncludeHeader: true,
+		Data:          view,
+	})
+}
+
+// ServeAPIPermalink returns a permalink as JSON.
+func (s *server) ServeAPIPermalink(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	view, status, err := s.permalinkView(ctx, r.URL.Query().Get(":id"), r.URL.Query().Get("fast_forward") != "")
+	if err != nil {
+		code := "not_found"
+		if status == 500 {
+			code = "internal_error"
+		}
+		writeError(ctx, w, status, code, err.Error())
+		return
+	}
+	replyJSON(ctx, w, 200, view)
+}
@@ -26,6 +26,42 @@ var knownTags = map[string]bool{
 	"case":        true,
 	"lit":         true,
 	"max_matches": true,
+	"context":     true,
+}
+
+// Filters that may be given more than once. Their values are combined
+// into a single regex matching any of them.
+var repeatableTags = map[string]bool{
+	"file":  true,
+	"-file": true,
+	"path":  true,
+	"-path": true,
+	"repo":  true,
+	"-repo": true,
+	"tags":  true,
+	"-tags": true,
+}
+
+// alternation builds a regex matching any of terms, quoting each one
+// first if quote is set.
+func alternation(terms []string, quote bool) string {
+	var alts []string
+	for _, t := range terms {
+		if t == "" {
+			continue
+		}
+		if quote {
+			t = regexp.QuoteMeta(t)
+		}
+		alts = append(alts, t)
+	}
+	if len(alts) == 1 {
+		return alts[0]
+	}
+	for i := range alts {
+		alts[i] = "(" + alts[i] + ")"
+	}
+	return strings.Join(alts, "|")
 }
 
 func onlyOneSynonym(ops map[string]string, op1 string, op2 string) (string, error) {
@@ -42,6 +78,18 @@ func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
 	var out pb.Query
 
 	ops := make(map[string]string)
+	filters := make(map[string][]string)
+	setOp := func(key, term string) error {
+		if repeatableTags[key] {
+			filters[key] = append(filters[key], term)
+			return nil
+		}
+		if _, alreadySet := ops[key]; alreadySet {
+			return fmt.Errorf("got term twice: %s", key)
+		}
+		ops[key] = term
+		return nil
+	}
 	key := ""
 	term := ""
 	q := strings.TrimSpace(query)
@@ -52,10 +100,9 @@ func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
 		m := pieceRE.FindStringSubmatchIndex(q)
 		if m == nil {
 			term += q
-			if _, alreadySet := ops[key]; alreadySet {
-				return out, fmt.Errorf("got term twice: %s", key)
+			if err := setOp(key, term); err != nil {
+				return out, err
 			}
-			ops[key] = term
 			break
 		}
 
@@ -71,10 +118,9 @@ func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
 				term += " "
 
 			} else {
-				if _, alreadySet := ops[key]; alreadySet {
-					return out, fmt.Errorf("got term twice: %s", key)
+				if err := setOp(key, term); err != nil {
+					return out, err
 				}
-				ops[key] = term
 				key = ""
 				term = ""
 				inRegex = globalRegex
@@ -138,6 +184,11 @@ func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
 		justGotSpace = (match == " ")
 	}
 
+	for k, terms := range filters {
+		quote := !globalRegex && k != "tags" && k != "-tags"
+		ops[k] = alternation(terms, quote)
+	}
+
 	var err error
 	if out.File, err = onlyOneSynonym(ops, "file", "path"); err != nil {
 		return out, err
@@ -168,13 +219,6 @@ func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
 		out.Line = bits[0]
 	}
 
-	if !globalRegex {
-		out.File = regexp.QuoteMeta(out.File)
-		out.NotFile = regexp.QuoteMeta(out.NotFile)
-		out.Repo = regexp.QuoteMeta(out.Repo)
-		out.NotRepo = regexp.QuoteMeta(out.NotRepo)
-	}
-
 	if out.Line == "" && out.File != "" {
 		out.Line = out.File
 		out.File = ""
@@ -198,6 +242,489 @@ func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
 	} else {
 		out.MaxMatches = 0
 	}
+	if v, ok := ops["context"]; ok && v != "" {
+		if out.ContextLines, err = parseContextLines(v); err != nil {
+			return out, err
+		}
+	}
 
 	return out, nil
 }
+
+// The most lines of context a query may ask for.
+const maxContextLines = 100
+
+// parseContextLines parses a number of lines of context for
+// pb.Query.ContextLines, in which 0 means the backend's default and
+// asking for no context is negative.
+func parseContextLines(v string) (int32, error) {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 || n > maxContextLines {
+		return 0, fmt.Errorf("Value given to context: must be an integer from 0 to %d", maxContextLines)
+	}
+	if n == 0 {
+		return -1, nil
+	}
+	return int32(n), nil
+}
+
+// QueryExprOp identifies the kind of a QueryExpr node.
+type QueryExprOp int
+
+const (
+	OpLine QueryExprOp = iota
+	OpAnd
+	OpOr
+)
+
+// A QueryExpr is a boolean combination of line searches. OpLine nodes
+// are leaves carrying a regex to search for, and any filters that
+// apply only to that search. OpOr takes the union of its children's
+// matches; OpAnd keeps the matches from files that every positive
+// child matched, minus any lines matching a Negated child.
+type QueryExpr struct {
+	Op       QueryExprOp  `json:"op"`
+	Line     string       `json:"line,omitempty"`
+	FoldCase bool         `json:"fold_case,omitempty"`
+	Negated  bool         `json:"negated,omitempty"`
+	Filters  *ExprFilters `json:"filters,omitempty"`
+	Children []*QueryExpr `json:"children,omitempty"`
+}
+
+// ExprFilters are the filters of one term of a boolean query, on top
+// of those of the whole query.
+type ExprFilters struct {
+	File    string `json:"file,omitempty"`
+	NotFile string `json:"not_file,omitempty"`
+	Repo    string `json:"repo,omitempty"`
+	NotRepo string `json:"not_repo,omitempty"`
+	Tags    string `json:"tags,omitempty"`
+	NotTags string `json:"not_tags,omitempty"`
+}
+
+// add merges the filters of a group around a term into f. Repeated
+// exclusions are combined so that either excludes; a file:, repo: or
+// tags: filter given both for a term and for its group can't be.
+func (f *ExprFilters) add(outer *ExprFilters) error {
+	if err := addFilter("file", &f.File, outer.File); err != nil {
+		return err
+	}
+	if err := addFilter("repo", &f.Repo, outer.Repo); err != nil {
+		return err
+	}
+	if err := addFilter("tags", &f.Tags, outer.Tags); err != nil {
+		return err
+	}
+	mergeFilter(&f.NotFile, outer.NotFile)
+	mergeFilter(&f.NotRepo, outer.NotRepo)
+	mergeFilter(&f.NotTags, outer.NotTags)
+	return nil
+}
+
+func addFilter(name string, dst *string, outer string) error {
+	if outer == "" || *dst == outer {
+		return nil
+	}
+	if *dst != "" {
+		return fmt.Errorf("%s: given both for a term and for the terms around it", name)
+	}
+	*dst = outer
+	return nil
+}
+
+// apply adds f to a query for the term it belongs to.
+func (f *ExprFilters) apply(q *pb.Query) {
+	if f == nil {
+		return
+	}
+	if f.File != "" {
+		q.File = f.File
+	}
+	if f.Repo != "" {
+		q.Repo = f.Repo
+	}
+	if f.Tags != "" {
+		q.Tags = f.Tags
+	}
+	mergeFilter(&q.NotFile, f.NotFile)
+	mergeFilter(&q.NotRepo, f.NotRepo)
+	mergeFilter(&q.NotTags, f.NotTags)
+}
+
+// addScope adds the filters of a group to each of the positive terms
+// within it.
+func (e *QueryExpr) addScope(scope *ExprFilters) error {
+	if *scope == (ExprFilters{}) {
+		return nil
+	}
+	var err error
+	e.walk(func(e *QueryExpr) {
+		if err != nil || e.Op != OpLine || e.Negated {
+			return
+		}
+		if e.Filters == nil {
+			e.Filters = &ExprFilters{}
+		}
+		err = e.Filters.add(scope)
+	})
+	return err
+}
+
+func (e *QueryExpr) walk(f func(*QueryExpr)) {
+	f(e)
+	for _, c := range e.Children {
+		c.walk(f)
+	}
+}
+
+// ParseQueryExpr parses a query that may combine search terms with AND
+// and OR, use line: and -line: terms, and group terms in parentheses.
+// Filters like file: and repo: written with a search term apply to
+// that term alone. Filters written on their own apply to the terms of
+// the group they are in, or, outside any group, to the whole query,
+// and are returned in the pb.Query along with max_matches: and
+// context:. If the query uses none of the boolean syntax, the returned
+// expression is nil and the pb.Query is exactly what ParseQuery
+// returns.
+func ParseQueryExpr(query string, globalRegex bool) (pb.Query, *QueryExpr, error) {
+	words := splitQuery(strings.TrimSpace(query), globalRegex)
+	if !isBoolean(words, globalRegex) {
+		q, err := ParseQuery(query, globalRegex)
+		return q, nil, err
+	}
+
+	p := &exprParser{words: words, regex: globalRegex, filters: &pb.Query{}}
+	expr, scope, err := p.parseOr()
+	if err != nil {
+		return pb.Query{}, nil, err
+	}
+	if err := expr.validate(nil); err != nil {
+		return pb.Query{}, nil, err
+	}
+	// Check the filters for the whole query against the terms'.
+	q := p.filters
+	q.File, q.NotFile = scope.File, scope.NotFile
+	q.Repo, q.NotRepo = scope.Repo, scope.NotRepo
+	q.Tags, q.NotTags = scope.Tags, scope.NotTags
+	var conflict error
+	expr.walk(func(e *QueryExpr) {
+		if e.Filters != nil && conflict == nil {
+			f := *e.Filters
+			conflict = f.add(scope)
+		}
+	})
+	if conflict != nil {
+		return pb.Query{}, nil, conflict
+	}
+	return *q, expr, nil
+}
+
+// splitQuery breaks a query into space-separated words, keeping
+// parenthesised groups together the way ParseQuery does.
+func splitQuery(query string, globalRegex bool) []string {
+	var words []string
+	var word bytes.Buffer
+	depth := 0
+	esc := false
+	for _, r := range query {
+		switch {
+		case esc:
+			esc = false
+		case r == '\\':
+			esc = true
+		case r == '(' && (globalRegex || depth > 0 || word.Len() == 0):
+			depth++
+		case r == ')' && depth > 0:
+			depth--
+		case r == ' ' && depth == 0:
+			if word.Len() > 0 {
+				words = append(words, word.String())
+				word.Reset()
+			}
+			continue
+		}
+		word.WriteRune(r)
+	}
+	if word.Len() > 0 {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// isGroup reports whether word is entirely enclosed in one pair of
+// balanced parentheses.
+func isGroup(word string) bool {
+	if !strings.HasPrefix(word, "(") {
+		return false
+	}
+	depth := 0
+	esc := false
+	for i, r := range word {
+		switch {
+		case esc:
+			esc = false
+		case r == '\\':
+			esc = true
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+			if depth == 0 {
+				return i == len(word)-1
+			}
+		}
+	}
+	return false
+}
+
+func isLineTerm(word string) bool {
+	return strings.HasPrefix(word, "line:") || strings.HasPrefix(word, "-line:")
+}
+
+func isBoolean(words []string, globalRegex bool) bool {
+	for _, w := range words {
+		if w == "AND" || w == "OR" || isLineTerm(w) {
+			return true
+		}
+		if isBooleanGroup(w, globalRegex) {
+			return true
+		}
+	}
+	return false
+}
+
+func isBooleanGroup(word string, globalRegex bool) bool {
+	return isGroup(word) && isBoolean(splitQuery(word[1:len(word)-1], globalRegex), globalRegex)
+}
+
+type exprParser struct {
+	words   []string
+	pos     int
+	regex   bool
+	filters *pb.Query // max_matches: and context:, for the whole query
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.words) {
+		return p.words[p.pos]
+	}
+	return ""
+}
+
+// parseOr parses terms joined by OR. If there is only one, the
+// filters written on their own alongside it are returned rather than
+// added to its terms, as they may apply to the whole query.
+func (p *exprParser) parseOr() (*QueryExpr, *ExprFilters, error) {
+	var children []*QueryExpr
+	var scopes []*ExprFilters
+	for {
+		e, scope, err := p.parseAnd()
+		if err != nil {
+			return nil, nil, err
+		}
+		if e == nil {
+			return nil, nil, errors.New("OR must join two search terms")
+		}
+		children = append(children, e)
+		scopes = append(scopes, scope)
+		if p.peek() != "OR" {
+			break
+		}
+		p.pos++
+	}
+	if len(children) == 1 {
+		return children[0], scopes[0], nil
+	}
+	for i, c := range children {
+		if err := c.addScope(scopes[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return &QueryExpr{Op: OpOr, Children: children}, &ExprFilters{}, nil
+}
+
+// parseAnd parses a run of terms joined by AND. AND may be left out:
+// `foo -line:bar` means `foo AND -line:bar`. It returns the filters
+// written on their own among the terms along with them.
+func (p *exprParser) parseAnd() (*QueryExpr, *ExprFilters, error) {
+	var children []*QueryExpr
+	scope := &ExprFilters{}
+	needTerm := false
+	for p.pos < len(p.words) && p.peek() != "OR" {
+		if p.peek() == "AND" {
+			if len(children) == 0 || needTerm {
+				return nil, nil, errors.New("AND must join two search terms")
+			}
+			p.pos++
+			needTerm = true
+			continue
+		}
+		e, err := p.parseTerm(scope)
+		if err != nil {
+			return nil, nil, err
+		}
+		if e != nil {
+			children = append(children, e)
+			needTerm = false
+		}
+	}
+	if needTerm {
+		return nil, nil, errors.New("AND must join two search terms")
+	}
+	switch len(children) {
+	case 0:
+		return nil, scope, nil
+	case 1:
+		return children[0], scope, nil
+	}
+	return &QueryExpr{Op: OpAnd, Children: children}, scope, nil
+}
+
+// parseTerm parses a group, a line: or -line: term, or a run of plain
+// words. Plain words are handed to ParseQuery, so they may include
+// filters for the term; a run consisting only of filters yields no
+// term, and its filters are added to scope.
+func (p *exprParser) parseTerm(scope *ExprFilters) (*QueryExpr, error) {
+	w := p.peek()
+	if isBooleanGroup(w, p.regex) {
+		p.pos++
+		sub := &exprParser{
+			words:   splitQuery(w[1:len(w)-1], p.regex),
+			regex:   p.regex,
+			filters: p.filters,
+		}
+		e, groupScope, err := sub.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := e.addScope(groupScope); err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+	if isLineTerm(w) {
+		p.pos++
+		return p.lineTerm(w)
+	}
+
+	start := p.pos
+	for p.pos < len(p.words) {
+		w := p.words[p.pos]
+		if w == "AND" || w == "OR" || isLineTerm(w) || isBooleanGroup(w, p.regex) {
+			break
+		}
+		p.pos++
+	}
+	q, err := ParseQuery(strings.Join(p.words[start:p.pos], " "), p.regex)
+	if err != nil {
+		return nil, err
+	}
+	if q.FilenameOnly {
+		// ParseQuery turns a lone file: into a filename
+		// search; here it is just a filter.
+		q.File, q.Line = q.Line, ""
+	}
+	if err := p.addLimits(&q); err != nil {
+		return nil, err
+	}
+	filters := &ExprFilters{
+		File:    q.File,
+		NotFile: q.NotFile,
+		Repo:    q.Repo,
+		NotRepo: q.NotRepo,
+		Tags:    q.Tags,
+		NotTags: q.NotTags,
+	}
+	if q.Line == "" {
+		mergeFilter(&scope.File, filters.File)
+		mergeFilter(&scope.NotFile, filters.NotFile)
+		mergeFilter(&scope.Repo, filters.Repo)
+		mergeFilter(&scope.NotRepo, filters.NotRepo)
+		mergeFilter(&scope.Tags, filters.Tags)
+		mergeFilter(&scope.NotTags, filters.NotTags)
+		return nil, nil
+	}
+	e := &QueryExpr{Op: OpLine, Line: q.Line, FoldCase: q.FoldCase}
+	if *filters != (ExprFilters{}) {
+		e.Filters = filters
+	}
+	return e, nil
+}
+
+func (p *exprParser) lineTerm(word string) (*QueryExpr, error) {
+	negated := strings.HasPrefix(word, "-")
+	value := word[strings.Index(word, ":")+1:]
+	if value == "" {
+		return nil, fmt.Errorf("%s needs a value", word)
+	}
+	line := value
+	if !p.regex {
+		line = regexp.QuoteMeta(line)
+	}
+	if _, err := regexp.Compile(line); negated && err != nil {
+		return nil, fmt.Errorf("Invalid regex for -line: %s", err)
+	}
+	return &QueryExpr{
+		Op:       OpLine,
+		Line:     line,
+		FoldCase: strings.IndexAny(value, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") == -1,
+		Negated:  negated,
+	}, nil
+}
+
+// mergeFilter adds a filter to those collected so far; like repeated
+// filters in ParseQuery, the values are combined so that either may
+// match.
+func mergeFilter(dst *string, src string) {
+	if src == "" || *dst == src {
+		return
+	}
+	if *dst == "" {
+		*dst = src
+		return
+	}
+	*dst = "(" + *dst + ")|(" + src + ")"
+}
+
+// addLimits adds the max_matches: and context: given in one part of a
+// boolean query, which apply to the whole query, to those collected so
+// far.
+func (p *exprParser) addLimits(q *pb.Query) error {
+	f := p.filters
+	if q.MaxMatches != 0 {
+		if f.MaxMatches != 0 && f.MaxMatches != q.MaxMatches {
+			return errors.New("got term twice: max_matches")
+		}
+		f.MaxMatches = q.MaxMatches
+	}
+	if q.ContextLines != 0 {
+		if f.ContextLines != 0 && f.ContextLines != q.ContextLines {
+			return errors.New("got term twice: context")
+		}
+		f.ContextLines = q.ContextLines
+	}
+	return nil
+}
+
+var errNegatedAlone = errors.New("A -line: term must be combined with a search term using AND")
+
+func (e *QueryExpr) validate(parent *QueryExpr) error {
+	if e.Negated && (parent == nil || parent.Op != OpAnd) {
+		return errNegatedAlone
+	}
+	if e.Op == OpAnd {
+		positive := false
+		for _, c := range e.Children {
+			positive = positive || !c.Negated
+		}
+		if !positive {
+			return errNegatedAlone
+		}
+	}
+	for _, c := range e.Children {
+		if err := c.validate(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
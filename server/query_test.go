@@ -133,6 +133,16 @@ func TestParseQuery(t *testing.T) {
 			pb.Query{Line: "a", FoldCase: true},
 			true,
 		},
+		{
+			`a context:5`,
+			pb.Query{Line: "a", FoldCase: true, ContextLines: 5},
+			true,
+		},
+		{
+			`a context:0`,
+			pb.Query{Line: "a", FoldCase: true, ContextLines: -1},
+			true,
+		},
 		{
 			`file:hello`,
 			pb.Query{Line: "hello", FoldCase: true, FilenameOnly: true},
@@ -143,6 +153,30 @@ func TestParseQuery(t *testing.T) {
 			pb.Query{Line: "HELLO", FoldCase: false, FilenameOnly: true},
 			true,
 		},
+		{
+			`a file:b file:c`,
+			pb.Query{Line: "a", File: "(b)|(c)", FoldCase: true},
+			true,
+		},
+		{
+			`repo:web repo:api -file:_test.go -file:vendor/ a`,
+			pb.Query{
+				Line:     "a",
+				Repo:     "(web)|(api)",
+				NotFile:  "(_test.go)|(vendor/)",
+				FoldCase: true,
+			},
+			true,
+		},
+		{
+			`tags:kind:function a tags:kind:class`,
+			pb.Query{
+				Line:     "a",
+				Tags:     "(kind:function)|(kind:class)",
+				FoldCase: true,
+			},
+			true,
+		},
 		{
 			`lit:a( file:b`,
 			pb.Query{Line: `a\(`, File: "b", FoldCase: false},
@@ -190,6 +224,11 @@ func TestParseQuery(t *testing.T) {
 			pb.Query{Line: `\(file:a\) \(repo:b\)`, FoldCase: true},
 			false,
 		},
+		{
+			"file:a. file:b( c",
+			pb.Query{Line: `c`, File: `(a\.)|(b\()`, FoldCase: true},
+			false,
+		},
 		{
 			"file:a( b",
 			pb.Query{Line: `b`, File: `a\(`, FoldCase: true},
@@ -217,6 +256,8 @@ func TestParseQueryError(t *testing.T) {
 		{"lit:a b"},
 		{"case:a lit:b"},
 		{"a max_matches:a"},
+		{"a context:-1"},
+		{"a context:1000"},
 		{"a file:b c"},
 		{"a file:((abc()())()) c"},
 	}
@@ -228,3 +269,136 @@ func TestParseQueryError(t *testing.T) {
 		}
 	}
 }
+
+func TestParseQueryExpr(t *testing.T) {
+	cases := []struct {
+		in    string
+		query pb.Query
+		expr  *QueryExpr
+		regex bool
+	}{
+		{
+			"a b",
+			pb.Query{Line: "a b", FoldCase: true},
+			nil,
+			true,
+		},
+		{
+			"foo AND bar",
+			pb.Query{},
+			&QueryExpr{Op: OpAnd, Children: []*QueryExpr{
+				{Op: OpLine, Line: "foo", FoldCase: true},
+				{Op: OpLine, Line: "bar", FoldCase: true},
+			}},
+			true,
+		},
+		{
+			"foo file:a OR bar file:b",
+			pb.Query{},
+			&QueryExpr{Op: OpOr, Children: []*QueryExpr{
+				{Op: OpLine, Line: "foo", FoldCase: true, Filters: &ExprFilters{File: "a"}},
+				{Op: OpLine, Line: "bar", FoldCase: true, Filters: &ExprFilters{File: "b"}},
+			}},
+			true,
+		},
+		{
+			"foo OR Bar file:\\.go",
+			pb.Query{},
+			&QueryExpr{Op: OpOr, Children: []*QueryExpr{
+				{Op: OpLine, Line: "foo", FoldCase: true},
+				{Op: OpLine, Line: "Bar", FoldCase: false, Filters: &ExprFilters{File: `\.go`}},
+			}},
+			true,
+		},
+		{
+			"(x -line:c -repo:r) OR z -file:f",
+			pb.Query{},
+			&QueryExpr{Op: OpOr, Children: []*QueryExpr{
+				{Op: OpAnd, Children: []*QueryExpr{
+					{Op: OpLine, Line: "x", FoldCase: true, Filters: &ExprFilters{NotRepo: "r"}},
+					{Op: OpLine, Line: "c", FoldCase: true, Negated: true},
+				}},
+				{Op: OpLine, Line: "z", FoldCase: true, Filters: &ExprFilters{NotFile: "f"}},
+			}},
+			true,
+		},
+		{
+			"a b -line:c",
+			pb.Query{},
+			&QueryExpr{Op: OpAnd, Children: []*QueryExpr{
+				{Op: OpLine, Line: "a b", FoldCase: true},
+				{Op: OpLine, Line: "c", FoldCase: true, Negated: true},
+			}},
+			true,
+		},
+		{
+			"x AND (y OR z) repo:r",
+			pb.Query{Repo: "r"},
+			&QueryExpr{Op: OpAnd, Children: []*QueryExpr{
+				{Op: OpLine, Line: "x", FoldCase: true},
+				{Op: OpOr, Children: []*QueryExpr{
+					{Op: OpLine, Line: "y", FoldCase: true},
+					{Op: OpLine, Line: "z", FoldCase: true},
+				}},
+			}},
+			true,
+		},
+		{
+			"(a|b) OR c",
+			pb.Query{},
+			&QueryExpr{Op: OpOr, Children: []*QueryExpr{
+				{Op: OpLine, Line: "(a|b)", FoldCase: true},
+				{Op: OpLine, Line: "c", FoldCase: true},
+			}},
+			true,
+		},
+		{
+			"a.b OR line:c(",
+			pb.Query{},
+			&QueryExpr{Op: OpOr, Children: []*QueryExpr{
+				{Op: OpLine, Line: `a\.b`, FoldCase: true},
+				{Op: OpLine, Line: `c\(`, FoldCase: true},
+			}},
+			false,
+		},
+	}
+
+	for _, tc := range cases {
+		q, expr, err := ParseQueryExpr(tc.in, tc.regex)
+		if err != nil {
+			t.Errorf("parse(%v) error=%v", tc.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(tc.query, q) {
+			t.Errorf("error parsing %q: expected query %#v got %#v",
+				tc.in, tc.query, q)
+		}
+		if !reflect.DeepEqual(tc.expr, expr) {
+			t.Errorf("error parsing %q: expected expr %s got %s",
+				tc.in, asJSON{tc.expr}, asJSON{expr})
+		}
+	}
+}
+
+func TestParseQueryExprError(t *testing.T) {
+	cases := []string{
+		"AND foo",
+		"foo AND",
+		"foo OR",
+		"foo AND AND bar",
+		"-line:foo",
+		"foo OR -line:bar",
+		"foo AND -line:(",
+		"foo AND bar max_matches:1 max_matches:2",
+		"foo AND file:a",
+		"(x file:a -line:c file:b) OR z",
+		"x file:a AND (y OR z) file:b",
+	}
+
+	for _, in := range cases {
+		_, expr, err := ParseQueryExpr(in, true)
+		if err == nil {
+			t.Errorf("expected an error parsing (%v), got %s", in, asJSON{expr})
+		}
+	}
+}
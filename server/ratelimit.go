@@ -0,0 +1,387 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/config"
+)
+
+// Once this many clients are being tracked, buckets that have filled
+// back up are forgotten.
+const maxIdleBuckets = 10000
+
+// tokenBucket allows bursts of up to burst requests, refilling at
+// rate requests per second.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// take spends a token if one is available, or else returns how long
+// until one will be.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// apiKey is a key API clients present to be identified, and limited,
+// separately from everyone else.
+type apiKey struct {
+	name  string
+	rate  float64
+	burst int
+}
+
+// keyUsage counts the requests made with an API key.
+type keyUsage struct {
+	Requests    int64 `json:"requests"`
+	RateLimited int64 `json:"rate_limited"`
+}
+
+// uiCookie names the cookie that the search page sets to let the web
+// UI's own API requests, which carry no key, through when keys are
+// required. They are limited by IP address, like other requests
+// without a key. The cookie is only good for the address it was given
+// to, and expires unless it is used within uiCookieTTL.
+const uiCookie = "livegrep_ui"
+
+const uiCookieTTL = time.Hour
+
+// rateLimiter enforces the per-key and per-IP request limits on the
+// API.
+type rateLimiter struct {
+	keys         map[string]*apiKey // by key
+	ipRate       float64
+	ipBurst      int
+	keyRate      float64
+	keyBurst     int
+	requireKey   bool
+	reverseProxy bool
+	// The key that uiCookies are signed with, if keys are required.
+	uiSecret []byte
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	usage   map[string]*keyUsage // by key name
+}
+
+func newRateLimiter(cfg *config.Config) (*rateLimiter, error) {
+	rl := &rateLimiter{
+		keys:       make(map[string]*apiKey),
+		ipRate:     cfg.RateLimit.PerIP,
+		ipBurst:    cfg.RateLimit.PerIPBurst,
+		keyRate:    cfg.RateLimit.PerKey,
+		keyBurst:   cfg.RateLimit.PerKeyBurst,
+		requireKey: cfg.RateLimit.RequireKey,
+		buckets:    make(map[string]*tokenBucket),
+		usage:      make(map[string]*keyUsage),
+
+		reverseProxy: cfg.ReverseProxy,
+	}
+	for _, k := range cfg.APIKeys {
+		rl.keys[k.Key] = &apiKey{k.Name, k.RateLimit, k.Burst}
+	}
+	if cfg.APIKeyFile != "" {
+		if err := rl.loadKeyFile(cfg.APIKeyFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(rl.keys) == 0 && rl.ipRate == 0 && !rl.requireKey {
+		return nil, nil
+	}
+	if rl.requireKey {
+		rl.uiSecret = make([]byte, 32)
+		if _, err := rand.Read(rl.uiSecret); err != nil {
+			return nil, err
+		}
+	}
+	for _, k := range rl.keys {
+		rl.usage[k.name] = &keyUsage{}
+	}
+	return rl, nil
+}
+
+// loadKeyFile reads API keys from a file of "name:key" lines.
+func (rl *rateLimiter) loadKeyFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return fmt.Errorf("%s: expected name:key, got %q", path, line)
+		}
+		rl.keys[line[i+1:]] = &apiKey{name: line[:i]}
+	}
+	return scanner.Err()
+}
+
+func requestKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.Header.Get("X-Livegrep-Key")
+}
+
+// hasKey reports whether a request carries a known API key. A nil
+// *rateLimiter knows no keys.
+func (rl *rateLimiter) hasKey(r *http.Request) bool {
+	if rl == nil {
+		return false
+	}
+	_, ok := rl.keys[requestKey(r)]
+	return ok
+}
+
+// keyUser returns the user that an API request with a known key is
+// made as when authentication is on: one named after the key.
+func (rl *rateLimiter) keyUser(r *http.Request) *user {
+	if rl == nil || !strings.HasPrefix(r.URL.Path, "/api/") {
+		return nil
+	}
+	if key, ok := rl.keys[requestKey(r)]; ok {
+		return &user{Name: key.name}
+	}
+	return nil
+}
+
+// requestIP returns the address a request came from, which a reverse
+// proxy reports in X-Real-Ip if the config says there is one.
+func (rl *rateLimiter) requestIP(r *http.Request) string {
+	if rl.reverseProxy {
+		if ip := r.Header.Get("X-Real-Ip"); ip != "" {
+			return ip
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// allow decides whether to serve a request, returning the API error
+// code to fail it with if not.
+func (rl *rateLimiter) allow(r *http.Request) (code string, retry time.Duration) {
+	var bucket string
+	rate, burst := rl.ipRate, rl.ipBurst
+	var usage *keyUsage
+
+	if k := requestKey(r); k != "" {
+		key, ok := rl.keys[k]
+		if !ok {
+			return "bad_api_key", 0
+		}
+		bucket = "key:" + key.name
+		rate, burst = rl.keyLimits(key)
+		usage = rl.usage[key.name]
+	} else if rl.requireKey && !rl.fromUI(r) {
+		return "bad_api_key", 0
+	} else {
+		bucket = "ip:" + rl.requestIP(r)
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if usage != nil {
+		usage.Requests++
+	}
+	if rate <= 0 {
+		return "", 0
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	now := time.Now()
+	b, ok := rl.buckets[bucket]
+	if !ok {
+		rl.forgetIdle(now)
+		b = &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+		rl.buckets[bucket] = b
+	}
+	if ok, wait := b.take(now); !ok {
+		if usage != nil {
+			usage.RateLimited++
+		}
+		return "rate_limited", wait
+	}
+	return "", 0
+}
+
+// uiToken is the value of the uiCookie for the client making r, until
+// expires.
+func (rl *rateLimiter) uiToken(r *http.Request, expires int64) string {
+	mac := hmac.New(sha256.New, rl.uiSecret)
+	fmt.Fprintf(mac, "%s|%d", rl.requestIP(r), expires)
+	return strconv.FormatInt(expires, 10) + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// fromUI reports whether a request carries a current cookie from the
+// search page.
+func (rl *rateLimiter) fromUI(r *http.Request) bool {
+	if rl.uiSecret == nil {
+		return false
+	}
+	c, err := r.Cookie(uiCookie)
+	if err != nil {
+		return false
+	}
+	i := strings.Index(c.Value, ".")
+	if i < 0 {
+		return false
+	}
+	expires, err := strconv.ParseInt(c.Value[:i], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(c.Value), []byte(rl.uiToken(r, expires)))
+}
+
+// setUICookie lets the web UI on the page being served make API
+// requests without a key.
+func (rl *rateLimiter) setUICookie(w http.ResponseWriter, r *http.Request) {
+	if rl == nil || rl.uiSecret == nil {
+		return
+	}
+	expires := time.Now().Add(uiCookieTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     uiCookie,
+		Value:    rl.uiToken(r, expires.Unix()),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+	})
+}
+
+// keyLimits returns the rate and burst allowed to key.
+func (rl *rateLimiter) keyLimits(key *apiKey) (float64, int) {
+	if key.rate != 0 {
+		return key.rate, key.burst
+	}
+	return rl.keyRate, rl.keyBurst
+}
+
+// takeOver carries the buckets and usage counts of prev, the limiter
+// of the config being reloaded, over to rl, so that reloading doesn't
+// hand everyone a fresh burst, along with the key for the web UI's
+// cookies. Buckets take on rl's limits, and those of keys that rl
+// doesn't know are dropped.
+func (rl *rateLimiter) takeOver(prev *rateLimiter) {
+	if rl == nil || prev == nil {
+		return
+	}
+	if rl.uiSecret != nil && prev.uiSecret != nil {
+		rl.uiSecret = prev.uiSecret
+	}
+	byName := make(map[string]*apiKey, len(rl.keys))
+	for _, k := range rl.keys {
+		byName[k.name] = k
+	}
+	prev.mu.Lock()
+	defer prev.mu.Unlock()
+	for name, u := range prev.usage {
+		if cur, ok := rl.usage[name]; ok {
+			*cur = *u
+		}
+	}
+	for name, b := range prev.buckets {
+		rate, burst := rl.ipRate, rl.ipBurst
+		if strings.HasPrefix(name, "key:") {
+			key := byName[strings.TrimPrefix(name, "key:")]
+			if key == nil {
+				continue
+			}
+			rate, burst = rl.keyLimits(key)
+		}
+		if rate <= 0 {
+			continue
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		c := *b
+		c.rate, c.burst = rate, float64(burst)
+		c.tokens = math.Min(c.tokens, c.burst)
+		rl.buckets[name] = &c
+	}
+}
+
+func (rl *rateLimiter) forgetIdle(now time.Time) {
+	if len(rl.buckets) < maxIdleBuckets {
+		return
+	}
+	for name, b := range rl.buckets {
+		if b.refill(now); b.tokens >= b.burst {
+			delete(rl.buckets, name)
+		}
+	}
+}
+
+func (rl *rateLimiter) stats() map[string]keyUsage {
+	if rl == nil {
+		return nil
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	out := make(map[string]keyUsage, len(rl.usage))
+	for name, u := range rl.usage {
+		out[name] = *u
+	}
+	return out
+}
+
+// APIHandler is like Handler, but subjects requests to the API key
+// checks and rate limits.
+func (s *server) APIHandler(f func(c context.Context, w http.ResponseWriter, r *http.Request)) http.Handler {
+	if s.limiter == nil {
+		return handler(f)
+	}
+	return handler(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		switch code, retry := s.limiter.allow(r); code {
+		case "":
+			// Keep the web UI's cookie from expiring while
+			// it is in use.
+			if requestKey(r) == "" && s.limiter.fromUI(r) {
+				s.limiter.setUICookie(w, r)
+			}
+			f(ctx, w, r)
+		case "rate_limited":
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+			writeError(ctx, w, 429, code, "Too many requests; please slow down")
+		default:
+			writeError(ctx, w, 401, code, "Missing or unknown API key")
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/log"
+)
+
+// retireDelay is how long a reload waits before closing what the old
+// server used and the new one doesn't.
+var retireDelay = RequestTimeout
+
+// Reloader serves requests with a server built from the latest config.
+// Reloading builds a new server and swaps it in atomically; requests
+// already in flight finish on the old one.
+type Reloader struct {
+	load func() (*config.Config, error)
+
+	mu      sync.Mutex // held while reloading
+	current atomic.Value
+}
+
+// NewReloader returns a Reloader serving the config returned by load,
+// which is called again on every reload.
+func NewReloader(load func() (*config.Config, error)) (*Reloader, error) {
+	cfg, err := load()
+	if err != nil {
+		return nil, err
+	}
+	srv, err := newServer(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := startBlame(cfg); err != nil {
+		return nil, err
+	}
+	rl := &Reloader{load: load}
+	srv.reloader = rl
+	rl.current.Store(srv)
+	return rl, nil
+}
+
+func (rl *Reloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rl.current.Load().(*server).ServeHTTP(w, r)
+}
+
+// Reload re-reads the config and starts serving it. If anything is
+// wrong with the new config, the old one is kept.
+func (rl *Reloader) Reload() (err error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	cfg, err := rl.load()
+	if err != nil {
+		return err
+	}
+	// Bad templates make loadTemplates panic, which mustn't take
+	// down a running server.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	prev := rl.current.Load().(*server)
+	srv, err := newServer(cfg, prev)
+	if err != nil {
+		return err
+	}
+	srv.reloader = rl
+	rl.current.Store(srv)
+
+	// Blame histories take a while to load, so the new config is
+	// served while they are.
+	startBlameRefresh(cfg)
+	go func() {
+		if err := initBlame(cfg); err != nil {
+			log.Printf(context.Background(), "loading blame err=%s", err)
+		}
+	}()
+
+	// Backends the new config dropped, and an event sink it
+	// replaced, are closed once requests that might be using them
+	// are done.
+	var dropped []*Backend
+	for id, bk := range prev.bk {
+		if srv.bk[id] != bk {
+			dropped = append(dropped, bk)
+		}
+	}
+	var oldEvents EventSink
+	if prev.events != srv.events {
+		oldEvents = prev.events
+	}
+	if len(dropped) > 0 || oldEvents != nil {
+		time.AfterFunc(retireDelay, func() {
+			for _, bk := range dropped {
+				bk.Stop()
+			}
+			if oldEvents != nil {
+				oldEvents.Close()
+			}
+		})
+	}
+
+	log.Printf(context.Background(), "reloaded config backends=%d repos=%d",
+		len(srv.bk), len(srv.repos))
+	return nil
+}
+
+// hasBearerToken reports whether r carries key as a bearer token.
+func hasBearerToken(r *http.Request, key string) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(key)) == 1
+}
+
+// ServeReloadConfig reloads the config, for requests carrying the
+// admin key as a bearer token.
+func (s *server) ServeReloadConfig(w http.ResponseWriter, r *http.Request) {
+	if s.reloader == nil || s.config.AdminKey == "" {
+		http.Error(w, "404 Config reloading is not enabled", 404)
+		return
+	}
+	if !hasBearerToken(r, s.config.AdminKey) {
+		http.Error(w, "401 Bad admin key", 401)
+		return
+	}
+	if err := s.reloader.Reload(); err != nil {
+		log.Printf(context.Background(), "reloading config err=%s", err)
+		http.Error(w, fmt.Sprint("500 Reloading config: ", err), 500)
+		return
+	}
+	http.Error(w, "OK", 200)
+}
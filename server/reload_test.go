@@ -0,0 +1,145 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/livegrep/livegrep/server/config"
+)
+
+// testDocRoot makes a docroot with just enough in it for newServer.
+func testDocRoot(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "livegrep-docroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"templates/common/empty.html", "templates/opensearch.xml", "hashes.txt"} {
+		path := filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func stopped(bk *Backend) bool {
+	select {
+	case <-bk.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := testDocRoot(t)
+	defer os.RemoveAll(dir)
+	defer func(d time.Duration) { retireDelay = d }(retireDelay)
+	retireDelay = 0
+
+	cfg := &config.Config{
+		DocRoot: dir,
+		Backends: []config.Backend{
+			{Id: "a", Addr: "localhost:1"},
+			{Id: "b", Addr: "localhost:2"},
+			{Id: "c", Addr: "localhost:3"},
+		},
+		EventSink:     config.EventSink{Type: "file", Path: filepath.Join(dir, "events1")},
+		RateLimit:     config.RateLimit{PerIP: 0.001, PerIPBurst: 1},
+		SavedSearches: config.SavedSearches{Path: filepath.Join(dir, "saved.json")},
+	}
+	rl, err := NewReloader(func() (*config.Config, error) { return cfg, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := rl.current.Load().(*server)
+
+	get := func() int {
+		w := httptest.NewRecorder()
+		rl.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/saved/", nil))
+		return w.Code
+	}
+	if code := get(); code == 429 {
+		t.Errorf("expected the first request to be allowed")
+	}
+	if code := get(); code != 429 {
+		t.Errorf("expected the second request to be limited, got %d", code)
+	}
+
+	// A config that can't be used leaves the old one in place.
+	cfg = &config.Config{DocRoot: dir, EventSink: config.EventSink{Type: "bogus"}}
+	if err := rl.Reload(); err == nil {
+		t.Errorf("expected a bad config to fail to load")
+	}
+	if rl.current.Load().(*server) != prev {
+		t.Errorf("expected the old server to be kept")
+	}
+
+	cfg = &config.Config{
+		DocRoot: dir,
+		Backends: []config.Backend{
+			{Id: "a", Addr: "localhost:1"},
+			{Id: "b", Addr: "localhost:4"},
+		},
+		EventSink: config.EventSink{Type: "file", Path: filepath.Join(dir, "events2")},
+		RateLimit: config.RateLimit{PerIP: 0.001, PerIPBurst: 1},
+		SavedSearches: config.SavedSearches{
+			Path:    filepath.Join(dir, "saved.json"),
+			Mailbox: filepath.Join(dir, "mbox"),
+		},
+	}
+	if err := rl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	srv := rl.current.Load().(*server)
+	defer func() {
+		for _, bk := range srv.bk {
+			bk.Stop()
+		}
+	}()
+
+	if code := get(); code != 429 {
+		t.Errorf("expected the limit to carry over a reload, got %d", code)
+	}
+	// Saved searches in the same file stay with the one store that
+	// writes it.
+	if srv.saved != prev.saved {
+		t.Errorf("expected the saved search store to be kept")
+	} else if got := srv.saved.current().mailbox; got != cfg.SavedSearches.Mailbox {
+		t.Errorf("expected the kept store to use the new mailbox, got %q", got)
+	}
+	if srv.bk["a"] != prev.bk["a"] {
+		t.Errorf("expected backend a, whose address is unchanged, to be kept")
+	}
+	if srv.bk["b"] == prev.bk["b"] {
+		t.Errorf("expected backend b, whose address changed, to be replaced")
+	}
+
+	// What the new server doesn't use is closed.
+	deadline := time.Now().Add(5 * time.Second)
+	for !(stopped(prev.bk["b"]) && stopped(prev.bk["c"])) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !stopped(prev.bk["b"]) || !stopped(prev.bk["c"]) {
+		t.Errorf("expected the replaced and dropped backends to be stopped")
+	}
+	if stopped(srv.bk["a"]) {
+		t.Errorf("expected backend a to keep running")
+	}
+	for prev.events.Send(map[string]interface{}{}) == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if prev.events.Send(map[string]interface{}{}) == nil {
+		t.Errorf("expected the replaced event sink to be closed")
+	}
+	if err := srv.events.Send(map[string]interface{}{}); err != nil {
+		t.Errorf("expected the new event sink to work, got %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// A replica is considered unhealthy after this many consecutive
+// failures, and is only used once every healthy replica has failed.
+const maxReplicaFailures = 3
+
+var errNoReplicas = errors.New("backend has no replicas")
+
+// ReplicaHealth is what we know about whether a replica is up.
+type ReplicaHealth struct {
+	LastSuccess         time.Time
+	LastFailure         time.Time
+	LastError           string
+	ConsecutiveFailures int
+	// Latency of the most recent successful call.
+	Latency time.Duration
+}
+
+func (h ReplicaHealth) Healthy() bool {
+	return !h.LastSuccess.IsZero() && h.ConsecutiveFailures < maxReplicaFailures
+}
+
+// Replica is one of the codesearch processes serving a backend.
+type Replica struct {
+	Addr       string
+	Codesearch pb.CodeSearchClient
+
+	conn *grpc.ClientConn
+
+	mu     sync.Mutex
+	health ReplicaHealth
+}
+
+func (r *Replica) Health() ReplicaHealth {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.health
+}
+
+// record notes how a call to the replica on behalf of ctx went, and
+// reports whether the replica failed it.
+func (r *Replica) record(ctx context.Context, start time.Time, err error) bool {
+	if err != nil && ctx.Err() != nil {
+		// The caller gave up, which says nothing about the
+		// replica.
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch grpc.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Canceled:
+		// With the caller still waiting, a call that was
+		// cancelled was given up on by replicaSet.call.
+		r.health.LastFailure = time.Now()
+		r.health.LastError = err.Error()
+		r.health.ConsecutiveFailures++
+		return true
+	}
+	// Any other error came from a replica that is up, and is the
+	// caller's problem.
+	r.health.LastSuccess = time.Now()
+	r.health.ConsecutiveFailures = 0
+	r.health.Latency = time.Since(start)
+	return false
+}
+
+// replicaSet is a CodeSearchClient that sends each call to a healthy
+// replica, trying the next one if a replica fails.
+type replicaSet struct {
+	replicas []*Replica
+	next     uint32
+}
+
+// order returns the replicas in the order a call should try them:
+// the healthy ones first, round-robin, then the rest.
+func (rs *replicaSet) order() []*Replica {
+	n := len(rs.replicas)
+	first := int(atomic.AddUint32(&rs.next, 1)) % n
+	healthy := make([]*Replica, 0, n)
+	var unhealthy []*Replica
+	for i := 0; i < n; i++ {
+		r := rs.replicas[(first+i)%n]
+		if r.Health().Healthy() {
+			healthy = append(healthy, r)
+		} else {
+			unhealthy = append(unhealthy, r)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// call runs fn against each replica in turn until one doesn't fail.
+// Every replica but the last is called fail-fast, so that one that's
+// down is skipped rather than waited for, and is given up on if it
+// hasn't answered within its share of the time left, so that one that
+// hangs is too. fn must return once it has a first answer.
+func (rs *replicaSet) call(ctx context.Context, opts []grpc.CallOption, fn func(ctx context.Context, r *Replica, opts []grpc.CallOption) error) error {
+	err := errNoReplicas
+	replicas := rs.order()
+	for i, r := range replicas {
+		callCtx, callOpts := ctx, opts
+		var timer *time.Timer
+		if left := len(replicas) - i; left > 1 {
+			callOpts = append(opts[:len(opts):len(opts)], grpc.FailFast(true))
+			if deadline, ok := ctx.Deadline(); ok {
+				var cancel context.CancelFunc
+				callCtx, cancel = context.WithCancel(ctx)
+				timer = time.AfterFunc(time.Until(deadline)/time.Duration(left), cancel)
+			}
+		}
+		start := time.Now()
+		err = fn(callCtx, r, callOpts)
+		if timer != nil {
+			timer.Stop()
+		}
+		if !r.record(ctx, start, err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (rs *replicaSet) Info(ctx context.Context, in *pb.InfoRequest, opts ...grpc.CallOption) (*pb.ServerInfo, error) {
+	var out *pb.ServerInfo
+	err := rs.call(ctx, opts, func(ctx context.Context, r *Replica, opts []grpc.CallOption) (err error) {
+		out, err = r.Codesearch.Info(ctx, in, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (rs *replicaSet) Search(ctx context.Context, in *pb.Query, opts ...grpc.CallOption) (*pb.CodeSearchResult, error) {
+	var out *pb.CodeSearchResult
+	err := rs.call(ctx, opts, func(ctx context.Context, r *Replica, opts []grpc.CallOption) (err error) {
+		out, err = r.Codesearch.Search(ctx, in, opts...)
+		return err
+	})
+	return out, err
+}
+
+// StreamSearch fails over like the other calls, but a stream only
+// fails once it is read from, so the first reply is read here.
+func (rs *replicaSet) StreamSearch(ctx context.Context, in *pb.Query, opts ...grpc.CallOption) (pb.CodeSearch_StreamSearchClient, error) {
+	var out pb.CodeSearch_StreamSearchClient
+	err := rs.call(ctx, opts, func(ctx context.Context, r *Replica, opts []grpc.CallOption) error {
+		stream, err := r.Codesearch.StreamSearch(ctx, in, opts...)
+		if err != nil {
+			return err
+		}
+		first, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		out = &peekedStream{stream, first}
+		return nil
+	})
+	return out, err
+}
+
+// peekedStream is a search stream whose first reply has already been
+// read.
+type peekedStream struct {
+	pb.CodeSearch_StreamSearchClient
+	first *pb.CodeSearchResult
+}
+
+func (p *peekedStream) Recv() (*pb.CodeSearchResult, error) {
+	if first := p.first; first != nil {
+		p.first = nil
+		return first, nil
+	}
+	return p.CodeSearch_StreamSearchClient.Recv()
+}
+
+func (rs *replicaSet) Reload(ctx context.Context, in *pb.Empty, opts ...grpc.CallOption) (*pb.Empty, error) {
+	var out *pb.Empty
+	err := rs.call(ctx, opts, func(ctx context.Context, r *Replica, opts []grpc.CallOption) (err error) {
+		out, err = r.Codesearch.Reload(ctx, in, opts...)
+		return err
+	})
+	return out, err
+}
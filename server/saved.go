@@ -0,0 +1,663 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/log"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+const defaultSavedMaxMatches = 1000
+
+// savedSearch is a query that is re-run whenever its backend is
+// reindexed, so that its owner can be told about new matches.
+type savedSearch struct {
+	Id      string `json:"id"`
+	Name    string `json:"name"`
+	Query   string `json:"query"`
+	Backend string `json:"backend"`
+	// If set, new matches are POSTed here as JSON; otherwise they
+	// are appended to the configured mailbox.
+	Webhook string `json:"webhook,omitempty"`
+
+	// The user who saved the search. It runs with their access,
+	// as of the groups they were in when they last used saved
+	// searches, and is dropped once they can't see its backend.
+	Owner  string   `json:"owner,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+
+	// The index the search last ran against, and what it found
+	// there.
+	IndexTime int64     `json:"index_time"`
+	LastRun   time.Time `json:"last_run"`
+	LastError string    `json:"last_error,omitempty"`
+	Matches   []string  `json:"matches,omitempty"`
+}
+
+// savedSearchNotice is what is delivered when a saved search finds new
+// matches.
+type savedSearchNotice struct {
+	Id        string        `json:"id"`
+	Name      string        `json:"name"`
+	Query     string        `json:"query"`
+	Backend   string        `json:"backend"`
+	Owner     string        `json:"owner,omitempty"`
+	IndexTime time.Time     `json:"index_time"`
+	New       []*api.Result `json:"new"`
+	Removed   int           `json:"removed"`
+	// Set if the search stopped early, at the match limit or a
+	// timeout, so that New may be missing matches and Removed is
+	// always 0.
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+// savedSearchStore keeps the saved searches in a JSON file, of which
+// it is the only writer: a reload that keeps the file keeps the store.
+type savedSearchStore struct {
+	path   string
+	client *http.Client
+
+	// Held while searches run, so that each runs once per index.
+	running sync.Mutex
+
+	mu       sync.Mutex
+	settings *savedSearchSettings
+	searches map[string]*savedSearch
+	// Searches whose new matches are being delivered, which aren't
+	// run again until that is done.
+	delivering map[string]bool
+}
+
+// savedSearchSettings are the parts of a store's config that a reload
+// may change.
+type savedSearchSettings struct {
+	mailbox    string
+	maxMatches int32
+	// The hosts webhooks may be sent to.
+	webhookHosts map[string]bool
+}
+
+func newSavedSearchSettings(cfg *config.SavedSearches) *savedSearchSettings {
+	set := &savedSearchSettings{
+		mailbox:      cfg.Mailbox,
+		maxMatches:   cfg.MaxMatches,
+		webhookHosts: make(map[string]bool),
+	}
+	for _, h := range cfg.WebhookHosts {
+		set.webhookHosts[strings.ToLower(h)] = true
+	}
+	if set.maxMatches == 0 {
+		set.maxMatches = defaultSavedMaxMatches
+	}
+	return set
+}
+
+func newSavedSearchStore(cfg *config.SavedSearches) (*savedSearchStore, error) {
+	if cfg.Path == "" {
+		return nil, nil
+	}
+	st := &savedSearchStore{
+		path: cfg.Path,
+		// Webhooks are delivered one after another, so a slow
+		// one mustn't hold up the rest for long.
+		client:     &http.Client{Timeout: 10 * time.Second},
+		settings:   newSavedSearchSettings(cfg),
+		searches:   make(map[string]*savedSearch),
+		delivering: make(map[string]bool),
+	}
+	buf, err := ioutil.ReadFile(cfg.Path)
+	if os.IsNotExist(err) {
+		return st, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var searches []*savedSearch
+	if err := json.Unmarshal(buf, &searches); err != nil {
+		return nil, fmt.Errorf("%s: %v", cfg.Path, err)
+	}
+	for _, ss := range searches {
+		st.searches[ss.Id] = ss
+	}
+	return st, nil
+}
+
+// configure makes the store use cfg, which must name the same file.
+func (st *savedSearchStore) configure(cfg *config.SavedSearches) {
+	set := newSavedSearchSettings(cfg)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.settings = set
+}
+
+// current returns the settings the store is using.
+func (st *savedSearchStore) current() *savedSearchSettings {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.settings
+}
+
+// save writes out the store. The caller must hold st.mu.
+func (st *savedSearchStore) save() error {
+	searches := make([]*savedSearch, 0, len(st.searches))
+	for _, ss := range st.searches {
+		searches = append(searches, ss)
+	}
+	sort.Slice(searches, func(i, j int) bool { return searches[i].Id < searches[j].Id })
+	buf, err := json.MarshalIndent(searches, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write a new file and rename it into place, so that a crash
+	// never leaves a partly written store behind.
+	tmp, err := ioutil.TempFile(filepath.Dir(st.path), filepath.Base(st.path)+".")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), st.path)
+}
+
+// list returns the searches u may see: their own, or all of them if
+// authentication is disabled. The searches are copies.
+func (st *savedSearchStore) list(u *user) []*savedSearch {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	out := []*savedSearch{}
+	for _, ss := range st.searches {
+		if u == nil || ss.Owner == u.Name {
+			c := *ss
+			out = append(out, &c)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Id < out[j].Id })
+	return out
+}
+
+func (st *savedSearchStore) add(ss *savedSearch) error {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	ss.Id = hex.EncodeToString(id)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.searches[ss.Id] = ss
+	return st.save()
+}
+
+func (st *savedSearchStore) remove(u *user, id string) (bool, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	ss, ok := st.searches[id]
+	if !ok || (u != nil && ss.Owner != u.Name) {
+		return false, nil
+	}
+	delete(st.searches, id)
+	return true, st.save()
+}
+
+// forBackend returns copies of the searches of a backend.
+func (st *savedSearchStore) forBackend(id string) []*savedSearch {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var out []*savedSearch
+	for _, ss := range st.searches {
+		if ss.Backend == id {
+			c := *ss
+			out = append(out, &c)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Id < out[j].Id })
+	return out
+}
+
+// claim marks a search as being run, unless its last run is still
+// being delivered.
+func (st *savedSearchStore) claim(id string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.delivering[id] {
+		return false
+	}
+	st.delivering[id] = true
+	return true
+}
+
+// update records the outcome of a run claimed with claim, unless the
+// search has been deleted in the meantime, and releases the search.
+func (st *savedSearchStore) update(ss *savedSearch) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.delivering, ss.Id)
+	cur, ok := st.searches[ss.Id]
+	if !ok {
+		return nil
+	}
+	cur.IndexTime = ss.IndexTime
+	cur.LastRun = ss.LastRun
+	cur.LastError = ss.LastError
+	cur.Matches = ss.Matches
+	return st.save()
+}
+
+// refreshGroups records the groups u is in now on their searches,
+// which run with those groups. Groups that a proxy or OIDC provider
+// reports can only be learned from the owner's own requests.
+func (st *savedSearchStore) refreshGroups(u *user) error {
+	if u == nil {
+		return nil
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	changed := false
+	for _, ss := range st.searches {
+		if ss.Owner == u.Name && !reflect.DeepEqual(ss.Groups, u.Groups) {
+			ss.Groups = u.Groups
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return st.save()
+}
+
+// matchKeys identifies each result by its file and the text of the
+// line, so that a match isn't reported as new just because lines above
+// it moved. Repeats of the same line are numbered.
+func matchKeys(results []*api.Result) []string {
+	seen := make(map[string]int)
+	keys := make([]string, len(results))
+	for i, r := range results {
+		k := r.Tree + ":" + r.Path + ":" + r.Line
+		seen[k]++
+		keys[i] = fmt.Sprintf("%s#%d", k, seen[k])
+	}
+	return keys
+}
+
+// savedSearchRun is the outcome of running a saved search, which is
+// recorded once its notice, if any, is delivered.
+type savedSearchRun struct {
+	ss        *savedSearch
+	indexTime time.Time
+	notice    *savedSearchNotice
+	matches   []string
+	err       error
+}
+
+// runSavedSearches re-runs the saved searches of a backend that has
+// been reindexed, delivering any new matches. A search's first run
+// only records what it finds. The deliveries are made once all the
+// searches have run, so that a slow webhook doesn't hold up other
+// backends' searches.
+func (s *server) runSavedSearches(bk *Backend) {
+	for _, run := range s.searchSaved(bk) {
+		s.finishSavedSearch(run)
+	}
+}
+
+// searchSaved runs the saved searches of bk that haven't run against
+// its current index.
+func (s *server) searchSaved(bk *Backend) []*savedSearchRun {
+	s.saved.running.Lock()
+	defer s.saved.running.Unlock()
+
+	bk.I.Lock()
+	indexTime := bk.I.IndexTime
+	bk.I.Unlock()
+
+	var runs []*savedSearchRun
+	for _, ss := range s.saved.forBackend(bk.Id) {
+		if ss.IndexTime == indexTime.Unix() {
+			continue
+		}
+		ctx := context.Background()
+		if !s.ownerCanSee(ss, bk) {
+			log.Printf(ctx, "saved search id=%s dropped: %s can no longer see backend %s",
+				ss.Id, ss.Owner, bk.Id)
+			if _, err := s.saved.remove(nil, ss.Id); err != nil {
+				log.Printf(ctx, "saving saved searches err=%s", err)
+			}
+			continue
+		}
+		if !s.saved.claim(ss.Id) {
+			continue
+		}
+		run := &savedSearchRun{ss: ss, indexTime: indexTime}
+		run.notice, run.matches, run.err = s.runSavedSearch(ctx, bk, ss, indexTime)
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+// finishSavedSearch delivers the notice of a run and records it.
+func (s *server) finishSavedSearch(run *savedSearchRun) {
+	ctx := context.Background()
+	ss, err := run.ss, run.err
+	ss.LastRun = time.Now()
+	ss.LastError = ""
+	if err == nil && run.notice != nil {
+		if err = s.saved.deliver(ss, run.notice); err != nil {
+			err = fmt.Errorf("delivering: %v", err)
+		}
+	}
+	if err != nil {
+		log.Printf(ctx, "saved search id=%s err=%s", ss.Id, err)
+		ss.LastError = err.Error()
+	} else {
+		// Only now are the matches known to have been delivered;
+		// otherwise the search runs against this index again next
+		// time.
+		ss.IndexTime = run.indexTime.Unix()
+		ss.Matches = run.matches
+	}
+	if err := s.saved.update(ss); err != nil {
+		log.Printf(ctx, "saving saved searches err=%s", err)
+	}
+}
+
+// ownerCanSee reports whether the owner of ss, with the groups they
+// were last seen in, may still see any of the backend's repositories.
+func (s *server) ownerCanSee(ss *savedSearch, bk *Backend) bool {
+	if ss.Owner == "" || s.acl == nil {
+		return true
+	}
+	owner := &user{Name: ss.Owner, Groups: ss.Groups}
+	bk.I.Lock()
+	defer bk.I.Unlock()
+	if len(bk.I.Trees) == 0 {
+		return true // not known yet
+	}
+	for _, t := range bk.I.Trees {
+		if s.acl.allowed(owner, t.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// runSavedSearch runs ss, returning what to deliver if it found
+// anything new, and the matches to record once that is delivered.
+func (s *server) runSavedSearch(ctx context.Context, bk *Backend, ss *savedSearch, indexTime time.Time) (*savedSearchNotice, []string, error) {
+	q, expr, err := ParseQueryExpr(ss.Query, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	q.MaxMatches = s.saved.current().maxMatches
+	if ss.Owner != "" {
+		ctx = context.WithValue(ctx, userKey{}, &user{Name: ss.Owner, Groups: ss.Groups})
+	}
+	reply, err := s.runAPISearch(ctx, &apiSearch{backend: bk, query: q, expr: expr})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	first := ss.IndexTime == 0
+	previous := make(map[string]bool, len(ss.Matches))
+	for _, k := range ss.Matches {
+		previous[k] = true
+	}
+	notice := &savedSearchNotice{
+		Id:        ss.Id,
+		Name:      ss.Name,
+		Query:     ss.Query,
+		Backend:   ss.Backend,
+		Owner:     ss.Owner,
+		IndexTime: indexTime,
+	}
+	keys := matchKeys(reply.Results)
+	for i, k := range keys {
+		if previous[k] {
+			delete(previous, k)
+		} else {
+			notice.New = append(notice.New, reply.Results[i])
+		}
+	}
+	notice.Removed = len(previous)
+
+	// A search that stopped early may have left out matches that
+	// are still there. None are reported as removed, and those
+	// found before are still remembered, so that they aren't
+	// reported as new when found again.
+	if reason := reply.Info.ExitReason; reason == pb.SearchStats_MATCH_LIMIT.String() || reason == pb.SearchStats_TIMEOUT.String() {
+		notice.Incomplete = true
+		notice.Removed = 0
+		var kept []string
+		for k := range previous {
+			kept = append(kept, k)
+		}
+		sort.Strings(kept)
+		keys = append(keys, kept...)
+	}
+
+	if first || len(notice.New) == 0 {
+		return nil, keys, nil
+	}
+	return notice, keys, nil
+}
+
+// webhookAllowed reports whether new matches may be sent to a
+// webhook, which must be an http or https URL on one of the configured
+// hosts.
+func (st *savedSearchStore) webhookAllowed(webhook string) bool {
+	u, err := url.Parse(webhook)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	return st.current().webhookHosts[strings.ToLower(u.Hostname())]
+}
+
+func (st *savedSearchStore) deliver(ss *savedSearch, notice *savedSearchNotice) error {
+	if ss.Webhook != "" {
+		// The hosts may have been changed since the search was
+		// saved.
+		if !st.webhookAllowed(ss.Webhook) {
+			return fmt.Errorf("webhook %s is not on an allowed host", ss.Webhook)
+		}
+		buf, err := json.Marshal(notice)
+		if err != nil {
+			return err
+		}
+		resp, err := st.client.Post(ss.Webhook, "application/json", bytes.NewReader(buf))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("webhook %s: %s", ss.Webhook, resp.Status)
+		}
+		return nil
+	}
+	mailbox := st.current().mailbox
+	if mailbox == "" {
+		return nil
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	f, err := os.OpenFile(mailbox, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(mboxMessage(notice))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// mboxMessage formats a notice as a message in an mbox file.
+func mboxMessage(notice *savedSearchNotice) []byte {
+	now := time.Now()
+	to := notice.Owner
+	if to == "" {
+		to = "livegrep"
+	}
+	plural := "es"
+	if len(notice.New) == 1 {
+		plural = ""
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From livegrep %s\n", now.Format(time.ANSIC))
+	fmt.Fprintf(&b, "From: livegrep\n")
+	fmt.Fprintf(&b, "To: %s\n", to)
+	fmt.Fprintf(&b, "Date: %s\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Subject: %d new match%s for %q\n\n", len(notice.New), plural, notice.Name)
+	fmt.Fprintf(&b, "Query: %s\nBackend: %s\nIndexed: %s\n\n",
+		notice.Query, notice.Backend, notice.IndexTime.Format(time.RFC3339))
+	for _, r := range notice.New {
+		line := fmt.Sprintf("%s:%s:%d: %s", r.Tree, r.Path, r.LineNumber, r.Line)
+		if strings.HasPrefix(line, "From ") {
+			line = ">" + line
+		}
+		fmt.Fprintf(&b, "%s\n", line)
+	}
+	if notice.Removed > 0 {
+		fmt.Fprintf(&b, "\n%d earlier matches are gone.\n", notice.Removed)
+	}
+	if notice.Incomplete {
+		fmt.Fprintf(&b, "\nThe search stopped early, so there may be more new matches.\n")
+	}
+	b.WriteString("\n")
+	return b.Bytes()
+}
+
+// ServeAPISavedSearches lists the caller's saved searches.
+func (s *server) ServeAPISavedSearches(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if s.saved == nil {
+		writeError(ctx, w, 404, "not_found", "Saved searches are not enabled")
+		return
+	}
+	u := userFromContext(ctx)
+	if err := s.saved.refreshGroups(u); err != nil {
+		log.Printf(ctx, "saving saved searches err=%s", err)
+	}
+	replyJSON(ctx, w, 200, s.saved.list(u))
+}
+
+// sameOrigin reports whether a request came from one of livegrep's
+// own pages, going by its Origin header, or its Referer if a browser
+// left that out. Other sites' pages may not change saved searches.
+func sameOrigin(r *http.Request) bool {
+	from := r.Header.Get("Origin")
+	if from == "" {
+		from = r.Header.Get("Referer")
+	}
+	u, err := url.Parse(from)
+	return from != "" && err == nil && u.Host == r.Host
+}
+
+// checkSavedChange fails a request to change the saved searches unless
+// it carries an API key or comes from livegrep's own pages.
+func (s *server) checkSavedChange(ctx context.Context, w http.ResponseWriter, r *http.Request) bool {
+	if s.limiter.hasKey(r) || sameOrigin(r) {
+		return true
+	}
+	writeError(ctx, w, 403, "forbidden",
+		"Saved searches can only be changed with an API key or from livegrep itself")
+	return false
+}
+
+// ServeAPISaveSearch saves the search given by the "q" and "backend"
+// parameters, under "name". It is first run straight away, to record
+// the matches that later runs are compared against.
+func (s *server) ServeAPISaveSearch(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if s.saved == nil {
+		writeError(ctx, w, 404, "not_found", "Saved searches are not enabled")
+		return
+	}
+	if !s.checkSavedChange(ctx, w, r) {
+		return
+	}
+	ss := &savedSearch{
+		Name:    r.FormValue("name"),
+		Query:   r.FormValue("q"),
+		Backend: r.FormValue("backend"),
+		Webhook: r.FormValue("webhook"),
+	}
+	if ss.Query == "" {
+		writeError(ctx, w, 400, "bad_query", "You must specify a query to save")
+		return
+	}
+	if _, _, err := ParseQueryExpr(ss.Query, true); err != nil {
+		writeError(ctx, w, 400, "bad_query", err.Error())
+		return
+	}
+	if ss.Name == "" {
+		ss.Name = ss.Query
+	}
+	if ss.Backend == "" && len(s.bkOrder) > 0 {
+		ss.Backend = s.bkOrder[0]
+	}
+	bk, ok := s.bk[ss.Backend]
+	if !ok {
+		writeError(ctx, w, 400, "bad_backend", fmt.Sprintf("Unknown backend: %s", ss.Backend))
+		return
+	}
+	if ss.Webhook != "" && !s.saved.webhookAllowed(ss.Webhook) {
+		writeError(ctx, w, 400, "bad_webhook", "The webhook must be an http or https URL on an allowed host")
+		return
+	}
+	if u := userFromContext(ctx); u != nil {
+		ss.Owner, ss.Groups = u.Name, u.Groups
+		if err := s.saved.refreshGroups(u); err != nil {
+			log.Printf(ctx, "saving saved searches err=%s", err)
+		}
+	}
+	if err := s.saved.add(ss); err != nil {
+		writeError(ctx, w, 500, "internal_error", err.Error())
+		return
+	}
+	go s.runSavedSearches(bk)
+	replyJSON(ctx, w, 200, ss)
+}
+
+// ServeAPIDeleteSavedSearch deletes one of the caller's saved
+// searches.
+func (s *server) ServeAPIDeleteSavedSearch(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if s.saved == nil {
+		writeError(ctx, w, 404, "not_found", "Saved searches are not enabled")
+		return
+	}
+	if !s.checkSavedChange(ctx, w, r) {
+		return
+	}
+	ok, err := s.saved.remove(userFromContext(ctx), r.URL.Query().Get(":id"))
+	if err != nil {
+		writeError(ctx, w, 500, "internal_error", err.Error())
+		return
+	}
+	if !ok {
+		writeError(ctx, w, 404, "not_found", "No such saved search")
+		return
+	}
+	replyJSON(ctx, w, 200, map[string]string{})
+}
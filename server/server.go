@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"crypto/rand"
 	"fmt"
 	"html/template"
 	"io"
@@ -17,8 +18,8 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/bmizerany/pat"
-	libhoney "github.com/honeycombio/libhoney-go"
 
+	"github.com/livegrep/livegrep/server/api"
 	"github.com/livegrep/livegrep/server/config"
 	"github.com/livegrep/livegrep/server/log"
 	"github.com/livegrep/livegrep/server/reqid"
@@ -49,7 +50,19 @@ type server struct {
 	AssetHashes map[string]string
 	Layout      *template.Template
 
-	honey *libhoney.Builder
+	// reloader, if set, can replace this server with one built from
+	// a new config.
+	reloader *Reloader
+
+	events  EventSink
+	cache   *queryCache
+	metrics *serverMetrics
+	acl     *accessControl
+	limiter *rateLimiter
+	saved   *savedSearchStore
+
+	// cursorKey signs the cursors of paginated searches.
+	cursorKey []byte
 
 	serveFilePathRegex *regexp.Regexp
 }
@@ -82,6 +95,7 @@ func (s *server) ServeRoot(ctx context.Context, w http.ResponseWriter, r *http.R
 }
 
 func (s *server) ServeSearch(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	s.limiter.setUICookie(w, r)
 	urls := make(map[string]map[string]string, len(s.bk))
 	backends := make([]*Backend, 0, len(s.bk))
 	sampleRepo := ""
@@ -92,6 +106,9 @@ func (s *server) ServeSearch(ctx context.Context, w http.ResponseWriter, r *http
 		m := make(map[string]string, len(bk.I.Trees))
 		urls[bk.Id] = m
 		for _, r := range bk.I.Trees {
+			if !s.canSee(ctx, r.Name) {
+				continue
+			}
 			if sampleRepo == "" {
 				sampleRepo = r.Name
 			}
@@ -100,12 +117,26 @@ func (s *server) ServeSearch(ctx context.Context, w http.ResponseWriter, r *http
 		bk.I.Unlock()
 	}
 
+	repos := make(map[string]config.RepoConfig, len(s.repos))
+	for name, repo := range s.repos {
+		if s.canSee(ctx, name) {
+			repos[name] = repo
+		}
+	}
+	var defaultRepos []string
+	for _, name := range s.config.DefaultSearchRepos {
+		if s.canSee(ctx, name) {
+			defaultRepos = append(defaultRepos, name)
+		}
+	}
+
 	script_data := &struct {
 		RepoUrls           map[string]map[string]string `json:"repo_urls"`
 		InternalViewRepos  map[string]config.RepoConfig `json:"internal_view_repos"`
 		DefaultSearchRepos []string                     `json:"default_search_repos"`
 		LinkConfigs        []config.LinkConfig          `json:"link_configs"`
-	}{urls, s.repos, s.config.DefaultSearchRepos, s.config.LinkConfigs}
+		Permalinks         bool                         `json:"permalinks"`
+	}{urls, repos, defaultRepos, s.config.LinkConfigs, s.config.Permalinks.Dir != ""}
 
 	s.renderPage(ctx, w, r, "index.html", &page{
 		Title:         "code search",
@@ -145,6 +176,10 @@ func (s *server) ServeFile(ctx context.Context, w http.ResponseWriter, r *http.R
 		http.Error(w, "No such repo", 404)
 		return
 	}
+	if !s.canSee(ctx, repo.Name) {
+		http.Error(w, "403 Forbidden", 403)
+		return
+	}
 
 	h := getHistory(repo.Name).Hashes
 	head := h[len(h)-1]
@@ -186,6 +221,11 @@ func (s *server) ServeFile(ctx context.Context, w http.ResponseWriter, r *http.R
 		http.Error(w, fmt.Sprint("500 Error reading file: ", err), 500)
 		return
 	}
+	s.sendEvent(ctx, "view", map[string]interface{}{
+		"repo":   repo.Name,
+		"path":   path,
+		"commit": commit,
+	})
 
 	script_data := &struct {
 		RepoInfo config.RepoConfig `json:"repo_info"`
@@ -222,9 +262,13 @@ func (s *server) ServeLog(ctx context.Context, w http.ResponseWriter, r *http.Re
 		http.Error(w, "No such repo", 404)
 		return
 	}
+	if !s.canSee(ctx, repo.Name) {
+		http.Error(w, "403 Forbidden", 403)
+		return
+	}
 
-	gitHistory, ok := histories[repo.Name]
-	if !ok {
+	gitHistory := getHistory(repo.Name)
+	if gitHistory == nil {
 		http.Error(w, "Repo not configued for log", 404)
 		return
 	}
@@ -263,9 +307,13 @@ func (s *server) ServeBlame(ctx context.Context, w http.ResponseWriter, r *http.
 		http.Error(w, "No such repo", 404)
 		return
 	}
+	if !s.canSee(ctx, repo.Name) {
+		http.Error(w, "403 Forbidden", 403)
+		return
+	}
 
-	gitHistory, ok := histories[repo.Name]
-	if !ok {
+	gitHistory := getHistory(repo.Name)
+	if gitHistory == nil {
 		http.Error(w, "Repo not configured for blame", 404)
 		return
 	}
@@ -302,6 +350,11 @@ func (s *server) ServeBlame(ctx context.Context, w http.ResponseWriter, r *http.
 		http.Error(w, err.Error(), 404)
 		return
 	}
+	s.sendEvent(ctx, "blame", map[string]interface{}{
+		"repo":   repo.Name,
+		"path":   path,
+		"commit": hash,
+	})
 	s.renderPageCasual(ctx, w, r, "blamefile.html", map[string]interface{}{
 		"repo":       repo,
 		"path":       path,
@@ -311,6 +364,85 @@ func (s *server) ServeBlame(ctx context.Context, w http.ResponseWriter, r *http.
 	})
 }
 
+// ServeAPIBlame returns the blame of a file as JSON: for each line,
+// the commit that wrote it and the one that next changes it. A hash of
+// "HEAD" is resolved as it is for the blame page.
+func (s *server) ServeAPIBlame(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	repoName, hash, err := s.parseBlameURL(r)
+	if err != nil {
+		writeError(ctx, w, 404, "not_found", err.Error())
+		return
+	}
+	repo, ok := s.repos[repoName]
+	if !ok || !s.canSee(ctx, repoName) {
+		writeError(ctx, w, 404, "not_found", "No such repo")
+		return
+	}
+	gitHistory := getHistory(repo.Name)
+	if gitHistory == nil {
+		writeError(ctx, w, 404, "not_found", "Repo not configured for blame")
+		return
+	}
+	path := strings.TrimSuffix(pat.Tail("/api/v1/blame/:repo/:hash/", r.URL.Path), "/")
+	if path == "" {
+		writeError(ctx, w, 400, "bad_path", "You must specify a file to blame")
+		return
+	}
+
+	data := BlameData{}
+	if err := resolveCommit(repo, hash, path, &data); err != nil {
+		writeError(ctx, w, 404, "not_found", "No such commit")
+		return
+	}
+	if err := buildBlameData(repo, data.CommitHash, gitHistory, path, &data); err != nil {
+		writeError(ctx, w, 404, "not_found", err.Error())
+		return
+	}
+	s.sendEvent(ctx, "blame", map[string]interface{}{
+		"repo":   repo.Name,
+		"path":   path,
+		"commit": data.CommitHash,
+	})
+
+	reply := &api.ReplyBlame{
+		Repo: repo.Name,
+		Path: path,
+		Commit: &api.BlameCommit{
+			Hash:    data.CommitHash,
+			Author:  data.Author,
+			Date:    data.Date,
+			Subject: data.Subject,
+			Body:    data.Body,
+		},
+		PreviousCommit: data.PreviousCommit,
+		NextCommit:     data.NextCommit,
+		Lines:          make([]*api.BlameLine, len(data.Lines)),
+	}
+	for i, l := range data.Lines {
+		line := &api.BlameLine{
+			LineNumber:         l.OldLineNumber,
+			PreviousCommit:     l.PreviousCommit.Hash,
+			PreviousLineNumber: l.PreviousLineNumber,
+			Author:             l.PreviousCommit.Author,
+			Date:               blameDate(l.PreviousCommit.Date),
+		}
+		if l.NextCommit.Hash != "" {
+			line.NextCommit = l.NextCommit.Hash
+			line.NextLineNumber = l.NextLineNumber
+		}
+		reply.Lines[i] = line
+	}
+	replyJSON(ctx, w, 200, reply)
+}
+
+// blameDate formats a blameworthy date, which is a YYYYMMDD number.
+func blameDate(date int32) string {
+	if date == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%04d-%02d-%02d", date/10000, date%10000/100, date%100)
+}
+
 func (s *server) ServeDiff(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	if len(s.repos) == 0 {
 		http.Error(w, "404 Repository browsing not enabled", 404)
@@ -323,6 +455,10 @@ func (s *server) ServeDiff(ctx context.Context, w http.ResponseWriter, r *http.R
 		http.Error(w, "404 No such repository", 404)
 		return
 	}
+	if !s.canSee(ctx, repo.Name) {
+		http.Error(w, "403 Forbidden", 403)
+		return
+	}
 	rest := pat.Tail("/diff/:repo/:hash/", r.URL.Path)
 	if len(rest) > 0 && rest != "message" {
 		diffRedirect(w, r, repoName, hash, rest)
@@ -359,6 +495,10 @@ func (s *server) ServeDiff(ctx context.Context, w http.ResponseWriter, r *http.R
 		http.Error(w, err.Error(), 404)
 		return
 	}
+	s.sendEvent(ctx, "diff", map[string]interface{}{
+		"repo":   repo.Name,
+		"commit": hash,
+	})
 
 	s.renderPageCasual(ctx, w, r, "blamediff.html", map[string]interface{}{
 		"repo":       repo,
@@ -381,21 +521,53 @@ func (s *server) ServeHelp(ctx context.Context, w http.ResponseWriter, r *http.R
 }
 
 func (s *server) ServeHealthcheck(w http.ResponseWriter, r *http.Request) {
-	// All backends must have (at some point) reported an index age for us to
-	// report as healthy.
-	// TODO: report as unhealthy if a backend goes down after we've spoken to
-	// it.
-	for _, bk := range s.bk {
-		if bk.I.IndexTime.IsZero() {
-			http.Error(w, fmt.Sprintf("unhealthy backend '%s' '%s'\n", bk.Id, bk.Addr), 500)
-			return
+	// All backends must have (at some point) reported an index age,
+	// and still have a replica that is up, for us to report as
+	// healthy. The state of every replica follows.
+	var report bytes.Buffer
+	healthy := true
+	for _, id := range s.bkOrder {
+		bk := s.bk[id]
+		bk.I.Lock()
+		indexed := !bk.I.IndexTime.IsZero()
+		bk.I.Unlock()
+		if !indexed || !bk.Healthy() {
+			healthy = false
+			fmt.Fprintf(&report, "unhealthy backend '%s' '%s'\n", bk.Id, bk.Addr)
+		}
+		for _, rep := range bk.Replicas {
+			h := rep.Health()
+			state := "up"
+			if !h.Healthy() {
+				state = "down"
+			}
+			fmt.Fprintf(&report, "  %s %s: %s failures=%d latency=%s last_success=%s",
+				bk.Id, rep.Addr, state, h.ConsecutiveFailures, h.Latency, formatHealthTime(h.LastSuccess))
+			if h.LastError != "" {
+				fmt.Fprintf(&report, " last_error=%q", h.LastError)
+			}
+			report.WriteString("\n")
 		}
 	}
+	if !healthy {
+		http.Error(w, report.String(), 500)
+		return
+	}
 	io.WriteString(w, "ok\n")
+	report.WriteTo(w)
+}
+
+func formatHealthTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.RFC3339)
 }
 
 type stats struct {
-	IndexAge int64 `json:"index_age"`
+	IndexAge   int64               `json:"index_age"`
+	QueryCache *cacheStats         `json:"query_cache,omitempty"`
+	APIKeys    map[string]keyUsage `json:"api_keys,omitempty"`
 }
 
 func (s *server) ReloadIndexes(ctx context.Context, w http.ResponseWriter, r *http.Request) {
@@ -423,7 +595,9 @@ func (s *server) ServeStats(ctx context.Context, w http.ResponseWriter, r *http.
 		}
 	}
 	replyJSON(ctx, w, 200, &stats{
-		IndexAge: int64(maxBkAge / time.Second),
+		IndexAge:   int64(maxBkAge / time.Second),
+		QueryCache: s.cache.stats(),
+		APIKeys:    s.limiter.stats(),
 	})
 }
 
@@ -541,6 +715,9 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(ctx, RequestTimeout)
 	defer cancel()
 	ctx = reqid.NewContext(ctx, reqid.New())
+	if u := r.Context().Value(userKey{}); u != nil {
+		ctx = context.WithValue(ctx, userKey{}, u)
+	}
 	log.Printf(ctx, "http request: remote=%q method=%q url=%q",
 		r.RemoteAddr, r.Method, r.URL)
 	h(ctx, w, r)
@@ -551,6 +728,35 @@ func (s *server) Handler(f func(c context.Context, w http.ResponseWriter, r *htt
 }
 
 func New(cfg *config.Config) (http.Handler, error) {
+	srv, err := newServer(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := startBlame(cfg); err != nil {
+		return nil, err
+	}
+	return srv, nil
+}
+
+// startBlame loads the blame histories that cfg names, and starts
+// keeping them up to date.
+func startBlame(cfg *config.Config) error {
+	if err := initBlame(cfg); err != nil {
+		ctx := context.Background()
+		log.Printf(ctx, "Error: %s", err)
+		return err
+	}
+	startBlameRefresh(cfg)
+	return nil
+}
+
+// newServer builds a server for cfg. If prev is set, the new server
+// takes over whatever of prev's state cfg leaves unchanged: backends
+// with the same addresses, the query cache, saved searches, the event
+// sink, metrics, the rate limiter's counts, and the key that cursors
+// are signed with. Blame histories are
+// left to the caller, once the server is in use.
+func newServer(cfg *config.Config, prev *server) (_ *server, err error) {
 	srv := &server{
 		config: cfg,
 		bk:     make(map[string]*Backend),
@@ -558,28 +764,60 @@ func New(cfg *config.Config) (http.Handler, error) {
 	}
 	srv.loadTemplates()
 
-	if err := initBlame(cfg); err != nil {
-		ctx := context.Background()
-		log.Printf(ctx, "Error: %s", err)
+	if prev != nil && prev.config.EventSink == cfg.EventSink && prev.config.Honeycomb == cfg.Honeycomb {
+		srv.events = prev.events
+	} else if srv.events, err = newEventSink(cfg); err != nil {
 		return nil, err
+	} else if srv.events != nil {
+		// A new sink is closed again if the server can't be built.
+		defer func() {
+			if err != nil {
+				srv.events.Close()
+			}
+		}()
 	}
 
-	if cfg.Honeycomb.WriteKey != "" {
-		log.Printf(context.Background(),
-			"Enabling honeycomb dataset=%s", cfg.Honeycomb.Dataset)
-		srv.honey = libhoney.NewBuilder()
-		srv.honey.WriteKey = cfg.Honeycomb.WriteKey
-		srv.honey.Dataset = cfg.Honeycomb.Dataset
+	auth, err := newAuthenticator(&cfg.Auth)
+	if err != nil {
+		return nil, err
+	}
+	srv.acl, err = newAccessControl(&cfg.Auth)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, bk := range srv.config.Backends {
-		be, e := NewBackend(bk.Id, bk.Addr)
-		if e != nil {
-			return nil, e
+	srv.limiter, err = newRateLimiter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if prev != nil {
+		srv.limiter.takeOver(prev.limiter)
+		srv.cursorKey = prev.cursorKey
+	} else {
+		srv.cursorKey = make([]byte, 32)
+		if _, err := rand.Read(srv.cursorKey); err != nil {
+			return nil, err
 		}
-		be.Start()
-		srv.bk[be.Id] = be
-		srv.bkOrder = append(srv.bkOrder, be.Id)
+	}
+
+	// Only one store may write the file, so one that's still used
+	// is kept, to take on the new settings once the server is built.
+	if prev != nil && prev.saved != nil && prev.saved.path == cfg.SavedSearches.Path {
+		srv.saved = prev.saved
+		defer func() {
+			if err == nil {
+				srv.saved.configure(&cfg.SavedSearches)
+			}
+		}()
+	} else if srv.saved, err = newSavedSearchStore(&cfg.SavedSearches); err != nil {
+		return nil, err
+	}
+
+	if prev != nil && prev.config.QueryCache == cfg.QueryCache {
+		srv.cache = prev.cache
+	} else {
+		srv.cache = newQueryCache(cfg.QueryCache.Size,
+			time.Duration(cfg.QueryCache.TTLSeconds)*time.Second)
 	}
 
 	var repoNames []string
@@ -594,32 +832,93 @@ func New(cfg *config.Config) (http.Handler, error) {
 	}
 	srv.serveFilePathRegex = serveFilePathRegex
 
+	var started []*Backend
+	for _, bk := range srv.config.Backends {
+		addrs := bk.Addresses()
+		var be *Backend
+		if prev != nil {
+			if old := prev.bk[bk.Id]; old != nil && old.Addr == strings.Join(addrs, ",") {
+				be = old
+			}
+		}
+		if be == nil {
+			var e error
+			if be, e = NewBackend(bk.Id, addrs...); e != nil {
+				for _, be := range started {
+					be.Stop()
+				}
+				return nil, e
+			}
+			be.Start()
+			started = append(started, be)
+		}
+		srv.bk[be.Id] = be
+		srv.bkOrder = append(srv.bkOrder, be.Id)
+	}
+	for _, be := range srv.bk {
+		be.I.Lock()
+		be.cache = srv.cache
+		be.onReindex = nil
+		if srv.saved != nil {
+			be.onReindex = srv.runSavedSearches
+		}
+		be.I.Unlock()
+	}
+
+	if prev != nil {
+		srv.metrics = prev.metrics
+		srv.metrics.setServer(srv)
+	} else {
+		srv.metrics = newServerMetrics(srv)
+	}
+
 	m := pat.New()
-	m.Add("GET", "/log/:repo/", srv.Handler(srv.ServeLog))
-	m.Add("GET", "/blame/:repo/:hash/", srv.Handler(srv.ServeBlame))
-	m.Add("GET", "/diff/:repo/:hash/", srv.Handler(srv.ServeDiff))
+	m.Add("GET", "/log/:repo/", srv.Handler(srv.instrument("log", srv.ServeLog)))
+	m.Add("GET", "/blame/:repo/:hash/", srv.Handler(srv.instrument("blame", srv.ServeBlame)))
+	m.Add("GET", "/diff/:repo/:hash/", srv.Handler(srv.instrument("diff", srv.ServeDiff)))
 	m.Add("GET", "/debug/healthcheck", http.HandlerFunc(srv.ServeHealthcheck))
 	m.Add("GET", "/debug/reload-indexes", srv.Handler(srv.ReloadIndexes))
+	m.Add("POST", "/debug/reload-config", http.HandlerFunc(srv.ServeReloadConfig))
 	m.Add("GET", "/debug/stats", srv.Handler(srv.ServeStats))
+	m.Add("GET", "/debug/metrics", srv.Handler(srv.ServeMetrics))
 	m.Add("GET", "/search/:backend", srv.Handler(srv.ServeSearch))
 	m.Add("GET", "/search/", srv.Handler(srv.ServeSearch))
-	m.Add("GET", "/view/", srv.Handler(srv.ServeFile))
+	m.Add("GET", "/view/", srv.Handler(srv.instrument("view", srv.ServeFile)))
+	// Making a permalink runs a search, so it is limited like one.
+	m.Add("GET", "/permalink/new/:backend", srv.APIHandler(srv.ServeNewPermalink))
+	m.Add("GET", "/permalink/new/", srv.APIHandler(srv.ServeNewPermalink))
+	m.Add("GET", "/permalink/:id", srv.Handler(srv.ServePermalink))
 	m.Add("GET", "/about", srv.Handler(srv.ServeAbout))
 	m.Add("GET", "/help", srv.Handler(srv.ServeHelp))
 	m.Add("GET", "/opensearch.xml", srv.Handler(srv.ServeOpensearch))
 	m.Add("GET", "/", srv.Handler(srv.ServeRoot))
 
-	m.Add("GET", "/api/v1/search/:backend", srv.Handler(srv.ServeAPISearch))
-	m.Add("GET", "/api/v1/search/", srv.Handler(srv.ServeAPISearch))
+	m.Add("GET", "/api/v1/search/stream/:backend", srv.APIHandler(srv.instrument("search_stream", srv.ServeAPISearchStream)))
+	m.Add("GET", "/api/v1/search/stream/", srv.APIHandler(srv.instrument("search_stream", srv.ServeAPISearchStream)))
+	m.Add("GET", "/api/v1/search/:backend", srv.APIHandler(srv.instrument("search", srv.ServeAPISearch)))
+	m.Add("GET", "/api/v1/search/", srv.APIHandler(srv.instrument("search", srv.ServeAPISearch)))
+	m.Add("GET", "/api/v1/export/:backend", srv.APIHandler(srv.instrument("export", srv.ServeAPIExport)))
+	m.Add("GET", "/api/v1/export/", srv.APIHandler(srv.instrument("export", srv.ServeAPIExport)))
+	m.Add("GET", "/api/v1/blame/:repo/:hash/", srv.APIHandler(srv.instrument("blame_api", srv.ServeAPIBlame)))
+	m.Add("GET", "/api/v1/permalink/:id", srv.APIHandler(srv.ServeAPIPermalink))
+	m.Add("GET", "/api/v1/saved/", srv.APIHandler(srv.ServeAPISavedSearches))
+	m.Add("POST", "/api/v1/saved/", srv.APIHandler(srv.ServeAPISaveSearch))
+	m.Add("DELETE", "/api/v1/saved/:id", srv.APIHandler(srv.ServeAPIDeleteSavedSearch))
 
 	var h http.Handler = m
 
 	if cfg.Reload {
 		h = &reloadHandler{srv, h}
 	}
+	if auth != nil {
+		h = &authHandler{auth, srv.limiter, h}
+	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/assets/", http.FileServer(http.Dir(path.Join(cfg.DocRoot, "htdocs"))))
+	if cfg.MetricsKey != "" {
+		mux.HandleFunc("/debug/metrics", srv.ServeMetricsWithKey)
+	}
 	mux.Handle("/", h)
 
 	srv.inner = mux
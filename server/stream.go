@@ -0,0 +1,305 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/jsonframe"
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/log"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+var streamMarshaler = api.NewStreamMarshaler()
+
+// frameWriter writes jsonframe frames to an HTTP response, either as
+// newline-delimited JSON or as Server-Sent Events whose event name is
+// the frame's opcode, flushing after every frame.
+type frameWriter struct {
+	w   http.ResponseWriter
+	sse bool
+}
+
+func (fw *frameWriter) write(op jsonframe.Op) error {
+	buf, err := streamMarshaler.Marshal(op)
+	if err != nil {
+		return err
+	}
+	if fw.sse {
+		_, err = fmt.Fprintf(fw.w, "event: %s\ndata: %s\n\n", op.Opcode(), buf)
+	} else {
+		_, err = fmt.Fprintf(fw.w, "%s\n", buf)
+	}
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return err
+}
+
+// searchPart is part of the reply to a streamed search: some results,
+// as a backend finds them, or, once a search is done, its stats or
+// error.
+type searchPart struct {
+	backend *Backend // set if the search is fanned out
+	reply   *api.ReplySearch
+	done    bool
+	err     error
+}
+
+// startSearch runs search in the background, sending its reply in
+// parts as the backends find results. It returns how many parts will
+// be done. The search is abandoned once ctx is cancelled, as it must be
+// if the caller stops reading parts before then.
+func (s *server) startSearch(ctx context.Context, search *apiSearch) (<-chan searchPart, int) {
+	parts := make(chan searchPart)
+	send := func(part searchPart) error {
+		select {
+		case parts <- part:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if search.expr != nil {
+		go func() {
+			reply, err := s.runAPISearch(ctx, search)
+			send(searchPart{reply: reply, done: true, err: err})
+		}()
+		return parts, 1
+	}
+	fanOut := search.backends != nil
+	backends := search.backends
+	if !fanOut {
+		backends = []*Backend{search.backend}
+	}
+	q := &search.query
+	for _, backend := range backends {
+		go func(backend *Backend) {
+			part := searchPart{done: true}
+			if fanOut {
+				part.backend = backend
+			}
+			info, err := s.doStreamSearch(ctx, backend, q, func(reply *api.ReplySearch) error {
+				return send(searchPart{backend: part.backend, reply: reply})
+			})
+			part.reply = &api.ReplySearch{Info: info}
+			part.err = err
+			send(part)
+		}(backend)
+	}
+	return parts, len(backends)
+}
+
+// fairLimit holds the results of one kind that a search streams to
+// limit, divided between its backends as limitResults divides them,
+// while the backends are still finding them. Each backend may pass an
+// even share of the limit at once; what it finds beyond that is held
+// back until every backend is done, and then given the shares that
+// other backends didn't use.
+type fairLimit struct {
+	limit  int
+	share  int
+	ids    []string
+	passed map[string]int
+	held   map[string][]interface{}
+}
+
+func newFairLimit(limit, backends int) *fairLimit {
+	return &fairLimit{
+		limit:  limit,
+		share:  limit / backends,
+		passed: make(map[string]int),
+		held:   make(map[string][]interface{}),
+	}
+}
+
+// admit reports whether res, found by the backend with the given id,
+// may be written now. If not, it is held back for rest.
+func (l *fairLimit) admit(id string, res interface{}) bool {
+	if l.limit <= 0 {
+		return true
+	}
+	if _, ok := l.passed[id]; !ok {
+		l.ids = append(l.ids, id)
+		l.passed[id] = 0
+	}
+	if l.passed[id] < l.share {
+		l.passed[id]++
+		return true
+	}
+	l.held[id] = append(l.held[id], res)
+	return false
+}
+
+// rest returns the held back results that fit within the limit, once
+// every backend is done, and whether any had to be dropped.
+func (l *fairLimit) rest() ([]interface{}, bool) {
+	counts := make([]int, len(l.ids))
+	for i, id := range l.ids {
+		counts[i] = l.passed[id] + len(l.held[id])
+	}
+	var rest []interface{}
+	dropped := false
+	for i, share := range fairShares(counts, l.limit) {
+		id := l.ids[i]
+		held := l.held[id]
+		if n := share - l.passed[id]; n < len(held) {
+			held = held[:n]
+			dropped = true
+		}
+		rest = append(rest, held...)
+	}
+	return rest, dropped
+}
+
+// ServeAPISearchStream runs a search like ServeAPISearch, but writes
+// each result as its own frame as soon as a backend finds it, followed
+// by a final "stats" frame. The limit on results is divided between
+// the backends of a fanned out search, so results a backend finds
+// beyond its even share wait until the others are done. Boolean
+// queries can only be evaluated as a whole, so their results are
+// written once every term has been searched.
+func (s *server) ServeAPISearchStream(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	search := s.parseAPISearch(ctx, w, r)
+	if search == nil {
+		return
+	}
+	if search.cursor != nil {
+		writeError(ctx, w, 400, "bad_query", "Streamed searches cannot be paginated")
+		return
+	}
+
+	fw := &frameWriter{w: w}
+	if r.URL.Query().Get("format") == "sse" ||
+		strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		fw.sse = true
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.WriteHeader(200)
+
+	start := time.Now()
+	q := &search.query
+	fanOut := search.backends != nil
+
+	// Cancelled when we return, so that no search is left blocked
+	// if we give up writing the stream early.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	parts, n := s.startSearch(ctx, search)
+
+	stats := &api.ReplyStats{
+		Info:       &api.Stats{ExitReason: pb.SearchStats_NONE.String()},
+		SearchType: "normal",
+	}
+	if q.FilenameOnly {
+		stats.SearchType = "filename_only"
+	}
+	if fanOut {
+		stats.BackendInfo = make(map[string]*api.Stats)
+	}
+	merged := &api.ReplySearch{Info: stats.Info}
+
+	lines := newFairLimit(int(q.MaxMatches), n)
+	files := newFairLimit(int(q.MaxMatches), n)
+	writeResult := func(res interface{}) bool {
+		var err error
+		switch res := res.(type) {
+		case *api.Result:
+			merged.Results = append(merged.Results, res)
+			err = fw.write(res)
+		case *api.FileResult:
+			merged.FileResults = append(merged.FileResults, res)
+			err = fw.write(res)
+		}
+		if err != nil {
+			log.Printf(ctx, "writing stream err=%s", err)
+			return false
+		}
+		return true
+	}
+
+	var firstErr error
+	answered := 0
+	for done := 0; done < n; {
+		part := <-parts
+		if part.done {
+			done++
+		}
+		if part.err != nil {
+			log.Printf(ctx, "error in search err=%s", part.err)
+			if firstErr == nil {
+				firstErr = part.err
+			}
+			if part.backend != nil {
+				stats.Errors = append(stats.Errors, backendError(part.backend, part.err))
+			}
+			continue
+		}
+
+		reply := part.reply
+		id := ""
+		if part.backend != nil {
+			id = part.backend.Id
+		}
+		for _, res := range reply.Results {
+			if part.backend != nil {
+				res.Backend = id
+			}
+			if lines.admit(id, res) && !writeResult(res) {
+				return
+			}
+		}
+		for _, res := range reply.FileResults {
+			if part.backend != nil {
+				res.Backend = id
+			}
+			if files.admit(id, res) && !writeResult(res) {
+				return
+			}
+		}
+		if !part.done {
+			continue
+		}
+
+		answered++
+		if part.backend != nil {
+			stats.BackendInfo[part.backend.Id] = reply.Info
+		} else {
+			stats.BackendInfo = reply.BackendInfo
+		}
+		mergeStats(stats.Info, reply.Info)
+		stats.Errors = append(stats.Errors, reply.Errors...)
+	}
+
+	if answered == 0 {
+		_, e := queryError(firstErr)
+		fw.write(&e)
+		return
+	}
+
+	for _, limit := range []*fairLimit{lines, files} {
+		rest, dropped := limit.rest()
+		for _, res := range rest {
+			if !writeResult(res) {
+				return
+			}
+		}
+		if dropped {
+			stats.Info.ExitReason = pb.SearchStats_MATCH_LIMIT.String()
+		}
+	}
+
+	stats.Info.TotalTime = int64(time.Since(start) / time.Millisecond)
+	merged.Errors = stats.Errors
+	s.recordSearch(ctx, search, merged)
+	fw.write(stats)
+}
@@ -8,6 +8,7 @@
 #ifndef CODESEARCH_H
 #define CODESEARCH_H
 
+#include <algorithm>
 #include <vector>
 #include <string>
 #include <map>
@@ -124,8 +125,24 @@ struct query {
     } negate;
 
     bool filename_only;
+
+    // Lines of context to return around each match: 0 means
+    // kDefaultContextLines, and a negative number means none. Use
+    // query_context_lines() to interpret it.
+    int32_t context_lines = 0;
 };
 
+const int kDefaultContextLines = 3;
+const int kMaxContextLines     = 100;
+
+inline int query_context_lines(const query *q) {
+    if (q->context_lines == 0)
+        return kDefaultContextLines;
+    if (q->context_lines < 0)
+        return 0;
+    return std::min(q->context_lines, kMaxContextLines);
+}
+
 class code_searcher {
 public:
     code_searcher();
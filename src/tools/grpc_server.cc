@@ -23,6 +23,7 @@
 #include <boost/bind.hpp>
 
 using grpc::ServerContext;
+using grpc::ServerWriter;
 using grpc::Status;
 using grpc::StatusCode;
 
@@ -36,8 +37,10 @@ class CodeSearchImpl final : public CodeSearch::Service {
     virtual ~CodeSearchImpl();
 
     virtual grpc::Status Info(grpc::ServerContext* context, const ::InfoRequest* request, ::ServerInfo* response);
-    void TagsFirstSearch_(::CodeSearchResult* response, query& q, match_stats& stats);
+    void TagsFirstSearch_(::CodeSearchResult* response, ServerWriter<::CodeSearchResult>* writer, query& q, match_stats& stats);
+    grpc::Status Search_(grpc::ServerContext* context, const ::Query* request, ::CodeSearchResult* response, ServerWriter<::CodeSearchResult>* writer);
     virtual grpc::Status Search(grpc::ServerContext* context, const ::Query* request, ::CodeSearchResult* response);
+    virtual grpc::Status StreamSearch(grpc::ServerContext* context, const ::Query* request, ServerWriter<::CodeSearchResult>* writer);
     virtual grpc::Status Reload(grpc::ServerContext* context, const ::Empty* request, ::Empty* response);
 
  private:
@@ -143,6 +146,7 @@ Status parse_query(query *q, const ::Query* request, ::CodeSearchResult* respons
     if (status.ok())
         status = extract_regex(&q->negate.tags_pat, "-tags", request->not_tags());
     q->filename_only = request->filename_only();
+    q->context_lines = request->context_lines();
     return status;
 }
 
@@ -158,11 +162,15 @@ class add_match {
 public:
     typedef std::set<std::pair<indexed_file*, int>> line_set;
 
-    add_match(line_set* ls, CodeSearchResult* response)
-        : unique_lines_(ls), response_(response) {}
+    // If writer is set, each result is sent as soon as it is added,
+    // rather than collected in response.
+    add_match(line_set* ls, CodeSearchResult* response,
+              ServerWriter<CodeSearchResult>* writer = nullptr)
+        : unique_lines_(ls), response_(response), writer_(writer) {}
 
     int match_count() {
-        return response_->results_size();
+        // Every result added is in the set, even once it is sent.
+        return unique_lines_->size();
     }
 
     void operator()(const match_result *m) const {
@@ -187,6 +195,7 @@ public:
         result->mutable_bounds()->set_left(m->matchleft);
         result->mutable_bounds()->set_right(m->matchright);
         result->set_line(m->line.ToString());
+        send();
     }
 
     void operator()(const file_result *f) const {
@@ -196,11 +205,22 @@ public:
         result->set_path(f->file->path);
         result->mutable_bounds()->set_left(f->matchleft);
         result->mutable_bounds()->set_right(f->matchright);
+        send();
     }
 
 private:
+    void send() const {
+        if (writer_ == nullptr)
+            return;
+        // A failed write means the client has gone away; the search
+        // still runs to the end, but there's no one to tell.
+        writer_->Write(*response_);
+        response_->Clear();
+    }
+
     line_set* unique_lines_;
     CodeSearchResult* response_;
+    ServerWriter<CodeSearchResult>* writer_;
 };
 
 static void run_tags_search(const query& main_query, std::string regex,
@@ -215,6 +235,7 @@ static void run_tags_search(const query& main_query, std::string regex,
     // (unfortunately, we can't construct a line query that checks these)
     query constraints;
     constraints.line_pat = main_query.line_pat;  // tell it what to highlight
+    constraints.context_lines = main_query.context_lines;
     constraints.negate.file_pat.swap(q.negate.file_pat);
     constraints.negate.tags_pat.swap(q.negate.tags_pat);
 
@@ -238,13 +259,13 @@ static std::string pat(const std::shared_ptr<RE2> &p) {
     return p->pattern();
 }
 
-void CodeSearchImpl::TagsFirstSearch_(::CodeSearchResult* response, query& q, match_stats& stats) {
+void CodeSearchImpl::TagsFirstSearch_(::CodeSearchResult* response, ServerWriter<::CodeSearchResult>* writer, query& q, match_stats& stats) {
     string line_pat = q.line_pat->pattern();
     string regex;
     int32_t original_max_matches = q.max_matches;  // remember original value
 
     add_match::line_set ls;
-    add_match cb(&ls, response);
+    add_match cb(&ls, response, writer);
 
     /* To surface the most important matches first, start with tags.
        First pass: is the pattern an exact match for any tags? */
@@ -272,6 +293,21 @@ void CodeSearchImpl::TagsFirstSearch_(::CodeSearchResult* response, query& q, ma
 }
 
 Status CodeSearchImpl::Search(ServerContext* context, const ::Query* request, ::CodeSearchResult* response) {
+    return Search_(context, request, response, nullptr);
+}
+
+Status CodeSearchImpl::StreamSearch(ServerContext* context, const ::Query* request, ServerWriter<::CodeSearchResult>* writer) {
+    CodeSearchResult response;
+    Status st = Search_(context, request, &response, writer);
+    if (!st.ok())
+        return st;
+    // Everything else has been sent; this is just the stats.
+    writer->Write(response);
+    return Status::OK;
+}
+
+Status CodeSearchImpl::Search_(ServerContext* context, const ::Query* request, ::CodeSearchResult* response,
+                               ServerWriter<::CodeSearchResult>* writer) {
     WidthWalker width;
 
     scoped_trace_id trace(trace_id_from_request(context));
@@ -290,7 +326,8 @@ Status CodeSearchImpl::Search(ServerContext* context, const ::Query* request, ::
 
     log(q.trace_id,
         "processing query line='%s' file='%s' tree='%s' tags='%s' "
-        "not_file='%s' not_tree='%s' not_tags='%s' max_matches='%d'",
+        "not_file='%s' not_tree='%s' not_tags='%s' max_matches='%d' "
+        "context_lines='%d'",
         pat(q.line_pat).c_str(),
         pat(q.file_pat).c_str(),
         pat(q.tree_pat).c_str(),
@@ -298,7 +335,8 @@ Status CodeSearchImpl::Search(ServerContext* context, const ::Query* request, ::
         pat(q.negate.file_pat).c_str(),
         pat(q.negate.tree_pat).c_str(),
         pat(q.negate.tags_pat).c_str(),
-        q.max_matches);
+        q.max_matches,
+        q.context_lines);
 
     if (q.line_pat->ProgramSize() > kMaxProgramSize) {
         log("program too large size=%d", q.line_pat->ProgramSize());
@@ -330,13 +368,13 @@ Status CodeSearchImpl::Search(ServerContext* context, const ::Query* request, ::
 
     match_stats stats;
     if (q.tags_pat == NULL && tagdata_ && might_match_tags) {
-        CodeSearchImpl::TagsFirstSearch_(response, q, stats);
+        CodeSearchImpl::TagsFirstSearch_(response, writer, q, stats);
     } else if (q.tags_pat == NULL) {
         code_searcher::search_thread *search;
         if (!pool_.try_pop(&search))
             search = new code_searcher::search_thread(cs_);
         add_match::line_set ls;
-        add_match cb(&ls, response);
+        add_match cb(&ls, response, writer);
         search->match(q, cb, cb, &stats);
         pool_.push(search);
     } else {
@@ -344,7 +382,7 @@ Status CodeSearchImpl::Search(ServerContext* context, const ::Query* request, ::
             return Status(StatusCode::FAILED_PRECONDITION, "No tags file available.");
 
         add_match::line_set ls;
-        add_match cb(&ls, response);
+        add_match cb(&ls, response, writer);
         run_tags_search(q, line_pat, tagdata_, cb, tagmatch_, stats);
     }
 
@@ -27,7 +27,7 @@ var Codesearch = function() {
 
       var opts = Codesearch.in_flight;
 
-      var url = "/api/v1/search/";
+      var url = "/api/v1/search/stream/";
       if ('backend' in opts) {
         url = url + opts.backend;
       }
@@ -40,36 +40,70 @@ var Codesearch = function() {
 
       url = url + "?" + $.param(q);
 
-      var xhr = $.getJSON(url);
+      // The reply is a stream of newline-delimited JSON frames, which
+      // we hand to the delegate as they arrive.
+      var xhr = new XMLHttpRequest();
       var start = new Date();
-      xhr.done(function (data) {
-        var elapsed = new Date() - start;
-        data.results.forEach(function (r) {
-          Codesearch.delegate.match(opts.id, r);
-        });
-        data.file_results.forEach(function (r) {
-          Codesearch.delegate.file_match(opts.id, r);
+      var seen = 0;
+      var partial = "";
+      var done = false;
+      var handle_frame = function(frame) {
+        switch (frame.opcode) {
+        case "result":
+          Codesearch.delegate.match(opts.id, frame.body);
+          break;
+        case "file_result":
+          Codesearch.delegate.file_match(opts.id, frame.body);
+          break;
+        case "stats":
+          done = true;
+          var elapsed = new Date() - start;
+          Codesearch.delegate.search_done(opts.id, elapsed, frame.body.search_type, frame.body.info.why);
+          break;
+        case "error":
+          done = true;
+          Codesearch.delegate.error(opts.id, frame.body.message);
+          break;
+        }
+      };
+      var read_frames = function() {
+        if (xhr.status !== 200)
+          return;
+        partial += xhr.responseText.substring(seen);
+        seen = xhr.responseText.length;
+        var lines = partial.split("\n");
+        partial = lines.pop();
+        lines.forEach(function (line) {
+          if (line.length > 0)
+            handle_frame(JSON.parse(line));
         });
-        Codesearch.delegate.search_done(opts.id, elapsed, data.search_type, data.info.why);
-      });
-      xhr.fail(function(data) {
-        window._err = data;
-        if (data.status >= 400 && data.status < 500) {
-          var err = JSON.parse(data.responseText);
+      };
+      var finish = function() {
+        Codesearch.in_flight = null;
+        setTimeout(Codesearch.dispatch, 0);
+      };
+      xhr.onprogress = read_frames;
+      xhr.onload = function() {
+        if (xhr.status === 200) {
+          read_frames();
+          if (!done)
+            Codesearch.delegate.error(opts.id, "Incomplete response from server");
+        } else if (xhr.status >= 400 && xhr.status < 500) {
+          var err = JSON.parse(xhr.responseText);
           Codesearch.delegate.error(opts.id, err.error.message);
         } else {
-          var message = "Cannot connect to server";
-          if (data.status) {
-            message = "Bad response " + data.status + " from server";
-          }
-          Codesearch.delegate.error(opts.id, message);
-          console.log("server error", data.status, data.responseText);
+          window._err = xhr;
+          Codesearch.delegate.error(opts.id, "Bad response " + xhr.status + " from server");
+          console.log("server error", xhr.status, xhr.responseText);
         }
-      });
-      xhr.always(function() {
-        Codesearch.in_flight = null;
-        setTimeout(Codesearch.dispatch, 0);
-      });
+        finish();
+      };
+      xhr.onerror = function() {
+        Codesearch.delegate.error(opts.id, "Cannot connect to server");
+        finish();
+      };
+      xhr.open("GET", url);
+      xhr.send();
     }
   };
 }();
@@ -467,6 +467,35 @@ var SearchState = Backbone.Model.extend({
     return base + (qs ? "?" + qs : "");
   },
 
+  // search_url returns a URL under base that runs the current search
+  // again, with any extra parameters.
+  search_url: function(base, extra) {
+    var current = this.search_map[this.get('displaying')];
+    if (!current || current.q === "")
+      return null;
+    var url = base;
+    if (current.backend)
+      url += current.backend;
+    return url + "?" + $.param(_.extend({
+      q: current.q,
+      fold_case: current.fold_case,
+      regex: current.regex,
+      repo: current.repo
+    }, extra));
+  },
+
+  // export_url returns where to download every match of the current
+  // search, as "csv" or "json".
+  export_url: function(format) {
+    return this.search_url('/api/v1/export/', {format: format});
+  },
+
+  // permalink_url returns where to pin the current search's results to
+  // the index they came from.
+  permalink_url: function() {
+    return this.search_url('/permalink/new/', {});
+  },
+
   title: function() {
     var current = this.search_map[this.get('displaying')];
     if (!current || !current.q)
@@ -744,6 +773,15 @@ var ResultView = Backbone.View.extend({
       this.$('#searchtimebox').hide();
     }
 
+    this.$('#export-csv').attr('href', this.model.export_url('csv'));
+    this.$('#export-json').attr('href', this.model.export_url('json'));
+    if (CodesearchUI.permalinks) {
+      this.$('#permalink').attr('href', this.model.permalink_url());
+      this.$('#permalinkbox').show();
+    } else {
+      this.$('#permalinkbox').hide();
+    }
+
     var results;
     if (this.model.get('search_type') == 'filename_only') {
       results = '' + this.model.file_search_results.length;
@@ -988,6 +1026,7 @@ var CodesearchUI = function() {
 CodesearchUI.repo_urls = initData.repo_urls;
 CodesearchUI.internalViewRepos = initData.internal_view_repos;
 CodesearchUI.defaultSearchRepos = initData.default_search_repos;
+CodesearchUI.permalinks = initData.permalinks;
 CodesearchUI.linkConfigs = (initData.link_configs || []).map(function(link_config) {
   if (link_config.whitelist_pattern) {
     link_config.whitelist_pattern = new RegExp(link_config.whitelist_pattern);